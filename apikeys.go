@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"gitlab.com/johncolinsharp/entitycoll"
+	"log"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts every API key, telling them apart from access
+// tokens when given as a Bearer token
+const apiKeyPrefix = "jrv_"
+
+// apiKeyRequestor is the requestor of requests made with an API key,
+// the service account holding the key limited by the key's scope.
+// Collections tell it apart from logged in users by its type
+type apiKeyRequestor struct {
+	*user
+	key *entities.ApiKey
+}
+
+// requestorUser returns the account making a request, whether a user
+// logged in or a service account using an API key
+func requestorUser(requestor entitycoll.Entity) (*user, bool) {
+	switch r := withoutContext(requestor).(type) {
+	case *user:
+		return r, true
+	case *apiKeyRequestor:
+		return r.user, true
+	}
+	return nil, false
+}
+
+var errBadApiKey = entities.NewError(entities.Unauthorized, "invalid or expired API key")
+
+// verifyApiKey finds the service account an API key belongs to
+func (uc *userCollection) verifyApiKey(ctx context.Context, key string) (entitycoll.Entity, error) {
+	k, err := uc.getApiKey(ctx, tokenId(key))
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+		return nil, errBadApiKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if k.Expires != nil && !time.Now().Before(*k.Expires) {
+		return nil, errBadApiKey
+	}
+
+	u, err := uc.getUserByUuid(ctx, k.UserId)
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+		return nil, errBadApiKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &apiKeyRequestor{user: (*user)(u), key: k}, nil
+}
+
+// verifyBearer finds the requestor of a Bearer token, which is either
+// an access token or an API key
+func (uc *userCollection) verifyBearer(ctx context.Context, token string) (entitycoll.Entity, error) {
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		return uc.verifyApiKey(ctx, token)
+	}
+	return uc.verifyToken(ctx, token)
+}
+
+// authorizeScope checks that the scope of the API key a request is
+// made with, if it is, allows act on the collection restName
+func authorizeScope(requestor entitycoll.Entity, restName string, act action) error {
+	r, ok := withoutContext(requestor).(*apiKeyRequestor)
+	if !ok {
+		return nil
+	}
+
+	switch r.key.Scope {
+	case entities.ScopeFull:
+		return nil
+	case entities.ScopeRead:
+		if act == actionRead {
+			return nil
+		}
+	case entities.ScopePost:
+		if act == actionRead || act == actionCreate && restName == messages.GetRestName() {
+			return nil
+		}
+	}
+	return entities.NewError(entities.Forbidden, "a "+string(r.key.Scope)+" API key cannot "+string(act)+" "+restName)
+}
+
+// authorizeThread checks that the API key a request is made with, if
+// it is, may post to the thread in parentEntityUuids
+func authorizeThread(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID) error {
+	return authorizeThreadId(requestor, parentEntityUuids[threads.GetRestName()])
+}
+
+// authorizeThreadId checks that the API key a request is made with, if
+// it is, is not limited to threads other than threadId
+func authorizeThreadId(requestor entitycoll.Entity, threadId uuid.UUID) error {
+	r, ok := withoutContext(requestor).(*apiKeyRequestor)
+	if !ok || len(r.key.Threads) == 0 {
+		return nil
+	}
+
+	for _, id := range r.key.Threads {
+		if uuid.Equal(id, threadId) {
+			return nil
+		}
+	}
+	return entities.NewError(entities.Forbidden, "this API key cannot use this thread")
+}
+
+func validScope(scope entities.ApiKeyScope) bool {
+	for _, s := range entities.ApiKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceAccountCommand creates a service account, `jerver
+// service-account <username> [role]`, to hold API keys. Its role is
+// member unless given
+func serviceAccountCommand(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("service-account needs a username and optionally a role")
+	}
+	if !usernameRegexp.MatchString(args[0]) {
+		return fmt.Errorf("username must be 3 to 32 letters, digits, '_', '.' or '-'")
+	}
+	role := entities.RoleMember
+	if len(args) == 2 {
+		role = entities.Role(args[1])
+		if !validRole(role) {
+			return fmt.Errorf("unknown role %q", args[1])
+		}
+	}
+
+	b, err := openForCommand()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	u := entities.User{
+		Username: args[0],
+		// never matches a password, service accounts only use keys
+		HashedPwd: []byte{},
+		Approved:  true,
+		Role:      role,
+		Service:   true,
+	}
+	u.Uuid, _ = uuid.NewV4()
+	if err = b.CreateUser(context.Background(), &u, ""); err != nil {
+		return err
+	}
+	log.Printf("created service account %s (%s) as %s", u.Username, u.Uuid, role)
+	return nil
+}
+
+// apiKeyCommand manages the API keys of service accounts:
+//
+//	jerver apikey create [-scope full|read|post] [-threads <id>,...] [-expires <duration>] <username> <name>
+//	jerver apikey list <username>
+//	jerver apikey revoke <username> <name>
+//
+// A key is only ever shown when it is created
+func apiKeyCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("apikey needs one of create, list or revoke")
+	}
+
+	fs := flag.NewFlagSet("apikey "+args[0], flag.ExitOnError)
+	scope := fs.String("scope", string(entities.ScopeFull), "what the key may do (full, read or post)")
+	threadIds := fs.String("threads", "", "comma separated threads a post key may post to, any if empty")
+	var expiresIn duration
+	fs.Var(&expiresIn, "expires", "how long until the key expires, never if not given")
+	fs.Parse(args[1:])
+
+	b, err := openForCommand()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	ctx := context.Background()
+	if fs.NArg() < 1 {
+		return fmt.Errorf("apikey %s needs the username of a service account", args[0])
+	}
+	u, err := b.GetUserByUsername(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if !u.Service {
+		return fmt.Errorf("%s is not a service account", u.Username)
+	}
+
+	switch args[0] {
+	case "create":
+		if fs.NArg() != 2 {
+			return fmt.Errorf("apikey create needs a username and a key name")
+		}
+		k := entities.ApiKey{
+			UserId:  u.Uuid,
+			Name:    fs.Arg(1),
+			Scope:   entities.ApiKeyScope(*scope),
+			Created: time.Now().UTC(),
+		}
+		if !validScope(k.Scope) {
+			return fmt.Errorf("unknown scope %q", *scope)
+		}
+		if *threadIds != "" {
+			if k.Scope != entities.ScopePost {
+				return fmt.Errorf("only post keys are limited to threads")
+			}
+			for _, s := range strings.Split(*threadIds, ",") {
+				id, err := uuid.FromString(s)
+				if err != nil {
+					return fmt.Errorf("bad thread id %q", s)
+				}
+				k.Threads = append(k.Threads, id)
+			}
+		}
+		if expiresIn > 0 {
+			expires := k.Created.Add(time.Duration(expiresIn))
+			k.Expires = &expires
+		}
+
+		token, err := newToken()
+		if err != nil {
+			return err
+		}
+		key := apiKeyPrefix + token
+		k.Id = tokenId(key)
+		if err = b.CreateApiKey(ctx, &k); err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	case "list":
+		return b.GetUserApiKeys(ctx, u.Uuid, func(k entities.ApiKey) {
+			expires := "never"
+			if k.Expires != nil {
+				expires = k.Expires.Format(time.RFC3339)
+			}
+			fmt.Printf("%s\tscope %s\tthreads %d\tcreated %s\texpires %s\n",
+				k.Name, k.Scope, len(k.Threads), k.Created.Format(time.RFC3339), expires)
+		})
+	case "revoke":
+		if fs.NArg() != 2 {
+			return fmt.Errorf("apikey revoke needs a username and a key name")
+		}
+		if err = b.DeleteApiKey(ctx, u.Uuid, fs.Arg(1)); err != nil {
+			return err
+		}
+		log.Printf("revoked API key %s of %s", fs.Arg(1), u.Username)
+		return nil
+	default:
+		return fmt.Errorf("unknown apikey command %q", args[0])
+	}
+}
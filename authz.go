@@ -0,0 +1,144 @@
+package main
+
+import (
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"gitlab.com/johncolinsharp/entitycoll"
+)
+
+// action is what a request does to a collection
+type action string
+
+const (
+	actionRead   action = "read"
+	actionCreate action = "create"
+	actionEdit   action = "edit"
+	actionDelete action = "delete"
+)
+
+var (
+	anyRole     = []entities.Role{entities.RoleAdmin, entities.RoleModerator, entities.RoleMember, entities.RoleReadOnly}
+	writerRoles = []entities.Role{entities.RoleAdmin, entities.RoleModerator, entities.RoleMember}
+	staffRoles  = []entities.Role{entities.RoleAdmin, entities.RoleModerator}
+	adminRoles  = []entities.Role{entities.RoleAdmin}
+)
+
+// permissions maps each collection, by rest name, and action on to the
+// roles allowed to take it. These are checked before the collection is
+// called, which may then check further, as messages do for ownership
+// and users do for profiles. Users are created by registering rather
+// than through the collection, and cannot be deleted
+var permissions = map[string]map[action][]entities.Role{
+	"threads": {
+		actionRead:   anyRole,
+		actionCreate: writerRoles,
+		actionEdit:   staffRoles,
+		actionDelete: staffRoles,
+	},
+	"messages": {
+		actionRead:   anyRole,
+		actionCreate: writerRoles,
+		actionEdit:   writerRoles,
+		actionDelete: writerRoles,
+	},
+	"users": {
+		actionRead: anyRole,
+		actionEdit: anyRole,
+	},
+	"webhooks": {
+		actionRead:   adminRoles,
+		actionCreate: adminRoles,
+		actionEdit:   adminRoles,
+		actionDelete: adminRoles,
+	},
+}
+
+// authorize checks the permissions table for requestor taking act on
+// the collection restName, and the scope of the API key if the request
+// is made with one
+func authorize(requestor entitycoll.Entity, restName string, act action) error {
+	u, ok := requestorUser(requestor)
+	if !ok {
+		return entities.NewError(entities.Forbidden, "not logged in")
+	}
+
+	for _, role := range permissions[restName][act] {
+		if u.Role == role {
+			return authorizeScope(requestor, restName, act)
+		}
+	}
+	return entities.NewError(entities.Forbidden, "a "+string(u.Role)+" cannot "+string(act)+" "+restName)
+}
+
+// authorizedCollection is registered with entitycoll in place of each
+// collection, so that every call is checked against the permissions
+// table first
+type authorizedCollection struct {
+	entitycoll.EntityCollection
+}
+
+func (ac authorizedCollection) CreateEntity(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID, body []byte) (string, error) {
+	if err := authorize(requestor, ac.GetRestName(), actionCreate); err != nil {
+		return "", err
+	}
+	if err := authorizeThread(requestor, parentEntityUuids); err != nil {
+		return "", err
+	}
+	return ac.EntityCollection.CreateEntity(requestor, parentEntityUuids, body)
+}
+
+func (ac authorizedCollection) GetEntity(requestor entitycoll.Entity, targetUuid uuid.UUID) (entitycoll.Entity, error) {
+	if err := authorize(requestor, ac.GetRestName(), actionRead); err != nil {
+		return nil, err
+	}
+	return ac.EntityCollection.GetEntity(requestor, targetUuid)
+}
+
+func (ac authorizedCollection) GetCollection(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID, filter entitycoll.CollFilter) (entitycoll.Collection, error) {
+	if err := authorize(requestor, ac.GetRestName(), actionRead); err != nil {
+		return entitycoll.Collection{}, err
+	}
+	return ac.EntityCollection.GetCollection(requestor, parentEntityUuids, filter)
+}
+
+func (ac authorizedCollection) EditEntity(requestor entitycoll.Entity, targetUuid uuid.UUID, body []byte) error {
+	if err := authorize(requestor, ac.GetRestName(), actionEdit); err != nil {
+		return err
+	}
+	return ac.EntityCollection.EditEntity(requestor, targetUuid, body)
+}
+
+func (ac authorizedCollection) DelEntity(requestor entitycoll.Entity, targetUuid uuid.UUID) error {
+	if err := authorize(requestor, ac.GetRestName(), actionDelete); err != nil {
+		return err
+	}
+	return ac.EntityCollection.DelEntity(requestor, targetUuid)
+}
+
+// isModerator reports whether u may act on content it does not own
+func isModerator(u *user) bool {
+	return u.Role == entities.RoleModerator || u.Role == entities.RoleAdmin
+}
+
+// authorizeOwner allows the requestor to change content owned by
+// ownerId if it is the owner or a moderator, what names the content
+// for the error
+func authorizeOwner(requestor entitycoll.Entity, ownerId uuid.UUID, what string) error {
+	u, ok := requestorUser(requestor)
+	if !ok {
+		return entities.NewError(entities.Forbidden, "not logged in")
+	}
+	if uuid.Equal(u.Uuid, ownerId) || isModerator(u) {
+		return nil
+	}
+	return entities.NewError(entities.Forbidden, "only its author or a moderator can change this "+what)
+}
+
+// authorizeModerator allows only moderators, for changes to protected
+// fields, what names the change for the error
+func authorizeModerator(requestor entitycoll.Entity, what string) error {
+	if u, ok := requestorUser(requestor); ok && isModerator(u) {
+		return nil
+	}
+	return entities.NewError(entities.Forbidden, "only a moderator can "+what)
+}
@@ -0,0 +1,292 @@
+// Package backend defines the storage interface used by the jerver
+// server. Each of the dbbackend packages (pgsql-dbbackend,
+// sqlite-dbbackend) provides an implementation, and the server picks
+// one at startup
+package backend
+
+import (
+	"context"
+	"errors"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Config holds the settings needed to open a Backend
+type Config struct {
+	// DataSource is passed to the database driver, a connection
+	// string for postgres or a file path for sqlite
+	DataSource string
+
+	// RetryInterval is the wait after the first failed attempt to
+	// open the backend, doubling after every further failure up to
+	// MaxRetryInterval
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+
+	// Migrate has the backend bring its schema up to date when it is
+	// opened
+	Migrate bool
+}
+
+// OpenFunc opens a Backend, each dbbackend package provides one as
+// its Open function
+type OpenFunc func(config Config) (Backend, error)
+
+var ErrUnavailable = entities.NewError(entities.Unavailable, "storage backend unavailable")
+
+// ErrUnsupported is returned, wrapped, by an OpenFunc that can never
+// succeed, as when the database lacks something the backend needs
+var ErrUnsupported = errors.New("storage backend unsupported")
+var ErrTimeout = entities.NewError(entities.Unavailable, "storage backend query timed out")
+
+// Cursor marks a position in an ordered collection. Collections are
+// ordered by Created and then by Id, a collection read after a Cursor
+// starts with the entity following that position
+type Cursor struct {
+	Created time.Time
+	Id      uuid.UUID
+}
+
+// LikePrefix returns the LIKE pattern, escaped with '\', matching the
+// lower case strings that start with prefix in lower case
+func LikePrefix(prefix string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(prefix))
+	return escaped + "%"
+}
+
+// SearchQuery is a full-text search of message contents and thread
+// titles. Every one of Terms must match, the backends matching them
+// against words with the same stem. The search covers messages and
+// threads as Messages and Threads are set, and is narrowed by the
+// other fields that are set, AuthorId matching only messages
+type SearchQuery struct {
+	Terms    []string
+	Messages bool
+	Threads  bool
+	AuthorId *uuid.UUID
+	ThreadId *uuid.UUID
+	Since    *time.Time
+	Until    *time.Time
+}
+
+// the matches in the Snippet of a SearchResult are between SnippetStart
+// and SnippetEnd, characters that are not expected in text
+const (
+	SnippetStart = "\x02"
+	SnippetEnd   = "\x03"
+)
+
+// SearchTerms splits text into the lower case words, of letters and
+// digits, to search for
+func SearchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// JoinUuids and SplitUuids store a list of UUIDs, such as the threads of
+// an API key, as comma separated text
+func JoinUuids(ids []uuid.UUID) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = id.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func SplitUuids(s string) ([]uuid.UUID, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var ids []uuid.UUID
+	for _, part := range strings.Split(s, ",") {
+		id, err := uuid.FromString(part)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// JoinEvents and SplitEvents store the events a webhook is for as comma
+// separated text
+func JoinEvents(events []string) string {
+	return strings.Join(events, ",")
+}
+
+func SplitEvents(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+type Backend interface {
+	// Ping reports whether the underlying database can currently be
+	// reached
+	Ping(ctx context.Context) error
+	// Close releases the prepared statements and database handle
+	Close() error
+	// Subscribe has handler called with the events of changes made by
+	// this instance of the server, and by any others sharing its
+	// database, until unsubscribe is called
+	Subscribe(handler func(Event)) (unsubscribe func())
+
+	GetMessageByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.Message, error)
+	CreateMessage(ctx context.Context, m *entities.Message) error
+	DeleteMessageByUuid(ctx context.Context, targetUuid uuid.UUID) error
+	GetMessageCollection(ctx context.Context, threadId uuid.UUID, count uint64, page int64, appendToCollection func(entities.Message)) error
+	// GetMessageCollectionAfter pages by keyset rather than offset,
+	// after is nil to start from the first message of the thread
+	GetMessageCollectionAfter(ctx context.Context, threadId uuid.UUID, after *Cursor, count uint64, appendToCollection func(entities.Message)) error
+	GetMessageTotal(ctx context.Context, threadId uuid.UUID) (uint, error)
+	EditMessageByUuid(ctx context.Context, targetUuid uuid.UUID, m *entities.MessageEdit) error
+
+	GetThreadByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.Thread, error)
+	CreateThread(ctx context.Context, t *entities.Thread) error
+	DeleteThreadByUuid(ctx context.Context, targetUuid uuid.UUID) error
+	GetThreadCollection(ctx context.Context, count uint64, page int64, appendToCollection func(entities.Thread)) error
+	GetThreadCollectionAfter(ctx context.Context, after *Cursor, count uint64, appendToCollection func(entities.Thread)) error
+	GetThreadTotal(ctx context.Context) (uint, error)
+	EditThreadByUuid(ctx context.Context, targetUuid uuid.UUID, t *entities.ThreadEdit) error
+	// ReconcileThreadStats recomputes the NumMsgs and LastMsgTime of
+	// every thread from its messages
+	ReconcileThreadStats(ctx context.Context) error
+
+	// Search reads the results of q, the best matches first, newer
+	// results coming first among equal matches
+	Search(ctx context.Context, q *SearchQuery, count uint64, page int64, appendToCollection func(entities.SearchResult)) error
+	SearchTotal(ctx context.Context, q *SearchQuery) (uint, error)
+
+	GetUserByUsername(ctx context.Context, uname string) (*entities.User, error)
+	GetUserByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.User, error)
+	// GetUserCollection and GetUserTotal read the users whose usernames
+	// start with prefix, regardless of case, ordered by username
+	GetUserCollection(ctx context.Context, prefix string, count uint64, page int64, appendToCollection func(entities.User)) error
+	GetUserTotal(ctx context.Context, prefix string) (uint, error)
+	// EditUserByUuid sets the fields of u that are not nil, all at once
+	EditUserByUuid(ctx context.Context, targetUuid uuid.UUID, u *entities.UserEdit) error
+	// CreateUser adds u, redeeming inviteCode for it unless that is
+	// empty. Usernames are unique regardless of case
+	CreateUser(ctx context.Context, u *entities.User, inviteCode string) error
+	SetUserRole(ctx context.Context, targetUuid uuid.UUID, role entities.Role) error
+	// SetUserPassword replaces the password hash of a user, bumping its
+	// TokenGeneration, and in the same transaction revokes all of its
+	// sessions and password resets
+	SetUserPassword(ctx context.Context, targetUuid uuid.UUID, hashedPwd []byte) error
+	// UpgradeUserPassword replaces the password hash of a user with a
+	// new hash of the same password, keeping its sessions. It does
+	// nothing, returning a NotFound error, if the hash is no longer
+	// oldHash
+	UpgradeUserPassword(ctx context.Context, targetUuid uuid.UUID, oldHash, newHash []byte) error
+	// ApproveUser lets a user that registered awaiting approval log in
+	ApproveUser(ctx context.Context, uname string) error
+	// CreateInvite stores a new, unused, invite code
+	CreateInvite(ctx context.Context, code string) error
+
+	CreateSession(ctx context.Context, s *entities.Session) error
+	// TakeSession removes the session with id and returns it, so that
+	// each refresh token can only be used once
+	TakeSession(ctx context.Context, id string) (*entities.Session, error)
+	// DeleteUserSessions revokes every refresh token of a user
+	DeleteUserSessions(ctx context.Context, userId uuid.UUID) error
+
+	CreatePasswordReset(ctx context.Context, r *entities.PasswordReset) error
+	// TakePasswordReset removes the password reset with id and returns
+	// it, so that each reset token can only be used once
+	TakePasswordReset(ctx context.Context, id string) (*entities.PasswordReset, error)
+	// ReplacePasswordReset moves the password reset with oldId to newId
+	// and returns it, so that a new token can be sent for it. A NotFound
+	// error is returned if the reset has been used or revoked
+	ReplacePasswordReset(ctx context.Context, oldId, newId string) (*entities.PasswordReset, error)
+
+	RecordSecurityEvent(ctx context.Context, e *entities.SecurityEvent) error
+
+	// CreateApiKey stores a new key, names are unique for each user
+	CreateApiKey(ctx context.Context, k *entities.ApiKey) error
+	GetApiKey(ctx context.Context, id string) (*entities.ApiKey, error)
+	GetUserApiKeys(ctx context.Context, userId uuid.UUID, appendToCollection func(entities.ApiKey)) error
+	// DeleteApiKey revokes the key of a user with name
+	DeleteApiKey(ctx context.Context, userId uuid.UUID, name string) error
+
+	CreateWebhook(ctx context.Context, w *entities.Webhook) error
+	GetWebhook(ctx context.Context, id uuid.UUID) (*entities.Webhook, error)
+	// GetWebhooks reads every webhook, in the order they were created
+	GetWebhooks(ctx context.Context, appendToCollection func(entities.Webhook)) error
+	EditWebhookByUuid(ctx context.Context, id uuid.UUID, w *entities.WebhookEdit) error
+	// DeleteWebhookByUuid removes a webhook along with its deliveries
+	DeleteWebhookByUuid(ctx context.Context, id uuid.UUID) error
+
+	// CreateWebhookDelivery fails with a Conflict error if the event has
+	// already been delivered to the webhook
+	CreateWebhookDelivery(ctx context.Context, d *entities.WebhookDelivery) error
+	// UpdateWebhookDelivery stores the Status, Attempts,
+	// ResponseStatus, Error and Updated of d
+	UpdateWebhookDelivery(ctx context.Context, d *entities.WebhookDelivery) error
+	GetWebhookDelivery(ctx context.Context, id uuid.UUID) (*entities.WebhookDelivery, error)
+	// GetWebhookDeliveries reads the deliveries to a webhook, the most
+	// recent first
+	GetWebhookDeliveries(ctx context.Context, webhookId uuid.UUID, count uint64, page int64, appendToCollection func(entities.WebhookDelivery)) error
+	GetWebhookDeliveryTotal(ctx context.Context, webhookId uuid.UUID) (uint, error)
+
+	CreateJob(ctx context.Context, j *entities.Job) error
+	// ClaimJob leases the pending job with the earliest RunAt not after
+	// now, or a running job whose lease ended by now, to the caller
+	// until now+lease, counting an attempt at it. Every instance of the
+	// server may claim at once, no job being given to two of them. A
+	// NotFound error is returned if no job is due
+	ClaimJob(ctx context.Context, now time.Time, lease time.Duration) (*entities.Job, error)
+	// UpdateJob stores the Payload, Status, Attempts, Error, RunAt,
+	// LockedUntil and Updated of j
+	UpdateJob(ctx context.Context, j *entities.Job) error
+	DeleteJob(ctx context.Context, id uuid.UUID) error
+	GetJob(ctx context.Context, id uuid.UUID) (*entities.Job, error)
+	// GetJobs reads the jobs with status, the soonest due first
+	GetJobs(ctx context.Context, status entities.JobStatus, count uint64, page int64, appendToCollection func(entities.Job)) error
+}
+
+const defaultRetryInterval = 500 * time.Millisecond
+const defaultMaxRetryInterval = 30 * time.Second
+
+// OpenWithRetry calls open until it succeeds, backing off
+// exponentially between attempts. If stop is closed before a Backend
+// could be opened ErrUnavailable is returned, and if open fails with
+// ErrUnsupported it is returned without retrying
+func OpenWithRetry(open OpenFunc, config Config, stop <-chan struct{}) (Backend, error) {
+	interval := config.RetryInterval
+	if interval <= 0 {
+		interval = defaultRetryInterval
+	}
+	maxInterval := config.MaxRetryInterval
+	if maxInterval <= 0 {
+		maxInterval = defaultMaxRetryInterval
+	}
+
+	for {
+		b, err := open(config)
+		if err == nil {
+			return b, nil
+		}
+		if errors.Is(err, ErrUnsupported) {
+			return nil, err
+		}
+		log.Printf("could not open storage backend, retrying in %s: %s", interval, err)
+
+		select {
+		case <-stop:
+			return nil, ErrUnavailable
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
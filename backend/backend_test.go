@@ -0,0 +1,72 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		text  string
+		terms []string
+	}{
+		{"", []string{}},
+		{"   ", []string{}},
+		{"!?, -", []string{}},
+		{"Asquith", []string{"asquith"}},
+		{"Lloyd George", []string{"lloyd", "george"}},
+		{"  best   PM? ", []string{"best", "pm"}},
+		{"Who's the best", []string{"who", "s", "the", "best"}},
+		{"Gascoyne-Cecil 1895", []string{"gascoyne", "cecil", "1895"}},
+		{"café Über", []string{"café", "über"}},
+		{"ΣΟΦΙΑ", []string{"σοφια"}},
+		{"日本語,テキスト", []string{"日本語", "テキスト"}},
+	}
+	for _, test := range tests {
+		if terms := SearchTerms(test.text); !reflect.DeepEqual(terms, test.terms) {
+			t.Errorf("SearchTerms(%q) = %q, want %q", test.text, terms, test.terms)
+		}
+	}
+}
+
+func TestOpenWithRetry(t *testing.T) {
+	failed := errors.New("connection refused")
+	unsupported := fmt.Errorf("%w: no FTS5", ErrUnsupported)
+	tests := []struct {
+		name string
+		// errs are returned by the attempts to open, in turn, the
+		// attempt after the last succeeding
+		errs     []error
+		attempts int
+		err      error
+	}{
+		{"opens", nil, 1, nil},
+		{"retries", []error{failed, failed}, 3, nil},
+		{"unsupported", []error{unsupported}, 1, unsupported},
+		{"unsupported after retrying", []error{failed, unsupported}, 2, unsupported},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			open := func(config Config) (Backend, error) {
+				attempts += 1
+				if attempts <= len(test.errs) {
+					return nil, test.errs[attempts-1]
+				}
+				return Unavailable{}, nil
+			}
+			config := Config{RetryInterval: time.Millisecond}
+
+			b, err := OpenWithRetry(open, config, make(chan struct{}))
+			if err != test.err || (b == nil) != (err != nil) {
+				t.Fatalf("got %v, %v, want error %v", b, err, test.err)
+			}
+			if attempts != test.attempts {
+				t.Fatalf("opened %d times, want %d", attempts, test.attempts)
+			}
+		})
+	}
+}
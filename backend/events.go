@@ -0,0 +1,132 @@
+package backend
+
+import (
+	"github.com/satori/go.uuid"
+	"sync"
+)
+
+// EventType names a change published on the event bus of a Backend
+type EventType string
+
+const (
+	MessageCreated EventType = "message.created"
+	MessageEdited  EventType = "message.edited"
+	MessageDeleted EventType = "message.deleted"
+	ThreadCreated  EventType = "thread.created"
+	ThreadEdited   EventType = "thread.edited"
+	ThreadDeleted  EventType = "thread.deleted"
+	// EventsLost is published when events may have been missed, such
+	// as while reconnecting to the database, so that subscribers can
+	// start afresh
+	EventsLost EventType = "events.lost"
+)
+
+// Event is a change made to a message or thread through a Backend.
+// Only ids are carried, as events passed between instances of the
+// server are limited in size, subscribers read anything else they need
+// from the Backend
+type Event struct {
+	// Id is given to each event as it is published
+	Id       uuid.UUID
+	Type     EventType
+	ThreadId uuid.UUID
+	// MessageId is uuid.Nil for thread events
+	MessageId uuid.UUID
+	// PrevThreadId is the thread a message was moved out of by a
+	// MessageEdited event, otherwise uuid.Nil
+	PrevThreadId uuid.UUID
+}
+
+// Bus passes events to the handlers subscribed to it in this process.
+// Handlers are called one event at a time, in the order the events were
+// published, from a goroutine of the Bus's own so that publishing never
+// waits on them
+type Bus struct {
+	mu       sync.Mutex
+	handlers map[*func(Event)]struct{}
+	queue    []Event
+	wake     chan struct{}
+	done     chan struct{}
+}
+
+func NewBus() *Bus {
+	bus := &Bus{
+		handlers: map[*func(Event)]struct{}{},
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go bus.run()
+	return bus
+}
+
+// Subscribe has handler called with every event published until
+// unsubscribe is called
+func (bus *Bus) Subscribe(handler func(Event)) (unsubscribe func()) {
+	h := &handler
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.handlers[h] = struct{}{}
+
+	return func() {
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+		delete(bus.handlers, h)
+	}
+}
+
+// Publish queues e for the handlers, it is safe to call while holding
+// locks that the handlers take
+func (bus *Bus) Publish(e Event) {
+	if uuid.Equal(e.Id, uuid.Nil) {
+		e.Id, _ = uuid.NewV4()
+	}
+
+	bus.mu.Lock()
+	bus.queue = append(bus.queue, e)
+	bus.mu.Unlock()
+
+	select {
+	case bus.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the Bus, events still queued are dropped
+func (bus *Bus) Close() {
+	close(bus.done)
+}
+
+func (bus *Bus) run() {
+	for {
+		select {
+		case <-bus.done:
+			return
+		case <-bus.wake:
+		}
+
+		bus.mu.Lock()
+		queue := bus.queue
+		bus.queue = nil
+		handlers := make([]func(Event), 0, len(bus.handlers))
+		for h := range bus.handlers {
+			handlers = append(handlers, *h)
+		}
+		bus.mu.Unlock()
+
+		for _, e := range queue {
+			for _, handler := range handlers {
+				handler(e)
+			}
+		}
+	}
+}
+
+// MessageEditedEvent is the event of an edit to a message in
+// oldThreadId, moving it to newThreadId unless that is nil
+func MessageEditedEvent(messageId, oldThreadId uuid.UUID, newThreadId *uuid.UUID) Event {
+	e := Event{Type: MessageEdited, ThreadId: oldThreadId, MessageId: messageId}
+	if newThreadId != nil && !uuid.Equal(*newThreadId, oldThreadId) {
+		e.ThreadId, e.PrevThreadId = *newThreadId, oldThreadId
+	}
+	return e
+}
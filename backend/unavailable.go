@@ -0,0 +1,245 @@
+package backend
+
+import (
+	"context"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"time"
+)
+
+// Unavailable stands in for a Backend that has not been opened yet,
+// every call fails with ErrUnavailable
+type Unavailable struct{}
+
+func (Unavailable) Ping(ctx context.Context) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) Close() error {
+	return nil
+}
+
+// Subscribe does nothing, as no changes can be made
+func (Unavailable) Subscribe(handler func(Event)) func() {
+	return func() {}
+}
+
+func (Unavailable) GetMessageByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.Message, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) CreateMessage(ctx context.Context, m *entities.Message) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) DeleteMessageByUuid(ctx context.Context, targetUuid uuid.UUID) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetMessageCollection(ctx context.Context, threadId uuid.UUID, count uint64, page int64, appendToCollection func(entities.Message)) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetMessageCollectionAfter(ctx context.Context, threadId uuid.UUID, after *Cursor, count uint64, appendToCollection func(entities.Message)) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetMessageTotal(ctx context.Context, threadId uuid.UUID) (uint, error) {
+	return 0, ErrUnavailable
+}
+
+func (Unavailable) EditMessageByUuid(ctx context.Context, targetUuid uuid.UUID, m *entities.MessageEdit) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetThreadByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.Thread, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) CreateThread(ctx context.Context, t *entities.Thread) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) DeleteThreadByUuid(ctx context.Context, targetUuid uuid.UUID) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetThreadCollection(ctx context.Context, count uint64, page int64, appendToCollection func(entities.Thread)) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetThreadCollectionAfter(ctx context.Context, after *Cursor, count uint64, appendToCollection func(entities.Thread)) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetThreadTotal(ctx context.Context) (uint, error) {
+	return 0, ErrUnavailable
+}
+
+func (Unavailable) EditThreadByUuid(ctx context.Context, targetUuid uuid.UUID, t *entities.ThreadEdit) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) ReconcileThreadStats(ctx context.Context) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetUserByUsername(ctx context.Context, uname string) (*entities.User, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) GetUserByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.User, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) GetUserCollection(ctx context.Context, prefix string, count uint64, page int64, appendToCollection func(entities.User)) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetUserTotal(ctx context.Context, prefix string) (uint, error) {
+	return 0, ErrUnavailable
+}
+
+func (Unavailable) EditUserByUuid(ctx context.Context, targetUuid uuid.UUID, u *entities.UserEdit) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) CreateUser(ctx context.Context, u *entities.User, inviteCode string) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) SetUserRole(ctx context.Context, targetUuid uuid.UUID, role entities.Role) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) SetUserPassword(ctx context.Context, targetUuid uuid.UUID, hashedPwd []byte) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) UpgradeUserPassword(ctx context.Context, targetUuid uuid.UUID, oldHash, newHash []byte) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) ApproveUser(ctx context.Context, uname string) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) CreateInvite(ctx context.Context, code string) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) CreateSession(ctx context.Context, s *entities.Session) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) TakeSession(ctx context.Context, id string) (*entities.Session, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) DeleteUserSessions(ctx context.Context, userId uuid.UUID) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) CreatePasswordReset(ctx context.Context, r *entities.PasswordReset) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) TakePasswordReset(ctx context.Context, id string) (*entities.PasswordReset, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) ReplacePasswordReset(ctx context.Context, oldId, newId string) (*entities.PasswordReset, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) RecordSecurityEvent(ctx context.Context, e *entities.SecurityEvent) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) CreateApiKey(ctx context.Context, k *entities.ApiKey) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetApiKey(ctx context.Context, id string) (*entities.ApiKey, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) GetUserApiKeys(ctx context.Context, userId uuid.UUID, appendToCollection func(entities.ApiKey)) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) DeleteApiKey(ctx context.Context, userId uuid.UUID, name string) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) CreateWebhook(ctx context.Context, w *entities.Webhook) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetWebhook(ctx context.Context, id uuid.UUID) (*entities.Webhook, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) GetWebhooks(ctx context.Context, appendToCollection func(entities.Webhook)) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) EditWebhookByUuid(ctx context.Context, id uuid.UUID, w *entities.WebhookEdit) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) DeleteWebhookByUuid(ctx context.Context, id uuid.UUID) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) CreateWebhookDelivery(ctx context.Context, d *entities.WebhookDelivery) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) UpdateWebhookDelivery(ctx context.Context, d *entities.WebhookDelivery) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetWebhookDelivery(ctx context.Context, id uuid.UUID) (*entities.WebhookDelivery, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) GetWebhookDeliveries(ctx context.Context, webhookId uuid.UUID, count uint64, page int64, appendToCollection func(entities.WebhookDelivery)) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetWebhookDeliveryTotal(ctx context.Context, webhookId uuid.UUID) (uint, error) {
+	return 0, ErrUnavailable
+}
+
+func (Unavailable) CreateJob(ctx context.Context, j *entities.Job) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) ClaimJob(ctx context.Context, now time.Time, lease time.Duration) (*entities.Job, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) UpdateJob(ctx context.Context, j *entities.Job) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) DeleteJob(ctx context.Context, id uuid.UUID) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) GetJob(ctx context.Context, id uuid.UUID) (*entities.Job, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) GetJobs(ctx context.Context, status entities.JobStatus, count uint64, page int64, appendToCollection func(entities.Job)) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) Search(ctx context.Context, q *SearchQuery, count uint64, page int64, appendToCollection func(entities.SearchResult)) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) SearchTotal(ctx context.Context, q *SearchQuery) (uint, error) {
+	return 0, ErrUnavailable
+}
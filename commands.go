@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"log"
+	"os"
+	"strconv"
+)
+
+// commands can be named on the command line after any flags, e.g.
+// `jerver -backend sqlite reconcile`, to run them against the backend
+// in place of the server
+var commands = map[string]func(args []string) error{
+	"reconcile": reconcileCommand,
+	"migrate":   migrateCommand,
+	"invite":    inviteCommand,
+	"approve":   approveCommand,
+	"role":      roleCommand,
+
+	"service-account": serviceAccountCommand,
+	"apikey":          apiKeyCommand,
+	"jobs":            jobsCommand,
+}
+
+func runCommand(args []string) error {
+	command, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return command(args[1:])
+}
+
+// openForCommand opens the configured backend, without retrying
+func openForCommand() (backend.Backend, error) {
+	return backends[conf.Backend](conf.backendConfig())
+}
+
+// reconcileCommand recomputes the message count and last message time
+// of every thread, for when they have drifted from the messages
+func reconcileCommand(args []string) error {
+	b, err := openForCommand()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	err = b.ReconcileThreadStats(context.Background())
+	if err == nil {
+		log.Print("thread stats reconciled")
+	}
+	return err
+}
+
+// migrateCommand changes the schema of the configured backend:
+//
+//	jerver migrate up [-dry-run]
+//	jerver migrate down [-dry-run] [steps]
+//	jerver migrate status
+//
+// With -dry-run the SQL of the migrations is printed instead of run
+func migrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("migrate needs one of up, down or status")
+	}
+
+	newMigrator, ok := migrators[conf.Backend]
+	if !ok {
+		return fmt.Errorf("%s backend has no schema to migrate", conf.Backend)
+	}
+
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print the migrations instead of running them")
+	fs.Parse(args[1:])
+
+	config := conf.backendConfig()
+	m, err := newMigrator(config)
+	if err != nil {
+		return err
+	}
+	defer m.DB.Close()
+	m.Out = os.Stdout
+	m.DryRun = *dryRun
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		return m.Up(ctx)
+	case "down":
+		steps := 1
+		if fs.NArg() > 0 {
+			steps, err = strconv.Atoi(fs.Arg(0))
+			if err != nil || steps < 1 {
+				return fmt.Errorf("bad number of steps %q", fs.Arg(0))
+			}
+		}
+		return m.Down(ctx, steps)
+	case "status":
+		return m.Status(ctx, os.Stdout)
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
+
+// inviteCommand creates an invite code and prints it, for handing to
+// someone who is to register while registration is by invite
+func inviteCommand(args []string) error {
+	b, err := openForCommand()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	code, err := newInviteCode()
+	if err != nil {
+		return err
+	}
+	if err = b.CreateInvite(context.Background(), code); err != nil {
+		return err
+	}
+	fmt.Println(code)
+	return nil
+}
+
+// approveCommand lets the users named in args, who registered while
+// registration needed approval, log in
+func approveCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("approve needs the usernames to approve")
+	}
+
+	b, err := openForCommand()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	for _, uname := range args {
+		if err = b.ApproveUser(context.Background(), uname); err != nil {
+			return fmt.Errorf("approving %s: %s", uname, err)
+		}
+		log.Printf("approved %s", uname)
+	}
+	return nil
+}
+
+// roleCommand gives a user a role, `jerver role <username> <role>`. It
+// is how the first admin is made, after which admins can change roles
+// through the users API
+func roleCommand(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("role needs a username and a role")
+	}
+	role := entities.Role(args[1])
+	if !validRole(role) {
+		return fmt.Errorf("unknown role %q", args[1])
+	}
+
+	b, err := openForCommand()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	ctx := context.Background()
+	u, err := b.GetUserByUsername(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if err = b.SetUserRole(ctx, u.Uuid, role); err != nil {
+		return err
+	}
+	log.Printf("%s is now %s", args[0], role)
+	return nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/pwhash"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// duration is a time.Duration that can be read from the config file,
+// the environment and the command line in the form "1m30s"
+type duration time.Duration
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// serverConfig holds every setting of the server. Values are layered,
+// starting from the defaults, then the JSON config file, then JERVER_*
+// environment variables, and finally command line flags
+type serverConfig struct {
+	ListenAddr  string
+	AllowOrigin string
+	// MaxPageCount is the largest count of a page of a collection that
+	// can be asked for
+	MaxPageCount intValue
+
+	// Registration is how new users may register: "closed", "open",
+	// "invite" (with a code from `jerver invite`) or "approval" (not
+	// able to log in until `jerver approve <username>`)
+	Registration string
+
+	// BasicAuth lets API requests authenticate with a username and
+	// password, rather than only with an access token from logging in
+	// at /verification. TokenSecret signs the access tokens, so must be
+	// shared by every instance of the server
+	BasicAuth       boolValue
+	TokenSecret     string
+	AccessTokenTTL  duration
+	RefreshTokenTTL duration
+
+	// accounts and addresses with repeated failed logins are locked
+	// out for LoginLockoutBase, doubling with each further failure up
+	// to LoginLockoutMax
+	LoginLockoutBase duration
+	LoginLockoutMax  duration
+
+	// PasswordHash is the algorithm new password hashes are made with,
+	// "bcrypt" or "argon2id" (Argon2Memory being in KiB). Hashes made
+	// otherwise are rehashed when their users next log in
+	PasswordHash  string
+	BcryptCost    intValue
+	Argon2Time    intValue
+	Argon2Memory  intValue
+	Argon2Threads intValue
+
+	// password reset tokens are sent by MailSender ("log", "file" to
+	// append to MailFile, or "smtp"), as a link to PasswordResetURL
+	// with the token in its query, and expire after PasswordResetTTL
+	MailSender       string
+	MailFile         string
+	MailFrom         string
+	SmtpAddr         string
+	SmtpUsername     string
+	SmtpPassword     string
+	PasswordResetURL string
+	PasswordResetTTL duration
+
+	Backend      string
+	PgsqlConnStr string
+	SqlitePath   string
+
+	DbRetryInterval    duration
+	DbMaxRetryInterval duration
+
+	// DbMigrate has the server apply any pending schema migrations
+	// when it opens the backend
+	DbMigrate boolValue
+
+	// DbTimeout bounds every backend operation, unless the operation
+	// (named as the backend.Backend method, e.g. "GetMessageCollection")
+	// has its own entry in DbOpTimeouts. DbOpTimeouts can only be set
+	// in the config file
+	DbTimeout    duration
+	DbOpTimeouts map[string]duration
+
+	// JobWorkers is how many jobs this instance runs at once, none if
+	// 0. Workers look for due jobs every JobPollInterval, and a job is
+	// taken to have been abandoned, and is run again, if it has not
+	// finished JobLease after it started. On shutdown running jobs are
+	// given JobDrainTimeout to finish
+	JobWorkers      intValue
+	JobPollInterval duration
+	JobLease        duration
+	JobDrainTimeout duration
+}
+
+var defaultConfig = serverConfig{
+	ListenAddr:   ":8080",
+	AllowOrigin:  "http://localhost:8090",
+	MaxPageCount: 100,
+
+	Registration: registrationClosed,
+
+	AccessTokenTTL:  duration(15 * time.Minute),
+	RefreshTokenTTL: duration(30 * 24 * time.Hour),
+
+	LoginLockoutBase: duration(time.Second),
+	LoginLockoutMax:  duration(15 * time.Minute),
+
+	PasswordHash:  pwhash.Bcrypt,
+	BcryptCost:    intValue(bcrypt.DefaultCost),
+	Argon2Time:    3,
+	Argon2Memory:  64 * 1024,
+	Argon2Threads: 4,
+
+	MailSender:       "log",
+	MailFile:         "./jerver.mail",
+	MailFrom:         "jerver@localhost",
+	SmtpAddr:         "localhost:25",
+	PasswordResetURL: "http://localhost:8090/reset-password",
+	PasswordResetTTL: duration(time.Hour),
+
+	Backend:      "pgsql",
+	PgsqlConnStr: "user=jerver dbname=jerver sslmode=disable",
+	SqlitePath:   "./jerver.db",
+
+	DbRetryInterval:    duration(500 * time.Millisecond),
+	DbMaxRetryInterval: duration(30 * time.Second),
+	DbMigrate:          true,
+
+	DbTimeout: duration(5 * time.Second),
+
+	JobWorkers:      4,
+	JobPollInterval: duration(time.Second),
+	JobLease:        duration(5 * time.Minute),
+	JobDrainTimeout: duration(30 * time.Second),
+}
+
+// conf is the configuration the server is running with, set by main
+var conf serverConfig
+
+// configSetting ties a setting to its environment variable and flag
+type configSetting struct {
+	env   string
+	flag  string
+	usage string
+	value func(c *serverConfig) flag.Value
+}
+
+var configSettings = []configSetting{
+	{"JERVER_LISTEN_ADDR", "listen", "address to serve the API on",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.ListenAddr) }},
+	{"JERVER_ALLOW_ORIGIN", "allow-origin", "origin allowed to make cross-origin requests",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.AllowOrigin) }},
+	{"JERVER_MAX_PAGE_COUNT", "max-page-count", "largest count of a page of a collection",
+		func(c *serverConfig) flag.Value { return &c.MaxPageCount }},
+	{"JERVER_REGISTRATION", "registration", "how users may register (closed, open, invite or approval)",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.Registration) }},
+	{"JERVER_BASIC_AUTH", "basic-auth", "accept Basic credentials on API requests as well as access tokens",
+		func(c *serverConfig) flag.Value { return &c.BasicAuth }},
+	{"JERVER_TOKEN_SECRET", "token-secret", "secret signing access tokens (random if empty)",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.TokenSecret) }},
+	{"JERVER_ACCESS_TOKEN_TTL", "access-token-ttl", "lifetime of access tokens",
+		func(c *serverConfig) flag.Value { return &c.AccessTokenTTL }},
+	{"JERVER_REFRESH_TOKEN_TTL", "refresh-token-ttl", "lifetime of refresh tokens",
+		func(c *serverConfig) flag.Value { return &c.RefreshTokenTTL }},
+	{"JERVER_LOGIN_LOCKOUT_BASE", "login-lockout-base", "first lockout after repeated failed logins",
+		func(c *serverConfig) flag.Value { return &c.LoginLockoutBase }},
+	{"JERVER_LOGIN_LOCKOUT_MAX", "login-lockout-max", "longest lockout after repeated failed logins",
+		func(c *serverConfig) flag.Value { return &c.LoginLockoutMax }},
+	{"JERVER_PASSWORD_HASH", "password-hash", "algorithm of new password hashes (bcrypt or argon2id)",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.PasswordHash) }},
+	{"JERVER_BCRYPT_COST", "bcrypt-cost", "cost of new bcrypt password hashes",
+		func(c *serverConfig) flag.Value { return &c.BcryptCost }},
+	{"JERVER_ARGON2_TIME", "argon2-time", "passes over memory of new argon2id password hashes",
+		func(c *serverConfig) flag.Value { return &c.Argon2Time }},
+	{"JERVER_ARGON2_MEMORY", "argon2-memory", "KiB of memory used by new argon2id password hashes",
+		func(c *serverConfig) flag.Value { return &c.Argon2Memory }},
+	{"JERVER_ARGON2_THREADS", "argon2-threads", "threads used by new argon2id password hashes",
+		func(c *serverConfig) flag.Value { return &c.Argon2Threads }},
+	{"JERVER_MAIL_SENDER", "mail-sender", "how to send mail (log, file or smtp)",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.MailSender) }},
+	{"JERVER_MAIL_FILE", "mail-file", "file the file mail sender appends to",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.MailFile) }},
+	{"JERVER_MAIL_FROM", "mail-from", "address mail is sent from",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.MailFrom) }},
+	{"JERVER_SMTP_ADDR", "smtp-addr", "host:port of the SMTP server for the smtp mail sender",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.SmtpAddr) }},
+	{"JERVER_SMTP_USERNAME", "smtp-username", "username for the SMTP server, empty to not authenticate",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.SmtpUsername) }},
+	{"JERVER_SMTP_PASSWORD", "smtp-password", "password for the SMTP server",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.SmtpPassword) }},
+	{"JERVER_PASSWORD_RESET_URL", "password-reset-url", "page password reset links point to",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.PasswordResetURL) }},
+	{"JERVER_PASSWORD_RESET_TTL", "password-reset-ttl", "lifetime of password reset tokens",
+		func(c *serverConfig) flag.Value { return &c.PasswordResetTTL }},
+	{"JERVER_BACKEND", "backend", "storage backend to use (pgsql, sqlite or memory)",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.Backend) }},
+	{"JERVER_PGSQL_CONN", "pgsql-conn", "connection string for the pgsql backend",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.PgsqlConnStr) }},
+	{"JERVER_SQLITE_PATH", "sqlite-path", "database file for the sqlite backend",
+		func(c *serverConfig) flag.Value { return (*stringValue)(&c.SqlitePath) }},
+	{"JERVER_DB_RETRY_INTERVAL", "db-retry-interval", "wait before retrying to open the backend",
+		func(c *serverConfig) flag.Value { return &c.DbRetryInterval }},
+	{"JERVER_DB_MAX_RETRY_INTERVAL", "db-max-retry-interval", "longest wait between attempts to open the backend",
+		func(c *serverConfig) flag.Value { return &c.DbMaxRetryInterval }},
+	{"JERVER_DB_MIGRATE", "db-migrate", "apply pending schema migrations on startup",
+		func(c *serverConfig) flag.Value { return &c.DbMigrate }},
+	{"JERVER_DB_TIMEOUT", "db-timeout", "default timeout of backend operations",
+		func(c *serverConfig) flag.Value { return &c.DbTimeout }},
+	{"JERVER_JOB_WORKERS", "job-workers", "number of background jobs run at once, 0 to run none",
+		func(c *serverConfig) flag.Value { return &c.JobWorkers }},
+	{"JERVER_JOB_POLL_INTERVAL", "job-poll-interval", "wait between checks for due background jobs",
+		func(c *serverConfig) flag.Value { return &c.JobPollInterval }},
+	{"JERVER_JOB_LEASE", "job-lease", "time a background job may run before it is run again elsewhere",
+		func(c *serverConfig) flag.Value { return &c.JobLease }},
+	{"JERVER_JOB_DRAIN_TIMEOUT", "job-drain-timeout", "time given to running background jobs to finish on shutdown",
+		func(c *serverConfig) flag.Value { return &c.JobDrainTimeout }},
+}
+
+type stringValue string
+
+func (s *stringValue) String() string {
+	return string(*s)
+}
+
+func (s *stringValue) Set(v string) error {
+	*s = stringValue(v)
+	return nil
+}
+
+type boolValue bool
+
+func (b *boolValue) String() string {
+	return strconv.FormatBool(bool(*b))
+}
+
+func (b *boolValue) Set(v string) error {
+	parsed, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	*b = boolValue(parsed)
+	return nil
+}
+
+// IsBoolFlag lets the flag be given without a value, as -db-migrate
+func (b *boolValue) IsBoolFlag() bool {
+	return true
+}
+
+type intValue int
+
+func (i *intValue) String() string {
+	return strconv.Itoa(int(*i))
+}
+
+func (i *intValue) Set(v string) error {
+	parsed, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*i = intValue(parsed)
+	return nil
+}
+
+// loadConfig builds the server configuration from the config file
+// (named by -config or JERVER_CONFIG), the environment and args. Any
+// arguments left after the flags are returned
+func loadConfig(args []string) (serverConfig, []string, error) {
+	// flags are parsed into their own copy first, so that only those
+	// explicitly given override the file and the environment
+	var flagged serverConfig
+	fs := flag.NewFlagSet("jerver", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("JERVER_CONFIG"), "path of JSON config file")
+	for _, setting := range configSettings {
+		v := setting.value(&flagged)
+		v.Set(setting.value(&defaultConfig).String())
+		fs.Var(v, setting.flag, setting.usage)
+	}
+	fs.Parse(args)
+
+	c := defaultConfig
+	if *configPath != "" {
+		f, err := os.Open(*configPath)
+		if err != nil {
+			return c, nil, err
+		}
+		defer f.Close()
+
+		if err = json.NewDecoder(f).Decode(&c); err != nil {
+			return c, nil, fmt.Errorf("reading config file %s: %s", *configPath, err)
+		}
+	}
+
+	for _, setting := range configSettings {
+		if env, ok := os.LookupEnv(setting.env); ok {
+			if err := setting.value(&c).Set(env); err != nil {
+				return c, nil, fmt.Errorf("%s: %s", setting.env, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, setting := range configSettings {
+			if setting.flag == f.Name && err == nil {
+				err = setting.value(&c).Set(f.Value.String())
+			}
+		}
+	})
+
+	return c, fs.Args(), err
+}
+
+// passwordHashParams returns how new password hashes are made
+func (c *serverConfig) passwordHashParams() pwhash.Params {
+	return pwhash.Params{
+		Algorithm:     c.PasswordHash,
+		BcryptCost:    int(c.BcryptCost),
+		Argon2Time:    uint32(c.Argon2Time),
+		Argon2Memory:  uint32(c.Argon2Memory),
+		Argon2Threads: uint8(c.Argon2Threads),
+	}
+}
+
+// backendConfig returns the config for opening the selected backend
+func (c *serverConfig) backendConfig() backend.Config {
+	bc := backend.Config{
+		RetryInterval:    time.Duration(c.DbRetryInterval),
+		MaxRetryInterval: time.Duration(c.DbMaxRetryInterval),
+		Migrate:          bool(c.DbMigrate),
+	}
+
+	switch c.Backend {
+	case "pgsql":
+		bc.DataSource = c.PgsqlConnStr
+	case "sqlite":
+		bc.DataSource = c.SqlitePath
+	}
+
+	return bc
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"gitlab.com/johncolinsharp/entitycoll"
+	"net/http"
+	"strings"
+)
+
+// cursorCollection is a page of a collection read by cursor rather
+// than by page number. NextCursor is passed back to read the page
+// that follows, it is empty once the end of the collection is reached
+type cursorCollection struct {
+	Entities      []entitycoll.Entity
+	TotalEntities uint
+	NextCursor    string
+}
+
+// cursorCollectionNode is implemented by the collections that can be
+// read by cursor
+type cursorCollectionNode interface {
+	GetCursorCollection(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID, cursor string, count uint64) (cursorCollection, error)
+}
+
+var errBadCursor = entities.NewError(entities.Validation, "malformed cursor")
+
+// encodeCursor turns c into the opaque token handed to clients
+func encodeCursor(c *backend.Cursor) string {
+	if c == nil {
+		return ""
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor reverses encodeCursor, the empty token is the start of
+// the collection and gives a nil cursor
+func decodeCursor(token string) (*backend.Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errBadCursor
+	}
+
+	var c backend.Cursor
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, errBadCursor
+	}
+	return &c, nil
+}
+
+// cursorHandler serves GET requests on the thread and message
+// collections that carry a `cursor` query parameter (which may be
+// empty to fetch the first page). entitycoll's CollFilter only knows
+// about page and count, so every other request is passed on to next
+func cursorHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		_, hasCursor := query["cursor"]
+		if r.Method != "GET" || !hasCursor {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var node cursorCollectionNode
+		parentEntityUuids := map[string]uuid.UUID{}
+		path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(path) == 1 && path[0] == threads.GetRestName():
+			node = &threads
+		case len(path) == 3 && path[0] == threads.GetRestName() && path[2] == messages.GetRestName():
+			threadId, err := uuid.FromString(path[1])
+			if err != nil {
+				writeError(w, entities.NewError(entities.Validation, "malformed thread id"))
+				return
+			}
+			parentEntityUuids[threads.GetRestName()] = threadId
+			node = &messages
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		serveRead(w, r, func(requestor entitycoll.Entity, count uint64, page int64) (interface{}, error) {
+			if err := authorize(requestor, path[len(path)-1], actionRead); err != nil {
+				return nil, err
+			}
+			collection, err := node.GetCursorCollection(requestor, parentEntityUuids, query.Get("cursor"), count)
+			if err == nil {
+				collection.Entities, err = projectAll(requestor, collection.Entities)
+			}
+			return collection, err
+		})
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/satori/go.uuid"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	id, _ := uuid.NewV4()
+	tests := []struct {
+		name   string
+		cursor *backend.Cursor
+	}{
+		{"start", nil},
+		{"zero", &backend.Cursor{}},
+		{"utc", &backend.Cursor{Created: time.Date(2020, 2, 29, 12, 30, 0, 123456789, time.UTC), Id: id}},
+		{"zone", &backend.Cursor{Created: time.Date(2020, 2, 29, 12, 30, 0, 1, time.FixedZone("x", 3600)), Id: id}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := encodeCursor(test.cursor)
+			got, err := decodeCursor(token)
+			if err != nil {
+				t.Fatalf("decodeCursor(%q): %v", token, err)
+			}
+			if test.cursor == nil {
+				if token != "" || got != nil {
+					t.Fatalf("nil cursor gave token %q and cursor %v", token, got)
+				}
+				return
+			}
+			if got == nil || !got.Created.Equal(test.cursor.Created) || !uuid.Equal(got.Id, test.cursor.Id) {
+				t.Fatalf("got %+v, want %+v", got, test.cursor)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorMalformed(t *testing.T) {
+	valid := encodeCursor(&backend.Cursor{Created: time.Now()})
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"not base64", "!!!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"Created":"2020-01-01T00:00:00Z"}`))},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("cursor"))},
+		{"bad time", base64.RawURLEncoding.EncodeToString([]byte(`{"Created":"yesterday"}`))},
+		{"bad id", base64.RawURLEncoding.EncodeToString([]byte(`{"Id":"nope"}`))},
+		{"truncated", valid[:len(valid)-3]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if c, err := decodeCursor(test.token); err != errBadCursor {
+				t.Fatalf("decodeCursor(%q) = %+v, %v, want errBadCursor", test.token, c, err)
+			}
+		})
+	}
+}
@@ -1,34 +1,110 @@
 package main
 
 import (
+	"context"
+	"github.com/john-sharp/jerver/backend"
 	"github.com/john-sharp/jerver/entities"
-	// "github.com/john-sharp/jerver/sqlite-dbbackend"
-	"github.com/john-sharp/jerver/pgsql-dbbackend"
 	"github.com/satori/go.uuid"
 	"gitlab.com/johncolinsharp/entitycoll"
+	"sync"
+	"time"
 )
 
+// currentDbBackend is the storage backend chosen at startup, all
+// collections reach the database through dbBackend(). It is
+// backend.Unavailable until the backend has been opened
+var currentDbBackend backend.Backend = backend.Unavailable{}
+var dbBackendMu sync.RWMutex
+
+func dbBackend() backend.Backend {
+	dbBackendMu.RLock()
+	defer dbBackendMu.RUnlock()
+	return currentDbBackend
+}
+
+func setDbBackend(b backend.Backend) {
+	dbBackendMu.Lock()
+	defer dbBackendMu.Unlock()
+	currentDbBackend = b
+}
+
+// withDbTimeout bounds ctx by the timeout configured for the backend
+// operation op, falling back to the default DbTimeout
+func withDbTimeout(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(conf.DbTimeout)
+	if opTimeout, ok := conf.DbOpTimeouts[op]; ok {
+		timeout = time.Duration(opTimeout)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// dbError makes it clear when a failed backend operation was down to
+// its timeout expiring
+func dbError(ctx context.Context, op string, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return entities.WrapError(entities.Unavailable, op+" timed out", backend.ErrTimeout)
+	}
+	return err
+}
+
+// contextRequestor is the requestor authorizeUser gives entitycoll to
+// pass to the collections: who is making the request, a *user or an
+// *apiKeyRequestor, with the context of the request, as entitycoll does
+// not pass the request itself on
+type contextRequestor struct {
+	requestor entitycoll.Entity
+	ctx       context.Context
+}
+
+// requestContext is the context of the request requestor is making,
+// the background context for a requestor found without a request.
+// Backend calls are still bounded by withDbTimeout
+func requestContext(requestor entitycoll.Entity) context.Context {
+	if r, ok := requestor.(*contextRequestor); ok {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// withoutContext returns who is making a request, without the context
+// of the request authorizeUser gave the requestor
+func withoutContext(requestor entitycoll.Entity) entitycoll.Entity {
+	if r, ok := requestor.(*contextRequestor); ok {
+		return r.requestor
+	}
+	return requestor
+}
+
 type messageCollection struct{}
 
-func (mc *messageCollection) getByUuid(targetUuid uuid.UUID) (*entities.Message, error) {
-	return dbbackend.GetMessageByUuid(targetUuid)
+func (mc *messageCollection) getByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.Message, error) {
+	ctx, cancel := withDbTimeout(ctx, "GetMessageByUuid")
+	defer cancel()
+	m, err := dbBackend().GetMessageByUuid(ctx, targetUuid)
+	return m, dbError(ctx, "GetMessageByUuid", err)
 }
 
-func (mc *messageCollection) create(m *entities.Message) error {
-	return dbbackend.CreateMessage(m)
+func (mc *messageCollection) create(ctx context.Context, m *entities.Message) error {
+	ctx, cancel := withDbTimeout(ctx, "CreateMessage")
+	defer cancel()
+	return dbError(ctx, "CreateMessage", dbBackend().CreateMessage(ctx, m))
 }
 
-func (mc *messageCollection) deleteByUuid(targetUuid uuid.UUID) error {
-	return dbbackend.DeleteMessageByUuid(targetUuid)
+func (mc *messageCollection) deleteByUuid(ctx context.Context, targetUuid uuid.UUID) error {
+	ctx, cancel := withDbTimeout(ctx, "DeleteMessageByUuid")
+	defer cancel()
+	return dbError(ctx, "DeleteMessageByUuid", dbBackend().DeleteMessageByUuid(ctx, targetUuid))
 }
 
-func (mc *messageCollection) getCollection(threadId uuid.UUID, count uint64, page int64) ([]entitycoll.Entity, error) {
+func (mc *messageCollection) getCollection(ctx context.Context, threadId uuid.UUID, count uint64, page int64) ([]entitycoll.Entity, error) {
 	collection := []entitycoll.Entity{}
 
 	messageCollectionAppender := func(m entities.Message) {
 		collection = append(collection, m)
 	}
-	err := dbbackend.GetMessageCollection(threadId, count, page, messageCollectionAppender)
+	ctx, cancel := withDbTimeout(ctx, "GetMessageCollection")
+	defer cancel()
+	err := dbError(ctx, "GetMessageCollection", dbBackend().GetMessageCollection(ctx, threadId, count, page, messageCollectionAppender))
 
 	if err != nil {
 		collection = []entitycoll.Entity{}
@@ -36,33 +112,158 @@ func (mc *messageCollection) getCollection(threadId uuid.UUID, count uint64, pag
 	return collection, err
 }
 
-func (mc *messageCollection) getTotal(threadId uuid.UUID) (uint, error) {
-	return dbbackend.GetMessageTotal(threadId)
+// getCollectionAfter reads up to count messages following after. The
+// cursor returned marks the last message read, it is nil when there
+// are no further messages
+func (mc *messageCollection) getCollectionAfter(ctx context.Context, threadId uuid.UUID, after *backend.Cursor, count uint64) ([]entitycoll.Entity, *backend.Cursor, error) {
+	collection := []entitycoll.Entity{}
+	var last *backend.Cursor
+	more := false
+
+	messageCollectionAppender := func(m entities.Message) {
+		// one more than asked for is read to find out whether
+		// there is a further page
+		if uint64(len(collection)) == count {
+			more = true
+			return
+		}
+		collection = append(collection, m)
+		last = &backend.Cursor{Created: m.Created, Id: m.Id}
+	}
+	ctx, cancel := withDbTimeout(ctx, "GetMessageCollectionAfter")
+	defer cancel()
+	err := dbError(ctx, "GetMessageCollectionAfter", dbBackend().GetMessageCollectionAfter(ctx, threadId, after, count+1, messageCollectionAppender))
+
+	if err != nil {
+		return []entitycoll.Entity{}, nil, err
+	}
+	if !more {
+		last = nil
+	}
+	return collection, last, nil
+}
+
+func (mc *messageCollection) getTotal(ctx context.Context, threadId uuid.UUID) (uint, error) {
+	ctx, cancel := withDbTimeout(ctx, "GetMessageTotal")
+	defer cancel()
+	total, err := dbBackend().GetMessageTotal(ctx, threadId)
+	return total, dbError(ctx, "GetMessageTotal", err)
 }
 
-func (mc *messageCollection) editByUuid(targetUuid uuid.UUID, m *entities.MessageEdit) error {
-	return dbbackend.EditMessageByUuid(targetUuid, m)
+func (mc *messageCollection) editByUuid(ctx context.Context, targetUuid uuid.UUID, m *entities.MessageEdit) error {
+	ctx, cancel := withDbTimeout(ctx, "EditMessageByUuid")
+	defer cancel()
+	return dbError(ctx, "EditMessageByUuid", dbBackend().EditMessageByUuid(ctx, targetUuid, m))
 }
 
-func (tc *threadCollection) getByUuid(targetUuid uuid.UUID) (*entities.Thread, error) {
-	return dbbackend.GetThreadByUuid(targetUuid)
+func (tc *threadCollection) getByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.Thread, error) {
+	ctx, cancel := withDbTimeout(ctx, "GetThreadByUuid")
+	defer cancel()
+	t, err := dbBackend().GetThreadByUuid(ctx, targetUuid)
+	return t, dbError(ctx, "GetThreadByUuid", err)
 }
 
-func (tc *threadCollection) create(t *entities.Thread) error {
-	return dbbackend.CreateThread(t)
+func (tc *threadCollection) create(ctx context.Context, t *entities.Thread) error {
+	ctx, cancel := withDbTimeout(ctx, "CreateThread")
+	defer cancel()
+	return dbError(ctx, "CreateThread", dbBackend().CreateThread(ctx, t))
 }
 
-func (tc *threadCollection) deleteByUuid(targetUuid uuid.UUID) error {
-	return dbbackend.DeleteThreadByUuid(targetUuid)
+func (tc *threadCollection) deleteByUuid(ctx context.Context, targetUuid uuid.UUID) error {
+	ctx, cancel := withDbTimeout(ctx, "DeleteThreadByUuid")
+	defer cancel()
+	return dbError(ctx, "DeleteThreadByUuid", dbBackend().DeleteThreadByUuid(ctx, targetUuid))
 }
 
-func (mc *threadCollection) getCollection(count uint64, page int64) ([]entitycoll.Entity, error) {
+func (mc *threadCollection) getCollection(ctx context.Context, count uint64, page int64) ([]entitycoll.Entity, error) {
 	collection := []entitycoll.Entity{}
 
 	threadCollectionAppender := func(t entities.Thread) {
 		collection = append(collection, t)
 	}
-	err := dbbackend.GetThreadCollection(count, page, threadCollectionAppender)
+	ctx, cancel := withDbTimeout(ctx, "GetThreadCollection")
+	defer cancel()
+	err := dbError(ctx, "GetThreadCollection", dbBackend().GetThreadCollection(ctx, count, page, threadCollectionAppender))
+
+	if err != nil {
+		collection = []entitycoll.Entity{}
+	}
+	return collection, err
+}
+
+// getCollectionAfter reads up to count threads following after. The
+// cursor returned marks the last thread read, it is nil when there
+// are no further threads
+func (tc *threadCollection) getCollectionAfter(ctx context.Context, after *backend.Cursor, count uint64) ([]entitycoll.Entity, *backend.Cursor, error) {
+	collection := []entitycoll.Entity{}
+	var last *backend.Cursor
+	more := false
+
+	threadCollectionAppender := func(t entities.Thread) {
+		// one more than asked for is read to find out whether
+		// there is a further page
+		if uint64(len(collection)) == count {
+			more = true
+			return
+		}
+		collection = append(collection, t)
+		last = &backend.Cursor{Created: t.Created, Id: t.Id}
+	}
+	ctx, cancel := withDbTimeout(ctx, "GetThreadCollectionAfter")
+	defer cancel()
+	err := dbError(ctx, "GetThreadCollectionAfter", dbBackend().GetThreadCollectionAfter(ctx, after, count+1, threadCollectionAppender))
+
+	if err != nil {
+		return []entitycoll.Entity{}, nil, err
+	}
+	if !more {
+		last = nil
+	}
+	return collection, last, nil
+}
+
+func (tc *threadCollection) getTotal(ctx context.Context) (uint, error) {
+	ctx, cancel := withDbTimeout(ctx, "GetThreadTotal")
+	defer cancel()
+	total, err := dbBackend().GetThreadTotal(ctx)
+	return total, dbError(ctx, "GetThreadTotal", err)
+}
+
+func (tc *threadCollection) editByUuid(ctx context.Context, targetUuid uuid.UUID, t *entities.ThreadEdit) error {
+	ctx, cancel := withDbTimeout(ctx, "EditThreadByUuid")
+	defer cancel()
+	return dbError(ctx, "EditThreadByUuid", dbBackend().EditThreadByUuid(ctx, targetUuid, t))
+}
+
+func (uc *userCollection) getUserByUsername(ctx context.Context, uname string) (*entities.User, error) {
+	ctx, cancel := withDbTimeout(ctx, "GetUserByUsername")
+	defer cancel()
+	u, err := dbBackend().GetUserByUsername(ctx, uname)
+	return u, dbError(ctx, "GetUserByUsername", err)
+}
+
+func (uc *userCollection) getUserByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.User, error) {
+	ctx, cancel := withDbTimeout(ctx, "GetUserByUuid")
+	defer cancel()
+	u, err := dbBackend().GetUserByUuid(ctx, targetUuid)
+	return u, dbError(ctx, "GetUserByUuid", err)
+}
+
+func (uc *userCollection) createUser(ctx context.Context, u *user, inviteCode string) error {
+	ctx, cancel := withDbTimeout(ctx, "CreateUser")
+	defer cancel()
+	return dbError(ctx, "CreateUser", dbBackend().CreateUser(ctx, (*entities.User)(u), inviteCode))
+}
+
+func (uc *userCollection) getCollection(ctx context.Context, prefix string, count uint64, page int64) ([]entitycoll.Entity, error) {
+	collection := []entitycoll.Entity{}
+
+	userCollectionAppender := func(u entities.User) {
+		collection = append(collection, u)
+	}
+	ctx, cancel := withDbTimeout(ctx, "GetUserCollection")
+	defer cancel()
+	err := dbError(ctx, "GetUserCollection", dbBackend().GetUserCollection(ctx, prefix, count, page, userCollectionAppender))
 
 	if err != nil {
 		collection = []entitycoll.Entity{}
@@ -70,18 +271,210 @@ func (mc *threadCollection) getCollection(count uint64, page int64) ([]entitycol
 	return collection, err
 }
 
-func (tc *threadCollection) getTotal() (uint, error) {
-	return dbbackend.GetThreadTotal()
+func (uc *userCollection) getTotal(ctx context.Context, prefix string) (uint, error) {
+	ctx, cancel := withDbTimeout(ctx, "GetUserTotal")
+	defer cancel()
+	total, err := dbBackend().GetUserTotal(ctx, prefix)
+	return total, dbError(ctx, "GetUserTotal", err)
+}
+
+func (uc *userCollection) editByUuid(ctx context.Context, targetUuid uuid.UUID, u *entities.UserEdit) error {
+	ctx, cancel := withDbTimeout(ctx, "EditUserByUuid")
+	defer cancel()
+	return dbError(ctx, "EditUserByUuid", dbBackend().EditUserByUuid(ctx, targetUuid, u))
+}
+
+func (uc *userCollection) setUserPassword(ctx context.Context, targetUuid uuid.UUID, hashedPwd []byte) error {
+	ctx, cancel := withDbTimeout(ctx, "SetUserPassword")
+	defer cancel()
+	return dbError(ctx, "SetUserPassword", dbBackend().SetUserPassword(ctx, targetUuid, hashedPwd))
+}
+
+func (uc *userCollection) upgradeUserPassword(ctx context.Context, targetUuid uuid.UUID, oldHash, newHash []byte) error {
+	ctx, cancel := withDbTimeout(ctx, "UpgradeUserPassword")
+	defer cancel()
+	return dbError(ctx, "UpgradeUserPassword", dbBackend().UpgradeUserPassword(ctx, targetUuid, oldHash, newHash))
+}
+
+func (uc *userCollection) approveUser(ctx context.Context, uname string) error {
+	ctx, cancel := withDbTimeout(ctx, "ApproveUser")
+	defer cancel()
+	return dbError(ctx, "ApproveUser", dbBackend().ApproveUser(ctx, uname))
+}
+
+func (uc *userCollection) createInvite(ctx context.Context, code string) error {
+	ctx, cancel := withDbTimeout(ctx, "CreateInvite")
+	defer cancel()
+	return dbError(ctx, "CreateInvite", dbBackend().CreateInvite(ctx, code))
+}
+
+func (uc *userCollection) createSession(ctx context.Context, s *entities.Session) error {
+	ctx, cancel := withDbTimeout(ctx, "CreateSession")
+	defer cancel()
+	return dbError(ctx, "CreateSession", dbBackend().CreateSession(ctx, s))
+}
+
+func (uc *userCollection) takeSession(ctx context.Context, id string) (*entities.Session, error) {
+	ctx, cancel := withDbTimeout(ctx, "TakeSession")
+	defer cancel()
+	s, err := dbBackend().TakeSession(ctx, id)
+	return s, dbError(ctx, "TakeSession", err)
+}
+
+func (uc *userCollection) deleteUserSessions(ctx context.Context, userId uuid.UUID) error {
+	ctx, cancel := withDbTimeout(ctx, "DeleteUserSessions")
+	defer cancel()
+	return dbError(ctx, "DeleteUserSessions", dbBackend().DeleteUserSessions(ctx, userId))
+}
+
+func (uc *userCollection) createPasswordReset(ctx context.Context, r *entities.PasswordReset) error {
+	ctx, cancel := withDbTimeout(ctx, "CreatePasswordReset")
+	defer cancel()
+	return dbError(ctx, "CreatePasswordReset", dbBackend().CreatePasswordReset(ctx, r))
+}
+
+func (uc *userCollection) takePasswordReset(ctx context.Context, id string) (*entities.PasswordReset, error) {
+	ctx, cancel := withDbTimeout(ctx, "TakePasswordReset")
+	defer cancel()
+	r, err := dbBackend().TakePasswordReset(ctx, id)
+	return r, dbError(ctx, "TakePasswordReset", err)
+}
+
+func (uc *userCollection) replacePasswordReset(ctx context.Context, oldId, newId string) (*entities.PasswordReset, error) {
+	ctx, cancel := withDbTimeout(ctx, "ReplacePasswordReset")
+	defer cancel()
+	r, err := dbBackend().ReplacePasswordReset(ctx, oldId, newId)
+	return r, dbError(ctx, "ReplacePasswordReset", err)
+}
+
+func (uc *userCollection) recordSecurityEvent(ctx context.Context, e *entities.SecurityEvent) error {
+	ctx, cancel := withDbTimeout(ctx, "RecordSecurityEvent")
+	defer cancel()
+	return dbError(ctx, "RecordSecurityEvent", dbBackend().RecordSecurityEvent(ctx, e))
+}
+
+func (uc *userCollection) getApiKey(ctx context.Context, id string) (*entities.ApiKey, error) {
+	ctx, cancel := withDbTimeout(ctx, "GetApiKey")
+	defer cancel()
+	k, err := dbBackend().GetApiKey(ctx, id)
+	return k, dbError(ctx, "GetApiKey", err)
 }
 
-func (tc *threadCollection) editByUuid(targetUuid uuid.UUID, t *entities.ThreadEdit) error {
-	return dbbackend.EditThreadByUuid(targetUuid, t)
+type webhookCollection struct{}
+
+func (wc *webhookCollection) create(ctx context.Context, w *entities.Webhook) error {
+	ctx, cancel := withDbTimeout(ctx, "CreateWebhook")
+	defer cancel()
+	return dbError(ctx, "CreateWebhook", dbBackend().CreateWebhook(ctx, w))
+}
+
+func (wc *webhookCollection) getByUuid(ctx context.Context, id uuid.UUID) (*entities.Webhook, error) {
+	ctx, cancel := withDbTimeout(ctx, "GetWebhook")
+	defer cancel()
+	w, err := dbBackend().GetWebhook(ctx, id)
+	return w, dbError(ctx, "GetWebhook", err)
+}
+
+func (wc *webhookCollection) getAll(ctx context.Context) ([]entities.Webhook, error) {
+	ctx, cancel := withDbTimeout(ctx, "GetWebhooks")
+	defer cancel()
+	webhooks := []entities.Webhook{}
+	err := dbBackend().GetWebhooks(ctx, func(w entities.Webhook) {
+		webhooks = append(webhooks, w)
+	})
+	return webhooks, dbError(ctx, "GetWebhooks", err)
+}
+
+func (wc *webhookCollection) editByUuid(ctx context.Context, id uuid.UUID, w *entities.WebhookEdit) error {
+	ctx, cancel := withDbTimeout(ctx, "EditWebhookByUuid")
+	defer cancel()
+	return dbError(ctx, "EditWebhookByUuid", dbBackend().EditWebhookByUuid(ctx, id, w))
+}
+
+func (wc *webhookCollection) deleteByUuid(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withDbTimeout(ctx, "DeleteWebhookByUuid")
+	defer cancel()
+	return dbError(ctx, "DeleteWebhookByUuid", dbBackend().DeleteWebhookByUuid(ctx, id))
+}
+
+func (wc *webhookCollection) createDelivery(ctx context.Context, d *entities.WebhookDelivery) error {
+	ctx, cancel := withDbTimeout(ctx, "CreateWebhookDelivery")
+	defer cancel()
+	return dbError(ctx, "CreateWebhookDelivery", dbBackend().CreateWebhookDelivery(ctx, d))
+}
+
+func (wc *webhookCollection) updateDelivery(ctx context.Context, d *entities.WebhookDelivery) error {
+	ctx, cancel := withDbTimeout(ctx, "UpdateWebhookDelivery")
+	defer cancel()
+	return dbError(ctx, "UpdateWebhookDelivery", dbBackend().UpdateWebhookDelivery(ctx, d))
+}
+
+func (wc *webhookCollection) getDelivery(ctx context.Context, id uuid.UUID) (*entities.WebhookDelivery, error) {
+	ctx, cancel := withDbTimeout(ctx, "GetWebhookDelivery")
+	defer cancel()
+	d, err := dbBackend().GetWebhookDelivery(ctx, id)
+	return d, dbError(ctx, "GetWebhookDelivery", err)
 }
 
-func (uc *userCollection) getUserByUsername(uname string) (*entities.User, error) {
-	return dbbackend.GetUserByUsername(uname)
+func (wc *webhookCollection) getDeliveries(ctx context.Context, webhookId uuid.UUID, count uint64, page int64) ([]entitycoll.Entity, error) {
+	ctx, cancel := withDbTimeout(ctx, "GetWebhookDeliveries")
+	defer cancel()
+	deliveries := []entitycoll.Entity{}
+	err := dbBackend().GetWebhookDeliveries(ctx, webhookId, count, page, func(d entities.WebhookDelivery) {
+		deliveries = append(deliveries, d)
+	})
+	return deliveries, dbError(ctx, "GetWebhookDeliveries", err)
+}
+
+func (wc *webhookCollection) getDeliveryTotal(ctx context.Context, webhookId uuid.UUID) (uint, error) {
+	ctx, cancel := withDbTimeout(ctx, "GetWebhookDeliveryTotal")
+	defer cancel()
+	total, err := dbBackend().GetWebhookDeliveryTotal(ctx, webhookId)
+	return total, dbError(ctx, "GetWebhookDeliveryTotal", err)
+}
+
+type jobCollection struct{}
+
+func (jc *jobCollection) create(ctx context.Context, j *entities.Job) error {
+	ctx, cancel := withDbTimeout(ctx, "CreateJob")
+	defer cancel()
+	return dbError(ctx, "CreateJob", dbBackend().CreateJob(ctx, j))
+}
+
+func (jc *jobCollection) claim(ctx context.Context, now time.Time, lease time.Duration) (*entities.Job, error) {
+	ctx, cancel := withDbTimeout(ctx, "ClaimJob")
+	defer cancel()
+	j, err := dbBackend().ClaimJob(ctx, now, lease)
+	return j, dbError(ctx, "ClaimJob", err)
+}
+
+func (jc *jobCollection) update(ctx context.Context, j *entities.Job) error {
+	ctx, cancel := withDbTimeout(ctx, "UpdateJob")
+	defer cancel()
+	return dbError(ctx, "UpdateJob", dbBackend().UpdateJob(ctx, j))
+}
+
+func (jc *jobCollection) deleteByUuid(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := withDbTimeout(ctx, "DeleteJob")
+	defer cancel()
+	return dbError(ctx, "DeleteJob", dbBackend().DeleteJob(ctx, id))
+}
+
+type searchCollection struct{}
+
+func (sc *searchCollection) search(ctx context.Context, q *backend.SearchQuery, count uint64, page int64) ([]entitycoll.Entity, error) {
+	ctx, cancel := withDbTimeout(ctx, "Search")
+	defer cancel()
+	results := []entitycoll.Entity{}
+	err := dbBackend().Search(ctx, q, count, page, func(r entities.SearchResult) {
+		results = append(results, r)
+	})
+	return results, dbError(ctx, "Search", err)
 }
 
-func (uc *userCollection) getUserByUuid(targetUuid uuid.UUID) (*entities.User, error) {
-	return dbbackend.GetUserByUuid(targetUuid)
+func (sc *searchCollection) total(ctx context.Context, q *backend.SearchQuery) (uint, error) {
+	ctx, cancel := withDbTimeout(ctx, "SearchTotal")
+	defer cancel()
+	total, err := dbBackend().SearchTotal(ctx, q)
+	return total, dbError(ctx, "SearchTotal", err)
 }
@@ -0,0 +1,69 @@
+package entities
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrorKind classifies an Error so that it can be reported to clients
+// with the right status code
+type ErrorKind string
+
+const (
+	NotFound     ErrorKind = "not_found"
+	Conflict     ErrorKind = "conflict"
+	Validation   ErrorKind = "validation"
+	Unauthorized ErrorKind = "unauthorized"
+	Forbidden    ErrorKind = "forbidden"
+	RateLimited  ErrorKind = "rate_limited"
+	Unavailable  ErrorKind = "unavailable"
+)
+
+var errorKinds = []ErrorKind{NotFound, Conflict, Validation, Unauthorized, Forbidden, RateLimited, Unavailable}
+
+// Error is returned by the backends and collections for failures that
+// clients need to be able to tell apart. Its message is always
+// prefixed by the kind, e.g. "not_found: no such thread"
+type Error struct {
+	Kind ErrorKind
+	Msg  string
+	// Err is the underlying cause, e.g. the driver error, if any
+	Err error
+}
+
+func (e *Error) Error() string {
+	return string(e.Kind) + ": " + e.Msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func NewError(kind ErrorKind, msg string) error {
+	return &Error{Kind: kind, Msg: msg}
+}
+
+func WrapError(kind ErrorKind, msg string, err error) error {
+	return &Error{Kind: kind, Msg: msg, Err: err}
+}
+
+// ErrorKindOf returns the kind of the first Error in err's chain
+func ErrorKindOf(err error) (ErrorKind, bool) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind, true
+	}
+	return "", false
+}
+
+// ParseError recovers the kind and message from the text of an Error,
+// for when only its message has been passed along
+func ParseError(s string) (ErrorKind, string, bool) {
+	s = strings.TrimSpace(s)
+	for _, kind := range errorKinds {
+		if strings.HasPrefix(s, string(kind)+": ") {
+			return kind, s[len(kind)+2:], true
+		}
+	}
+	return "", "", false
+}
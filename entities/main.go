@@ -2,6 +2,7 @@ package entities
 
 import (
 	"github.com/satori/go.uuid"
+	"time"
 )
 
 type Generic interface{}
@@ -11,6 +12,7 @@ type Message struct {
 	ThreadId uuid.UUID
 	AuthorId uuid.UUID
 	Content  string
+	Created  time.Time
 }
 
 type MessageEdit struct {
@@ -20,19 +22,204 @@ type MessageEdit struct {
 }
 
 type Thread struct {
-	Id      uuid.UUID
-	Title   string
-	NumMsgs uint
+	Id          uuid.UUID
+	Title       string
+	NumMsgs     uint
+	LastMsgTime *time.Time
+	Created     time.Time
 }
 
 type ThreadEdit struct {
 	Title *string
 }
 
+// Role decides what a user is allowed to do
+type Role string
+
+const (
+	RoleAdmin     Role = "admin"
+	RoleModerator Role = "moderator"
+	RoleMember    Role = "member"
+	RoleReadOnly  Role = "read-only"
+)
+
+var Roles = []Role{RoleAdmin, RoleModerator, RoleMember, RoleReadOnly}
+
 type User struct {
 	Uuid       uuid.UUID
 	FirstName  string
 	SecondName string
 	Username   string
 	HashedPwd  []byte
+	// Approved is false for users registered while registration needs
+	// approval, until an admin approves them
+	Approved bool
+	Role     Role
+	// Email is where password resets are sent, empty if none was given
+	Email       string
+	DisplayName string
+	Bio         string
+	// Service is true for service accounts, which are used through API
+	// keys and cannot log in with a password
+	Service bool
+	// TokenGeneration goes up each time the password is set, access
+	// tokens issued before then carrying the generation they were
+	// issued in
+	TokenGeneration int64
+}
+
+type UserEdit struct {
+	FirstName   *string
+	SecondName  *string
+	DisplayName *string
+	Bio         *string
+	Role        *Role
+}
+
+// SecurityEvent records something, such as a failed login, that may be
+// part of an attack on an account
+type SecurityEvent struct {
+	Kind       string
+	Username   string
+	RemoteAddr string
+	Created    time.Time
+}
+
+// Session is the server side record of a refresh token, Id being the
+// hex SHA-256 of the token
+type Session struct {
+	Id      string
+	UserId  uuid.UUID
+	Created time.Time
+	Expires time.Time
+}
+
+// ApiKeyScope limits what an API key may do, within what the role of
+// its service account allows
+type ApiKeyScope string
+
+const (
+	// ScopeFull keys may do anything their account may
+	ScopeFull ApiKeyScope = "full"
+	// ScopeRead keys may only read
+	ScopeRead ApiKeyScope = "read"
+	// ScopePost keys may read, and post messages to the threads listed
+	// by the key, or to any thread if it lists none
+	ScopePost ApiKeyScope = "post"
+)
+
+var ApiKeyScopes = []ApiKeyScope{ScopeFull, ScopeRead, ScopePost}
+
+// ApiKey lets a service account make requests, Id being the hex
+// SHA-256 of the key
+type ApiKey struct {
+	Id      string
+	UserId  uuid.UUID
+	Name    string
+	Scope   ApiKeyScope
+	Threads []uuid.UUID
+	Created time.Time
+	// Expires is nil for keys that do not expire
+	Expires *time.Time
+}
+
+// PasswordReset lets the holder of a reset token set a new password for
+// a user until Expires, Id being the hex SHA-256 of the token
+type PasswordReset struct {
+	Id      string
+	UserId  uuid.UUID
+	Created time.Time
+	Expires time.Time
+}
+
+// Webhook posts the events named in Events to Url, signed with Secret
+type Webhook struct {
+	Id      uuid.UUID
+	Url     string
+	Secret  string
+	Events  []string
+	Created time.Time
+}
+
+type WebhookEdit struct {
+	Url    *string
+	Secret *string
+	Events *[]string
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliverySucceeded DeliveryStatus = "succeeded"
+	// DeliveryFailed deliveries have used up their attempts, they are
+	// only tried again if replayed
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// WebhookDelivery logs the posting of an event to a webhook, Payload
+// being the body posted. ResponseStatus and Error are from the latest
+// attempt, ResponseStatus being 0 when there was no response
+type WebhookDelivery struct {
+	Id             uuid.UUID
+	WebhookId      uuid.UUID
+	EventId        uuid.UUID
+	Event          string
+	Payload        string
+	Status         DeliveryStatus
+	Attempts       int
+	ResponseStatus int
+	Error          string
+	Created        time.Time
+	Updated        time.Time
+}
+
+type JobStatus string
+
+const (
+	JobPending JobStatus = "pending"
+	JobRunning JobStatus = "running"
+	// JobDead jobs have used up their attempts, or are of a kind the
+	// server does not know, they stay until requeued or deleted
+	JobDead JobStatus = "dead"
+)
+
+// Job is work queued in the database to be run in the background by
+// any instance of the server. Payload is JSON read by the job's Kind.
+// A running job is leased to the worker running it until LockedUntil,
+// after which it is taken to have been abandoned and run again. Jobs
+// are deleted once they succeed
+type Job struct {
+	Id          uuid.UUID
+	Kind        string
+	Payload     string
+	Status      JobStatus
+	Attempts    int
+	MaxAttempts int
+	Error       string
+	RunAt       time.Time
+	LockedUntil time.Time
+	Created     time.Time
+	Updated     time.Time
+}
+
+type SearchKind string
+
+const (
+	SearchMessage SearchKind = "message"
+	SearchThread  SearchKind = "thread"
+)
+
+// SearchResult is a message or thread matching a search. For a thread
+// ThreadId is its own Id and AuthorId is uuid.Nil. Snippet is the
+// text around the matches, which are marked by the backend, and Rank
+// is higher for better matches within the one search
+type SearchResult struct {
+	Kind     SearchKind
+	Id       uuid.UUID
+	ThreadId uuid.UUID
+	AuthorId uuid.UUID
+	Created  time.Time
+	Snippet  string
+	Rank     float64
 }
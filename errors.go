@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/john-sharp/jerver/entities"
+	"log"
+	"net"
+	"net/http"
+)
+
+// statusForKind maps the kinds of entities.Error on to HTTP status
+// codes, errors of any other kind are internal server errors
+var statusForKind = map[entities.ErrorKind]int{
+	entities.NotFound:     http.StatusNotFound,
+	entities.Conflict:     http.StatusConflict,
+	entities.Validation:   http.StatusUnprocessableEntity,
+	entities.Unauthorized: http.StatusUnauthorized,
+	entities.Forbidden:    http.StatusForbidden,
+	entities.RateLimited:  http.StatusTooManyRequests,
+	entities.Unavailable:  http.StatusServiceUnavailable,
+}
+
+// errorBody is the machine-readable body sent with error responses
+type errorBody struct {
+	Error   string
+	Message string
+}
+
+func writeErrorBody(w http.ResponseWriter, kind entities.ErrorKind, msg string) {
+	status, ok := statusForKind[kind]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{Error: string(kind), Message: msg})
+}
+
+// writeError responds to a request that failed with err
+func writeError(w http.ResponseWriter, err error) {
+	var e *entities.Error
+	if errors.As(err, &e) {
+		writeErrorBody(w, e.Kind, e.Msg)
+		return
+	}
+	log.Print(err)
+	writeErrorBody(w, "internal", "internal server error")
+}
+
+// errorRewriter holds back error responses so that errorHandler can
+// replace them
+type errorRewriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (er *errorRewriter) WriteHeader(status int) {
+	if status >= 400 {
+		er.status = status
+		return
+	}
+	er.ResponseWriter.WriteHeader(status)
+}
+
+func (er *errorRewriter) Write(b []byte) (int, error) {
+	if er.status != 0 {
+		return er.body.Write(b)
+	}
+	return er.ResponseWriter.Write(b)
+}
+
+func (er *errorRewriter) Unwrap() http.ResponseWriter {
+	return er.ResponseWriter
+}
+
+// Flush and Hijack pass streams through, which have already written
+// a successful response
+func (er *errorRewriter) Flush() {
+	if f, ok := er.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (er *errorRewriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := er.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer cannot be hijacked")
+	}
+	return h.Hijack()
+}
+
+func (er *errorRewriter) finish() {
+	if er.status == 0 {
+		return
+	}
+
+	if kind, msg, ok := entities.ParseError(er.body.String()); ok {
+		writeErrorBody(er.ResponseWriter, kind, msg)
+		return
+	}
+
+	er.ResponseWriter.WriteHeader(er.status)
+	er.ResponseWriter.Write(er.body.Bytes())
+}
+
+// errorHandler gives the error responses written by entitycoll the
+// status code and body matching the entities.Error that caused them.
+// entitycoll only sees the error text, so the kind is recovered from
+// the message prefix
+func errorHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		er := &errorRewriter{ResponseWriter: w}
+		next.ServeHTTP(er, r)
+		er.finish()
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"log"
+	"sync"
+	"time"
+)
+
+// jobKind is a kind of job the workers can run. run is given the job,
+// its Attempts counting the attempt being made, and returns an error
+// for the job to be retried. The first retry waits retryBase, each
+// further one doubling the wait, until maxAttempts have been made and
+// the job is left dead. run must return once its ctx is done
+type jobKind struct {
+	run         func(ctx context.Context, j *entities.Job) error
+	maxAttempts int
+	retryBase   time.Duration
+}
+
+const (
+	jobPasswordResetMail = "password-reset-mail"
+	jobWebhookDelivery   = "webhook-delivery"
+)
+
+var jobKinds = map[string]jobKind{
+	jobPasswordResetMail: {run: sendPasswordResetMailJob, maxAttempts: 5, retryBase: time.Minute},
+	jobWebhookDelivery:   {run: webhooks.deliverJob, maxAttempts: webhookMaxAttempts, retryBase: webhookRetryBase},
+}
+
+var jobs jobCollection
+
+// enqueueJob queues a job of kind with payload, marshalled to JSON, to
+// be run at runAt, or as soon as a worker is free if runAt is the zero
+// time. The job is run once whichever instance of the server takes it
+func enqueueJob(ctx context.Context, kind string, payload interface{}, runAt time.Time) error {
+	k, ok := jobKinds[kind]
+	if !ok {
+		return fmt.Errorf("unknown job kind %q", kind)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if runAt.IsZero() {
+		runAt = now
+	}
+	j := entities.Job{
+		Kind:        kind,
+		Payload:     string(b),
+		Status:      entities.JobPending,
+		MaxAttempts: k.maxAttempts,
+		RunAt:       runAt.UTC(),
+		Created:     now,
+		Updated:     now,
+	}
+	j.Id, _ = uuid.NewV4()
+	if err = jobs.create(ctx, &j); err != nil {
+		return err
+	}
+
+	if !runAt.After(now) {
+		workers.wakeOne()
+	}
+	return nil
+}
+
+// jobWorkers run the jobs queued in the backend, polling it every
+// JobPollInterval, or sooner when this instance queues a job
+type jobWorkers struct {
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	// ctx is cancelled when draining takes too long, to stop the jobs
+	// still running
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var workers = newJobWorkers()
+
+func newJobWorkers() *jobWorkers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobWorkers{
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// start runs n workers, until drain is called
+func (jw *jobWorkers) start(n int) {
+	for i := 0; i < n; i++ {
+		jw.wg.Add(1)
+		go jw.work()
+	}
+}
+
+func (jw *jobWorkers) wakeOne() {
+	select {
+	case jw.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (jw *jobWorkers) work() {
+	defer jw.wg.Done()
+	for {
+		select {
+		case <-jw.stop:
+			return
+		default:
+		}
+
+		if jw.runNext() {
+			continue
+		}
+
+		select {
+		case <-jw.stop:
+			return
+		case <-jw.wake:
+		case <-time.After(time.Duration(conf.JobPollInterval)):
+		}
+	}
+}
+
+// runNext claims a due job and runs it, returning whether there was
+// one. The job is run for no longer than its lease, so that it is not
+// run twice at once
+func (jw *jobWorkers) runNext() bool {
+	lease := time.Duration(conf.JobLease)
+	j, err := jobs.claim(jw.ctx, time.Now(), lease)
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+		return false
+	}
+	if err != nil {
+		// not logged before the backend has been opened
+		if err != backend.ErrUnavailable {
+			log.Printf("jobs: %s", err)
+		}
+		return false
+	}
+
+	kind, ok := jobKinds[j.Kind]
+	switch {
+	case !ok:
+		err = fmt.Errorf("unknown job kind %q", j.Kind)
+		j.Attempts = j.MaxAttempts
+	case j.Attempts > j.MaxAttempts:
+		// claimed again after the lease of its last attempt ended
+		err = errors.New("abandoned on its last attempt")
+		j.Attempts = j.MaxAttempts
+	default:
+		ctx, cancel := context.WithTimeout(jw.ctx, lease)
+		err = kind.run(ctx, j)
+		cancel()
+	}
+
+	jw.finish(j, kind, err)
+	return true
+}
+
+// finish records the outcome of an attempt at j, which is deleted if
+// the attempt succeeded
+func (jw *jobWorkers) finish(j *entities.Job, kind jobKind, err error) {
+	ctx := context.Background()
+	if err == nil {
+		if err = jobs.deleteByUuid(ctx, j.Id); err != nil {
+			log.Printf("jobs: %s", err)
+		}
+		return
+	}
+
+	now := time.Now().UTC()
+	j.Error = err.Error()
+	j.LockedUntil = time.Time{}
+	j.Updated = now
+	switch {
+	case jw.ctx.Err() != nil:
+		// stopped by draining, so the attempt is not counted
+		j.Status = entities.JobPending
+		j.Attempts -= 1
+		j.RunAt = now
+	case j.Attempts >= j.MaxAttempts:
+		j.Status = entities.JobDead
+		log.Printf("jobs: %s job %s is dead after %d attempts: %s", j.Kind, j.Id, j.Attempts, err)
+	default:
+		j.Status = entities.JobPending
+		j.RunAt = now.Add(kind.retryBase << uint(j.Attempts-1))
+	}
+
+	if err = jobs.update(ctx, j); err != nil {
+		log.Printf("jobs: %s", err)
+	}
+}
+
+// drain stops the workers taking jobs and waits for the jobs running
+// to finish. If ctx is done first the jobs are cancelled, and put back
+// in the queue for the next start
+func (jw *jobWorkers) drain(ctx context.Context) {
+	close(jw.stop)
+
+	done := make(chan struct{})
+	go func() {
+		jw.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Print("jobs: cancelling the jobs still running")
+		jw.cancel()
+		<-done
+	}
+	jw.cancel()
+}
+
+// jobsCommand manages the job queue:
+//
+//	jerver jobs list [-status pending|running|dead] [-count n] [-page n]
+//	jerver jobs retry <id>
+//	jerver jobs delete <id>
+//
+// retry queues a job to run now with a fresh set of attempts, it is
+// how dead jobs are brought back
+func jobsCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("jobs needs one of list, retry or delete")
+	}
+
+	fs := flag.NewFlagSet("jobs "+args[0], flag.ExitOnError)
+	status := fs.String("status", string(entities.JobDead), "status of the jobs to list")
+	count := fs.Uint64("count", 50, "number of jobs to list")
+	page := fs.Int64("page", 0, "page of jobs to list")
+	fs.Parse(args[1:])
+
+	b, err := openForCommand()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	ctx := context.Background()
+	if args[0] == "list" {
+		return b.GetJobs(ctx, entities.JobStatus(*status), *count, *page, func(j entities.Job) {
+			fmt.Printf("%s\t%s\tattempts %d/%d\trun at %s\t%s\n",
+				j.Id, j.Kind, j.Attempts, j.MaxAttempts, j.RunAt.Format(time.RFC3339), j.Error)
+		})
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("jobs %s needs a job id", args[0])
+	}
+	id, err := uuid.FromString(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("bad job id %q", fs.Arg(0))
+	}
+
+	switch args[0] {
+	case "retry":
+		j, err := b.GetJob(ctx, id)
+		if err != nil {
+			return err
+		}
+		if j.Status == entities.JobRunning && j.LockedUntil.After(time.Now()) {
+			return fmt.Errorf("job %s is running", id)
+		}
+		now := time.Now().UTC()
+		j.Status = entities.JobPending
+		j.Attempts = 0
+		j.RunAt = now
+		j.LockedUntil = time.Time{}
+		j.Updated = now
+		if err = b.UpdateJob(ctx, j); err != nil {
+			return err
+		}
+		log.Printf("queued %s job %s to run again", j.Kind, id)
+		return nil
+	case "delete":
+		if err = b.DeleteJob(ctx, id); err != nil {
+			return err
+		}
+		log.Printf("deleted job %s", id)
+		return nil
+	default:
+		return fmt.Errorf("unknown jobs command %q", args[0])
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	memory "github.com/john-sharp/jerver/memory-dbbackend"
+	"github.com/satori/go.uuid"
+	"testing"
+	"time"
+)
+
+// testMemoryBackend sets up a memory backend, with its fixtures, for the
+// test, returning it
+func testMemoryBackend(t *testing.T) backend.Backend {
+	conf = defaultConfig
+	b, err := memory.Open(backend.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setDbBackend(b)
+	t.Cleanup(func() {
+		setDbBackend(backend.Unavailable{})
+		b.Close()
+	})
+	return b
+}
+
+// createTestJob queues a job of kind as if it had been claimed for its
+// attempts'th attempt
+func createTestJob(t *testing.T, b backend.Backend, kind string, attempts, maxAttempts int) *entities.Job {
+	now := time.Now().UTC()
+	j := &entities.Job{
+		Kind:        kind,
+		Payload:     "{}",
+		Status:      entities.JobRunning,
+		Attempts:    attempts,
+		MaxAttempts: maxAttempts,
+		RunAt:       now,
+		LockedUntil: now.Add(time.Minute),
+		Created:     now,
+		Updated:     now,
+	}
+	j.Id, _ = uuid.NewV4()
+	if err := b.CreateJob(context.Background(), j); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestJobFinish(t *testing.T) {
+	kind := jobKind{maxAttempts: 4, retryBase: time.Minute}
+	failed := errors.New("failed")
+	tests := []struct {
+		name     string
+		attempts int
+		err      error
+		drained  bool
+		// deleted, or else the status, attempts and retry delay it is
+		// left with
+		deleted bool
+		status  entities.JobStatus
+		left    int
+		retryIn time.Duration
+	}{
+		{"succeeded", 1, nil, false, true, "", 0, 0},
+		{"succeeded on last attempt", 4, nil, false, true, "", 0, 0},
+		{"first retry", 1, failed, false, false, entities.JobPending, 1, time.Minute},
+		{"second retry doubles", 2, failed, false, false, entities.JobPending, 2, 2 * time.Minute},
+		{"third retry doubles again", 3, failed, false, false, entities.JobPending, 3, 4 * time.Minute},
+		{"dead after max attempts", 4, failed, false, false, entities.JobDead, 4, 0},
+		{"drained attempt not counted", 2, failed, true, false, entities.JobPending, 1, 0},
+		{"drained last attempt not counted", 4, failed, true, false, entities.JobPending, 3, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := testMemoryBackend(t)
+			j := createTestJob(t, b, "test", test.attempts, kind.maxAttempts)
+			jw := newJobWorkers()
+			if test.drained {
+				jw.cancel()
+			}
+
+			before := time.Now()
+			jw.finish(j, kind, test.err)
+			after := time.Now()
+
+			got, err := b.GetJob(context.Background(), j.Id)
+			if test.deleted {
+				if k, _ := entities.ErrorKindOf(err); k != entities.NotFound {
+					t.Fatalf("job not deleted: %+v, %v", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != test.status || got.Attempts != test.left || got.Error != test.err.Error() {
+				t.Fatalf("got status %s, attempts %d, error %q, want %s, %d, %q",
+					got.Status, got.Attempts, got.Error, test.status, test.left, test.err)
+			}
+			if !got.LockedUntil.IsZero() {
+				t.Fatalf("job still locked until %s", got.LockedUntil)
+			}
+			if test.status == entities.JobPending &&
+				(got.RunAt.Before(before.Add(test.retryIn).Truncate(time.Microsecond)) || got.RunAt.After(after.Add(test.retryIn))) {
+				t.Fatalf("runs at %s, want %s after %s", got.RunAt, test.retryIn, before)
+			}
+		})
+	}
+}
+
+func TestJobRunNext(t *testing.T) {
+	failed := errors.New("failed")
+	jobKinds["test-ok"] = jobKind{run: func(ctx context.Context, j *entities.Job) error { return nil }, maxAttempts: 3, retryBase: time.Minute}
+	jobKinds["test-fail"] = jobKind{run: func(ctx context.Context, j *entities.Job) error { return failed }, maxAttempts: 3, retryBase: time.Minute}
+	defer delete(jobKinds, "test-ok")
+	defer delete(jobKinds, "test-fail")
+
+	tests := []struct {
+		name string
+		kind string
+		// attempts made before this claim
+		attempts int
+		deleted  bool
+		status   entities.JobStatus
+	}{
+		{"runs", "test-ok", 0, true, ""},
+		{"retries", "test-fail", 0, false, entities.JobPending},
+		{"dies on last attempt", "test-fail", 2, false, entities.JobDead},
+		{"abandoned on last attempt", "test-ok", 3, false, entities.JobDead},
+		{"unknown kind", "test-unknown", 0, false, entities.JobDead},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := testMemoryBackend(t)
+			j := createTestJob(t, b, test.kind, test.attempts, 3)
+			// due to be claimed again, as if its lease had ended
+			j.LockedUntil = time.Now().Add(-time.Second)
+			if err := b.UpdateJob(context.Background(), j); err != nil {
+				t.Fatal(err)
+			}
+
+			jw := newJobWorkers()
+			if !jw.runNext() {
+				t.Fatal("no job was run")
+			}
+			if jw.runNext() {
+				t.Fatal("a job was run twice")
+			}
+
+			got, err := b.GetJob(context.Background(), j.Id)
+			if test.deleted {
+				if k, _ := entities.ErrorKindOf(err); k != entities.NotFound {
+					t.Fatalf("job not deleted: %+v, %v", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != test.status {
+				t.Fatalf("got status %s, want %s (%s)", got.Status, test.status, got.Error)
+			}
+		})
+	}
+}
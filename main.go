@@ -1,20 +1,100 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	memory "github.com/john-sharp/jerver/memory-dbbackend"
+	"github.com/john-sharp/jerver/migrate"
+	pgsql "github.com/john-sharp/jerver/pgsql-dbbackend"
+	sqlite "github.com/john-sharp/jerver/sqlite-dbbackend"
 	"gitlab.com/johncolinsharp/entitycoll"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// backends maps the names accepted by the backend setting to the
+// function opening that storage backend
+var backends = map[string]backend.OpenFunc{
+	"pgsql":  pgsql.Open,
+	"sqlite": sqlite.Open,
+	"memory": memory.Open,
+}
+
+// migrators maps the backends with a schema to the function connecting
+// to their database for migrating it
+var migrators = map[string]func(config backend.Config) (*migrate.Migrator, error){
+	"pgsql":  pgsql.Migrator,
+	"sqlite": sqlite.Migrator,
+}
+
+var errBasicAuthDisabled = entities.NewError(entities.Unauthorized, "log in at /verification and use the access token")
+
+var errNotPassedOn = entities.NewError(entities.Unauthorized, "credentials were not checked by authHandler")
+
+// authorizeUser is entitycoll's RequestorAuthFn. Access tokens and API
+// keys reach it from authHandler under bearerUsername, as do Basic
+// credentials once authHandler has checked them, and it returns the
+// requestor with the context of the request. Credentials authHandler
+// has not passed on, for a request it is not serving, are refused
 func authorizeUser(uname, pwd string) (entitycoll.Entity, error) {
-	return users.verifyUser(uname, pwd)
+	if !strings.HasPrefix(uname, bearerUsername) {
+		if !conf.BasicAuth {
+			return nil, errBasicAuthDisabled
+		}
+		return nil, errNotPassedOn
+	}
+	ctx, ok := heldRequestContext(uname[len(bearerUsername):])
+	if !ok {
+		return nil, errNotPassedOn
+	}
+	requestor, err := users.verifyBearer(ctx, pwd)
+	if err != nil {
+		return nil, err
+	}
+	return &contextRequestor{requestor: requestor, ctx: ctx}, nil
+}
+
+// authenticateRequest finds the requestor of a request made to one of
+// jerver's own handlers, checking credentials as entitycoll does for
+// the collections
+func authenticateRequest(r *http.Request) (entitycoll.Entity, error) {
+	if token, ok := bearerToken(r); ok {
+		return users.verifyBearer(r.Context(), token)
+	}
+
+	uname, pword, ok := r.BasicAuth()
+	if !ok {
+		return nil, errors.New("no credentials supplied")
+	}
+	// as passed on by authHandler to handlers behind it
+	if strings.HasPrefix(uname, bearerUsername) {
+		return users.verifyBearer(r.Context(), pword)
+	}
+	if !conf.BasicAuth {
+		return nil, errBasicAuthDisabled
+	}
+	return users.verifyUser(r.Context(), uname, pword, remoteAddr(r))
 }
 
-// basic part of api for validating a user
+// basic part of api for validating a user, a GET checks the Basic
+// credentials given and a POST logs in with them
 func verificationHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Access-Control-Allow-Origin", "http://localhost:8090")
+	w.Header().Add("Access-Control-Allow-Origin", conf.AllowOrigin)
 	if r.Method == "OPTIONS" {
-		w.Header().Add("Access-Control-Allow-Headers", "Authorization")
-		w.Header().Add("Access-Control-Allow-Methods", "GET")
+		w.Header().Add("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Add("Access-Control-Allow-Methods", "GET, POST")
+		return
+	}
+
+	if r.Method == "POST" {
+		loginHandler(w, r)
 		return
 	}
 
@@ -24,20 +104,137 @@ func verificationHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "", http.StatusUnauthorized)
 		return
 	}
-	_, err := authorizeUser(uname, pword)
+	_, err := users.verifyUser(r.Context(), uname, pword, remoteAddr(r))
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.RateLimited || kind == entities.Unavailable {
+		writeError(w, err)
+		return
+	}
 	if err != nil {
 		http.Error(w, "incorrect uname/pword", http.StatusForbidden)
 		return
 	}
 }
 
+// reports whether the server can currently reach its storage backend
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if err := dbBackend().Ping(r.Context()); err != nil {
+		http.Error(w, "unhealthy: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
 func main() {
-	entitycoll.Configure(entitycoll.Configuration{ApiRoot: "/", AccessControlAllowOrigin: "http://localhost:8090", RequestorAuthFn: authorizeUser})
-	entitycoll.CreateApiObject(&users)
-	entitycoll.CreateApiObject(&threads)
-	entitycoll.CreateApiObject(&messages)
+	var err error
+	var args []string
+	conf, args, err = loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	openBackend, ok := backends[conf.Backend]
+	if !ok {
+		log.Fatalf("unknown backend %q", conf.Backend)
+	}
+
+	switch conf.Registration {
+	case registrationClosed, registrationOpen, registrationInvite, registrationApproval:
+	default:
+		log.Fatalf("unknown registration mode %q", conf.Registration)
+	}
+
+	if err = conf.passwordHashParams().Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	newMailer, ok := mailSenders[conf.MailSender]
+	if !ok {
+		log.Fatalf("unknown mail sender %q", conf.MailSender)
+	}
+	mailer = newMailer(&conf)
+
+	if conf.JobWorkers < 0 {
+		log.Fatalf("bad number of job workers %d", conf.JobWorkers)
+	}
+	if conf.MaxPageCount < 1 {
+		log.Fatalf("bad max page count %d", conf.MaxPageCount)
+	}
+
+	if len(args) > 0 {
+		if err = runCommand(args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	tokenKey = []byte(conf.TokenSecret)
+	if len(tokenKey) == 0 {
+		// tokens signed with a random key stop working when the server
+		// restarts, and are not accepted by other instances
+		log.Print("no token secret configured, using a random one")
+		if tokenKey, err = newTokenKey(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// the backend is opened in the background so that the server
+	// comes up, and reports itself unhealthy, while the database is
+	// unavailable
+	stopOpening := make(chan struct{})
+	go func() {
+		b, err := backend.OpenWithRetry(openBackend, conf.backendConfig(), stopOpening)
+		if errors.Is(err, backend.ErrUnsupported) {
+			log.Fatal(err)
+		}
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		b.Subscribe(messageEvents.handle)
+		b.Subscribe(webhooks.handle)
+		setDbBackend(b)
+		log.Printf("opened %s storage backend", conf.Backend)
+	}()
+
+	entitycoll.Configure(entitycoll.Configuration{ApiRoot: "/", AccessControlAllowOrigin: conf.AllowOrigin, RequestorAuthFn: authorizeUser})
+	entitycoll.CreateApiObject(projectedCollection{authorizedCollection{&users}})
+	entitycoll.CreateApiObject(projectedCollection{authorizedCollection{&threads}})
+	entitycoll.CreateApiObject(projectedCollection{authorizedCollection{&messages}})
+	entitycoll.CreateApiObject(projectedCollection{authorizedCollection{&webhooks}})
 
 	http.HandleFunc("/verification", verificationHandler)
+	http.HandleFunc("/verification/refresh", refreshHandler)
+	http.HandleFunc("/verification/logout", logoutHandler)
+	http.HandleFunc("/password", passwordHandler)
+	http.HandleFunc("/password/reset", passwordResetHandler)
+	http.HandleFunc("/password/reset/confirm", passwordResetConfirmHandler)
+	http.HandleFunc("/search", searchHandler)
+	http.HandleFunc("/health", healthHandler)
+
+	server := &http.Server{Addr: conf.ListenAddr, Handler: errorHandler(registrationHandler(cursorHandler(userSearchHandler(streamHandler(webhookDeliveryHandler(authHandler(http.DefaultServeMux)))))))}
+	server.RegisterOnShutdown(messageEvents.close)
+	workers.start(int(conf.JobWorkers))
+	shutdownDone := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		close(stopOpening)
+		server.Shutdown(context.Background())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.JobDrainTimeout))
+		workers.drain(ctx)
+		cancel()
+		close(shutdownDone)
+	}()
 
-	http.ListenAndServe(":8080", nil)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+
+	if err := dbBackend().Close(); err != nil {
+		log.Print(err)
+	}
 }
@@ -0,0 +1,1035 @@
+// Package dbbackend (memory-dbbackend) keeps users, threads and
+// messages in process memory. Nothing is persisted, it is meant for
+// frontend development, demos and tests where no database is to hand
+package dbbackend
+
+import (
+	"bytes"
+	"context"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"golang.org/x/crypto/bcrypt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend implements backend.Backend with slices held in memory
+type Backend struct {
+	mu       sync.RWMutex
+	users    []entities.User
+	threads  []entities.Thread
+	messages []entities.Message
+	// invites maps each invite code to the user that used it, or to
+	// nil while unused
+	invites  map[string]*uuid.UUID
+	sessions map[string]entities.Session
+	resets   map[string]entities.PasswordReset
+	apiKeys  map[string]entities.ApiKey
+	webhooks []entities.Webhook
+	// deliveries are in the order they were created
+	deliveries []entities.WebhookDelivery
+	jobs       []entities.Job
+	// securityEvents holds the latest maxSecurityEvents events
+	securityEvents []entities.SecurityEvent
+	bus            *backend.Bus
+}
+
+const maxSecurityEvents = 1000
+
+// Open returns a Backend preloaded with the same users, threads and
+// messages that initData puts in the SQL databases. The config is
+// ignored as there is nothing to connect to
+func Open(config backend.Config) (backend.Backend, error) {
+	b := &Backend{invites: map[string]*uuid.UUID{}, sessions: map[string]entities.Session{}, resets: map[string]entities.PasswordReset{}, apiKeys: map[string]entities.ApiKey{}}
+
+	userUuids := []uuid.UUID{}
+	for _, user := range fixtureUsers {
+		userUuid, _ := uuid.NewV4()
+		userUuids = append(userUuids, userUuid)
+		hpwd, err := bcrypt.GenerateFromPassword([]byte(user.Pwd), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+
+		b.users = append(b.users, entities.User{
+			Uuid:       userUuid,
+			FirstName:  user.FirstName,
+			SecondName: user.SecondName,
+			Username:   user.Username,
+			HashedPwd:  hpwd,
+			Approved:   true,
+			Role:       user.Role})
+	}
+
+	threadUuids := []uuid.UUID{}
+	for _, thread := range fixtureThreads {
+		threadUuid, _ := uuid.NewV4()
+		threadUuids = append(threadUuids, threadUuid)
+		b.threads = append(b.threads, entities.Thread{Id: threadUuid, Title: thread.Title, Created: time.Now().UTC()})
+	}
+
+	for _, message := range fixtureMessages {
+		messageUuid, _ := uuid.NewV4()
+		b.messages = append(b.messages, entities.Message{
+			Id:       messageUuid,
+			ThreadId: threadUuids[message.ThreadIndex],
+			AuthorId: userUuids[message.AuthorIndex],
+			Content:  message.Content,
+			Created:  time.Now().UTC()})
+	}
+
+	b.bus = backend.NewBus()
+	return b, nil
+}
+
+func (b *Backend) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (b *Backend) Close() error {
+	b.bus.Close()
+	return nil
+}
+
+// Subscribe is only for this process, as nothing else can share its
+// memory
+func (b *Backend) Subscribe(handler func(backend.Event)) func() {
+	return b.bus.Subscribe(handler)
+}
+
+// the find functions return the index of the matching entity, or -1.
+// Callers must hold mu
+func (b *Backend) findMessage(targetUuid uuid.UUID) int {
+	for i := range b.messages {
+		if uuid.Equal(b.messages[i].Id, targetUuid) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *Backend) findThread(targetUuid uuid.UUID) int {
+	for i := range b.threads {
+		if uuid.Equal(b.threads[i].Id, targetUuid) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *Backend) findUser(targetUuid uuid.UUID) int {
+	for i := range b.users {
+		if uuid.Equal(b.users[i].Uuid, targetUuid) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *Backend) findWebhook(id uuid.UUID) int {
+	for i, w := range b.webhooks {
+		if uuid.Equal(w.Id, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *Backend) findDelivery(id uuid.UUID) int {
+	for i, d := range b.deliveries {
+		if uuid.Equal(d.Id, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *Backend) findJob(id uuid.UUID) int {
+	for i, j := range b.jobs {
+		if uuid.Equal(j.Id, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// pageBounds converts count/page into slice bounds for a collection
+// of length n, in the same way as the LIMIT used by the SQL backends
+func pageBounds(n int, count uint64, page int64) (int, int) {
+	offset := page * int64(count)
+	if offset < 0 || offset >= int64(n) {
+		return n, n
+	}
+	end := offset + int64(count)
+	if end > int64(n) {
+		end = int64(n)
+	}
+	return int(offset), int(end)
+}
+
+// keyLess orders entities by (Created, Id), the same order the SQL
+// backends use
+func keyLess(aCreated time.Time, aId uuid.UUID, bCreated time.Time, bId uuid.UUID) bool {
+	if !aCreated.Equal(bCreated) {
+		return aCreated.Before(bCreated)
+	}
+	return bytes.Compare(aId.Bytes(), bId.Bytes()) < 0
+}
+
+// orderedMessages returns the messages of the thread ordered by key.
+// Callers must hold mu
+func (b *Backend) orderedMessages(threadId uuid.UUID) []entities.Message {
+	threadMessages := []entities.Message{}
+	for _, m := range b.messages {
+		if uuid.Equal(m.ThreadId, threadId) {
+			threadMessages = append(threadMessages, m)
+		}
+	}
+	sort.SliceStable(threadMessages, func(i, j int) bool {
+		return keyLess(threadMessages[i].Created, threadMessages[i].Id, threadMessages[j].Created, threadMessages[j].Id)
+	})
+	return threadMessages
+}
+
+// withStats fills in NumMsgs and LastMsgTime of t, these are worked
+// out from the messages on every read rather than being stored.
+// Callers must hold mu
+func (b *Backend) withStats(t entities.Thread) entities.Thread {
+	t.NumMsgs = 0
+	t.LastMsgTime = nil
+	for _, m := range b.messages {
+		if !uuid.Equal(m.ThreadId, t.Id) {
+			continue
+		}
+		t.NumMsgs += 1
+		if t.LastMsgTime == nil || m.Created.After(*t.LastMsgTime) {
+			created := m.Created
+			t.LastMsgTime = &created
+		}
+	}
+	return t
+}
+
+// orderedThreads returns all threads ordered by key. Callers must hold
+// mu
+func (b *Backend) orderedThreads() []entities.Thread {
+	threads := []entities.Thread{}
+	for _, t := range b.threads {
+		threads = append(threads, b.withStats(t))
+	}
+	sort.SliceStable(threads, func(i, j int) bool {
+		return keyLess(threads[i].Created, threads[i].Id, threads[j].Created, threads[j].Id)
+	})
+	return threads
+}
+
+// usersWithPrefix returns the users whose usernames start with prefix,
+// regardless of case, ordered by username as the SQL backends do
+func (b *Backend) usersWithPrefix(prefix string) []entities.User {
+	prefix = strings.ToLower(prefix)
+	users := []entities.User{}
+	for _, u := range b.users {
+		if strings.HasPrefix(strings.ToLower(u.Username), prefix) {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return strings.ToLower(users[i].Username) < strings.ToLower(users[j].Username)
+	})
+	return users
+}
+
+func (b *Backend) GetMessageByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.Message, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	i := b.findMessage(targetUuid)
+	if i == -1 {
+		return nil, entities.NewError(entities.NotFound, "message not found")
+	}
+
+	m := b.messages[i]
+	return &m, nil
+}
+
+func (b *Backend) CreateMessage(ctx context.Context, m *entities.Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.findMessage(m.Id) != -1 {
+		return entities.NewError(entities.Conflict, "message already exists")
+	}
+	if b.findThread(m.ThreadId) == -1 {
+		return entities.NewError(entities.Validation, "message refers to a thread that does not exist")
+	}
+	if b.findUser(m.AuthorId) == -1 {
+		return entities.NewError(entities.Validation, "message refers to an author that does not exist")
+	}
+
+	b.messages = append(b.messages, *m)
+	b.bus.Publish(backend.Event{Type: backend.MessageCreated, ThreadId: m.ThreadId, MessageId: m.Id})
+	return nil
+}
+
+func (b *Backend) DeleteMessageByUuid(ctx context.Context, targetUuid uuid.UUID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.findMessage(targetUuid)
+	if i == -1 {
+		return entities.NewError(entities.NotFound, "message not found")
+	}
+
+	threadId := b.messages[i].ThreadId
+	b.messages = append(b.messages[:i], b.messages[i+1:]...)
+	b.bus.Publish(backend.Event{Type: backend.MessageDeleted, ThreadId: threadId, MessageId: targetUuid})
+	return nil
+}
+
+func (b *Backend) GetMessageCollection(ctx context.Context, threadId uuid.UUID, count uint64, page int64, appendToCollection func(entities.Message)) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	threadMessages := b.orderedMessages(threadId)
+	start, end := pageBounds(len(threadMessages), count, page)
+	for _, m := range threadMessages[start:end] {
+		appendToCollection(m)
+	}
+	return nil
+}
+
+func (b *Backend) GetMessageCollectionAfter(ctx context.Context, threadId uuid.UUID, after *backend.Cursor, count uint64, appendToCollection func(entities.Message)) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	appended := uint64(0)
+	for _, m := range b.orderedMessages(threadId) {
+		if appended == count {
+			break
+		}
+		if after != nil && !keyLess(after.Created, after.Id, m.Created, m.Id) {
+			continue
+		}
+		appendToCollection(m)
+		appended += 1
+	}
+	return nil
+}
+
+func (b *Backend) GetMessageTotal(ctx context.Context, threadId uuid.UUID) (uint, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	ret := uint(0)
+	for _, m := range b.messages {
+		if uuid.Equal(m.ThreadId, threadId) {
+			ret += 1
+		}
+	}
+	return ret, nil
+}
+
+func (b *Backend) EditMessageByUuid(ctx context.Context, targetUuid uuid.UUID, m *entities.MessageEdit) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.findMessage(targetUuid)
+	if i == -1 {
+		return entities.NewError(entities.NotFound, "message not found")
+	}
+
+	if m.ThreadId != nil && b.findThread(*m.ThreadId) == -1 {
+		return entities.NewError(entities.Validation, "message refers to a thread that does not exist")
+	}
+	if m.AuthorId != nil && b.findUser(*m.AuthorId) == -1 {
+		return entities.NewError(entities.Validation, "message refers to an author that does not exist")
+	}
+
+	e := backend.MessageEditedEvent(targetUuid, b.messages[i].ThreadId, m.ThreadId)
+	if m.ThreadId != nil {
+		b.messages[i].ThreadId = *m.ThreadId
+	}
+
+	if m.AuthorId != nil {
+		b.messages[i].AuthorId = *m.AuthorId
+	}
+
+	if m.Content != nil {
+		b.messages[i].Content = *m.Content
+	}
+	b.bus.Publish(e)
+	return nil
+}
+
+func (b *Backend) GetThreadByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.Thread, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	i := b.findThread(targetUuid)
+	if i == -1 {
+		return nil, entities.NewError(entities.NotFound, "thread not found")
+	}
+
+	t := b.withStats(b.threads[i])
+	return &t, nil
+}
+
+func (b *Backend) CreateThread(ctx context.Context, t *entities.Thread) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.findThread(t.Id) != -1 {
+		return entities.NewError(entities.Conflict, "thread already exists")
+	}
+
+	b.threads = append(b.threads, entities.Thread{Id: t.Id, Title: t.Title, Created: t.Created})
+	b.bus.Publish(backend.Event{Type: backend.ThreadCreated, ThreadId: t.Id})
+	return nil
+}
+
+func (b *Backend) DeleteThreadByUuid(ctx context.Context, targetUuid uuid.UUID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.findThread(targetUuid)
+	if i == -1 {
+		return entities.NewError(entities.NotFound, "thread not found")
+	}
+
+	// the SQL backends refuse this through the messages foreign key
+	for _, m := range b.messages {
+		if uuid.Equal(m.ThreadId, targetUuid) {
+			return entities.NewError(entities.Conflict, "thread is still in use")
+		}
+	}
+
+	b.threads = append(b.threads[:i], b.threads[i+1:]...)
+	b.bus.Publish(backend.Event{Type: backend.ThreadDeleted, ThreadId: targetUuid})
+	return nil
+}
+
+func (b *Backend) GetThreadCollection(ctx context.Context, count uint64, page int64, appendToCollection func(entities.Thread)) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	threads := b.orderedThreads()
+	start, end := pageBounds(len(threads), count, page)
+	for _, t := range threads[start:end] {
+		appendToCollection(t)
+	}
+	return nil
+}
+
+func (b *Backend) GetThreadCollectionAfter(ctx context.Context, after *backend.Cursor, count uint64, appendToCollection func(entities.Thread)) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	appended := uint64(0)
+	for _, t := range b.orderedThreads() {
+		if appended == count {
+			break
+		}
+		if after != nil && !keyLess(after.Created, after.Id, t.Created, t.Id) {
+			continue
+		}
+		appendToCollection(t)
+		appended += 1
+	}
+	return nil
+}
+
+func (b *Backend) GetThreadTotal(ctx context.Context) (uint, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return uint(len(b.threads)), nil
+}
+
+func (b *Backend) EditThreadByUuid(ctx context.Context, targetUuid uuid.UUID, t *entities.ThreadEdit) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.findThread(targetUuid)
+	if i == -1 {
+		return entities.NewError(entities.NotFound, "thread not found")
+	}
+
+	if t.Title != nil {
+		b.threads[i].Title = *t.Title
+	}
+	b.bus.Publish(backend.Event{Type: backend.ThreadEdited, ThreadId: targetUuid})
+	return nil
+}
+
+// ReconcileThreadStats has nothing to do, thread stats are always
+// worked out from the messages
+func (b *Backend) ReconcileThreadStats(ctx context.Context) error {
+	return nil
+}
+
+func (b *Backend) GetUserByUsername(ctx context.Context, uname string) (*entities.User, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, u := range b.users {
+		if strings.EqualFold(u.Username, uname) {
+			return &u, nil
+		}
+	}
+	return nil, entities.NewError(entities.NotFound, "user not found")
+}
+
+func (b *Backend) GetUserByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.User, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	i := b.findUser(targetUuid)
+	if i == -1 {
+		return nil, entities.NewError(entities.NotFound, "user not found")
+	}
+
+	u := b.users[i]
+	return &u, nil
+}
+
+func (b *Backend) GetUserCollection(ctx context.Context, prefix string, count uint64, page int64, appendToCollection func(entities.User)) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	users := b.usersWithPrefix(prefix)
+	start, end := pageBounds(len(users), count, page)
+	for _, u := range users[start:end] {
+		appendToCollection(u)
+	}
+	return nil
+}
+
+func (b *Backend) GetUserTotal(ctx context.Context, prefix string) (uint, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return uint(len(b.usersWithPrefix(prefix))), nil
+}
+
+func (b *Backend) EditUserByUuid(ctx context.Context, targetUuid uuid.UUID, u *entities.UserEdit) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.findUser(targetUuid)
+	if i == -1 {
+		return entities.NewError(entities.NotFound, "user not found")
+	}
+
+	if u.FirstName != nil {
+		b.users[i].FirstName = *u.FirstName
+	}
+	if u.SecondName != nil {
+		b.users[i].SecondName = *u.SecondName
+	}
+	if u.DisplayName != nil {
+		b.users[i].DisplayName = *u.DisplayName
+	}
+	if u.Bio != nil {
+		b.users[i].Bio = *u.Bio
+	}
+	if u.Role != nil {
+		b.users[i].Role = *u.Role
+	}
+	return nil
+}
+
+func (b *Backend) CreateUser(ctx context.Context, u *entities.User, inviteCode string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, existing := range b.users {
+		if strings.EqualFold(existing.Username, u.Username) {
+			return entities.NewError(entities.Conflict, "user already exists")
+		}
+	}
+
+	if inviteCode != "" {
+		usedBy, ok := b.invites[inviteCode]
+		if !ok || usedBy != nil {
+			return entities.NewError(entities.Validation, "invite code is not valid or has been used")
+		}
+		userUuid := u.Uuid
+		b.invites[inviteCode] = &userUuid
+	}
+
+	b.users = append(b.users, *u)
+	return nil
+}
+
+func (b *Backend) SetUserRole(ctx context.Context, targetUuid uuid.UUID, role entities.Role) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.findUser(targetUuid)
+	if i == -1 {
+		return entities.NewError(entities.NotFound, "user not found")
+	}
+	b.users[i].Role = role
+	return nil
+}
+
+func (b *Backend) SetUserPassword(ctx context.Context, targetUuid uuid.UUID, hashedPwd []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.findUser(targetUuid)
+	if i == -1 {
+		return entities.NewError(entities.NotFound, "user not found")
+	}
+	b.users[i].HashedPwd = hashedPwd
+	b.users[i].TokenGeneration += 1
+
+	for id, s := range b.sessions {
+		if uuid.Equal(s.UserId, targetUuid) {
+			delete(b.sessions, id)
+		}
+	}
+	for id, r := range b.resets {
+		if uuid.Equal(r.UserId, targetUuid) {
+			delete(b.resets, id)
+		}
+	}
+	return nil
+}
+
+func (b *Backend) UpgradeUserPassword(ctx context.Context, targetUuid uuid.UUID, oldHash, newHash []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.findUser(targetUuid)
+	if i == -1 || !bytes.Equal(b.users[i].HashedPwd, oldHash) {
+		return entities.NewError(entities.NotFound, "user not found")
+	}
+	b.users[i].HashedPwd = newHash
+	return nil
+}
+
+func (b *Backend) ApproveUser(ctx context.Context, uname string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i := range b.users {
+		if strings.EqualFold(b.users[i].Username, uname) {
+			b.users[i].Approved = true
+			return nil
+		}
+	}
+	return entities.NewError(entities.NotFound, "user not found")
+}
+
+func (b *Backend) CreateInvite(ctx context.Context, code string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.invites[code]; ok {
+		return entities.NewError(entities.Conflict, "invite already exists")
+	}
+	b.invites[code] = nil
+	return nil
+}
+
+func (b *Backend) CreateSession(ctx context.Context, s *entities.Session) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.sessions[s.Id]; ok {
+		return entities.NewError(entities.Conflict, "session already exists")
+	}
+	b.sessions[s.Id] = *s
+	return nil
+}
+
+func (b *Backend) TakeSession(ctx context.Context, id string) (*entities.Session, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.sessions[id]
+	if !ok {
+		return nil, entities.NewError(entities.NotFound, "session not found")
+	}
+	delete(b.sessions, id)
+	return &s, nil
+}
+
+func (b *Backend) DeleteUserSessions(ctx context.Context, userId uuid.UUID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, s := range b.sessions {
+		if uuid.Equal(s.UserId, userId) {
+			delete(b.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (b *Backend) CreatePasswordReset(ctx context.Context, r *entities.PasswordReset) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.resets[r.Id]; ok {
+		return entities.NewError(entities.Conflict, "password reset already exists")
+	}
+	b.resets[r.Id] = *r
+	return nil
+}
+
+func (b *Backend) TakePasswordReset(ctx context.Context, id string) (*entities.PasswordReset, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.resets[id]
+	if !ok {
+		return nil, entities.NewError(entities.NotFound, "password reset not found")
+	}
+	delete(b.resets, id)
+	return &r, nil
+}
+
+func (b *Backend) ReplacePasswordReset(ctx context.Context, oldId, newId string) (*entities.PasswordReset, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.resets[oldId]
+	if !ok {
+		return nil, entities.NewError(entities.NotFound, "password reset not found")
+	}
+	if _, ok := b.resets[newId]; ok {
+		return nil, entities.NewError(entities.Conflict, "password reset already exists")
+	}
+	delete(b.resets, oldId)
+	r.Id = newId
+	b.resets[newId] = r
+	return &r, nil
+}
+
+func (b *Backend) CreateApiKey(ctx context.Context, k *entities.ApiKey) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, existing := range b.apiKeys {
+		if existing.Id == k.Id || uuid.Equal(existing.UserId, k.UserId) && existing.Name == k.Name {
+			return entities.NewError(entities.Conflict, "API key already exists")
+		}
+	}
+	if b.findUser(k.UserId) == -1 {
+		return entities.NewError(entities.Validation, "API key refers to something that does not exist")
+	}
+	b.apiKeys[k.Id] = *k
+	return nil
+}
+
+func (b *Backend) GetApiKey(ctx context.Context, id string) (*entities.ApiKey, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	k, ok := b.apiKeys[id]
+	if !ok {
+		return nil, entities.NewError(entities.NotFound, "API key not found")
+	}
+	return &k, nil
+}
+
+func (b *Backend) GetUserApiKeys(ctx context.Context, userId uuid.UUID, appendToCollection func(entities.ApiKey)) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	keys := []entities.ApiKey{}
+	for _, k := range b.apiKeys {
+		if uuid.Equal(k.UserId, userId) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+	for _, k := range keys {
+		appendToCollection(k)
+	}
+	return nil
+}
+
+func (b *Backend) DeleteApiKey(ctx context.Context, userId uuid.UUID, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, k := range b.apiKeys {
+		if uuid.Equal(k.UserId, userId) && k.Name == name {
+			delete(b.apiKeys, id)
+			return nil
+		}
+	}
+	return entities.NewError(entities.NotFound, "API key not found")
+}
+
+func (b *Backend) RecordSecurityEvent(ctx context.Context, e *entities.SecurityEvent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.securityEvents) == maxSecurityEvents {
+		b.securityEvents = b.securityEvents[1:]
+	}
+	b.securityEvents = append(b.securityEvents, *e)
+	return nil
+}
+
+// copyWebhook keeps the events of webhooks held from being changed
+// through those passed in or out
+func copyWebhook(w entities.Webhook) entities.Webhook {
+	w.Events = append([]string(nil), w.Events...)
+	return w
+}
+
+func (b *Backend) CreateWebhook(ctx context.Context, w *entities.Webhook) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.findWebhook(w.Id) != -1 {
+		return entities.NewError(entities.Conflict, "webhook already exists")
+	}
+	b.webhooks = append(b.webhooks, copyWebhook(*w))
+	return nil
+}
+
+func (b *Backend) GetWebhook(ctx context.Context, id uuid.UUID) (*entities.Webhook, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	i := b.findWebhook(id)
+	if i == -1 {
+		return nil, entities.NewError(entities.NotFound, "webhook not found")
+	}
+	w := copyWebhook(b.webhooks[i])
+	return &w, nil
+}
+
+func (b *Backend) GetWebhooks(ctx context.Context, appendToCollection func(entities.Webhook)) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, w := range b.webhooks {
+		appendToCollection(copyWebhook(w))
+	}
+	return nil
+}
+
+func (b *Backend) EditWebhookByUuid(ctx context.Context, id uuid.UUID, w *entities.WebhookEdit) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.findWebhook(id)
+	if i == -1 {
+		return entities.NewError(entities.NotFound, "webhook not found")
+	}
+
+	if w.Url != nil {
+		b.webhooks[i].Url = *w.Url
+	}
+	if w.Secret != nil {
+		b.webhooks[i].Secret = *w.Secret
+	}
+	if w.Events != nil {
+		b.webhooks[i].Events = append([]string(nil), *w.Events...)
+	}
+	return nil
+}
+
+func (b *Backend) DeleteWebhookByUuid(ctx context.Context, id uuid.UUID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.findWebhook(id)
+	if i == -1 {
+		return entities.NewError(entities.NotFound, "webhook not found")
+	}
+	b.webhooks = append(b.webhooks[:i], b.webhooks[i+1:]...)
+
+	kept := b.deliveries[:0]
+	for _, d := range b.deliveries {
+		if !uuid.Equal(d.WebhookId, id) {
+			kept = append(kept, d)
+		}
+	}
+	b.deliveries = kept
+	return nil
+}
+
+func (b *Backend) CreateWebhookDelivery(ctx context.Context, d *entities.WebhookDelivery) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, existing := range b.deliveries {
+		if uuid.Equal(existing.Id, d.Id) || uuid.Equal(existing.WebhookId, d.WebhookId) && uuid.Equal(existing.EventId, d.EventId) {
+			return entities.NewError(entities.Conflict, "webhook delivery already exists")
+		}
+	}
+	if b.findWebhook(d.WebhookId) == -1 {
+		return entities.NewError(entities.Validation, "webhook delivery refers to something that does not exist")
+	}
+	b.deliveries = append(b.deliveries, *d)
+	return nil
+}
+
+func (b *Backend) UpdateWebhookDelivery(ctx context.Context, d *entities.WebhookDelivery) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.findDelivery(d.Id)
+	if i == -1 {
+		return entities.NewError(entities.NotFound, "webhook delivery not found")
+	}
+	b.deliveries[i].Status = d.Status
+	b.deliveries[i].Attempts = d.Attempts
+	b.deliveries[i].ResponseStatus = d.ResponseStatus
+	b.deliveries[i].Error = d.Error
+	b.deliveries[i].Updated = d.Updated
+	return nil
+}
+
+func (b *Backend) GetWebhookDelivery(ctx context.Context, id uuid.UUID) (*entities.WebhookDelivery, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	i := b.findDelivery(id)
+	if i == -1 {
+		return nil, entities.NewError(entities.NotFound, "webhook delivery not found")
+	}
+	d := b.deliveries[i]
+	return &d, nil
+}
+
+func (b *Backend) GetWebhookDeliveries(ctx context.Context, webhookId uuid.UUID, count uint64, page int64, appendToCollection func(entities.WebhookDelivery)) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	deliveries := []entities.WebhookDelivery{}
+	for i := len(b.deliveries) - 1; i >= 0; i-- {
+		if uuid.Equal(b.deliveries[i].WebhookId, webhookId) {
+			deliveries = append(deliveries, b.deliveries[i])
+		}
+	}
+	start, end := pageBounds(len(deliveries), count, page)
+	for _, d := range deliveries[start:end] {
+		appendToCollection(d)
+	}
+	return nil
+}
+
+func (b *Backend) GetWebhookDeliveryTotal(ctx context.Context, webhookId uuid.UUID) (uint, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	ret := uint(0)
+	for _, d := range b.deliveries {
+		if uuid.Equal(d.WebhookId, webhookId) {
+			ret += 1
+		}
+	}
+	return ret, nil
+}
+
+func (b *Backend) CreateJob(ctx context.Context, j *entities.Job) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.findJob(j.Id) != -1 {
+		return entities.NewError(entities.Conflict, "job already exists")
+	}
+	b.jobs = append(b.jobs, *j)
+	return nil
+}
+
+func (b *Backend) ClaimJob(ctx context.Context, now time.Time, lease time.Duration) (*entities.Job, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	claim := -1
+	for i, j := range b.jobs {
+		due := j.Status == entities.JobPending && !j.RunAt.After(now) ||
+			j.Status == entities.JobRunning && !j.LockedUntil.After(now)
+		if due && (claim == -1 || j.RunAt.Before(b.jobs[claim].RunAt)) {
+			claim = i
+		}
+	}
+	if claim == -1 {
+		return nil, entities.NewError(entities.NotFound, "no job is due")
+	}
+
+	j := &b.jobs[claim]
+	j.Status = entities.JobRunning
+	j.Attempts += 1
+	j.LockedUntil = now.Add(lease)
+	j.Updated = now
+	ret := *j
+	return &ret, nil
+}
+
+func (b *Backend) UpdateJob(ctx context.Context, j *entities.Job) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.findJob(j.Id)
+	if i == -1 {
+		return entities.NewError(entities.NotFound, "job not found")
+	}
+	b.jobs[i].Payload = j.Payload
+	b.jobs[i].Status = j.Status
+	b.jobs[i].Attempts = j.Attempts
+	b.jobs[i].Error = j.Error
+	b.jobs[i].RunAt = j.RunAt
+	b.jobs[i].LockedUntil = j.LockedUntil
+	b.jobs[i].Updated = j.Updated
+	return nil
+}
+
+func (b *Backend) DeleteJob(ctx context.Context, id uuid.UUID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.findJob(id)
+	if i == -1 {
+		return entities.NewError(entities.NotFound, "job not found")
+	}
+	b.jobs = append(b.jobs[:i], b.jobs[i+1:]...)
+	return nil
+}
+
+func (b *Backend) GetJob(ctx context.Context, id uuid.UUID) (*entities.Job, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	i := b.findJob(id)
+	if i == -1 {
+		return nil, entities.NewError(entities.NotFound, "job not found")
+	}
+	j := b.jobs[i]
+	return &j, nil
+}
+
+func (b *Backend) GetJobs(ctx context.Context, status entities.JobStatus, count uint64, page int64, appendToCollection func(entities.Job)) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	jobs := []entities.Job{}
+	for _, j := range b.jobs {
+		if j.Status == status {
+			jobs = append(jobs, j)
+		}
+	}
+	sort.SliceStable(jobs, func(i, k int) bool {
+		return jobs[i].RunAt.Before(jobs[k].RunAt)
+	})
+	start, end := pageBounds(len(jobs), count, page)
+	for _, j := range jobs[start:end] {
+		appendToCollection(j)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package dbbackend
+
+import (
+	"bytes"
+	"context"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestMessageCollectionAfterEqualCreated pages through messages, many
+// created at the same time, checking every page follows on from the
+// last whatever the count
+func TestMessageCollectionAfterEqualCreated(t *testing.T) {
+	ctx := context.Background()
+	b, err := Open(backend.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	mb := b.(*Backend)
+
+	threadId, _ := uuid.NewV4()
+	if err = b.CreateThread(ctx, &entities.Thread{Id: threadId, Title: "keyset", Created: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var want []entities.Message
+	for i := 0; i < 10; i++ {
+		m := entities.Message{
+			ThreadId: threadId,
+			AuthorId: mb.users[0].Uuid,
+			Content:  "message",
+			// three runs of messages created at the same time,
+			// created in the opposite order to their times
+			Created: base.Add(time.Duration(2-i/4) * time.Minute),
+		}
+		m.Id, _ = uuid.NewV4()
+		if err = b.CreateMessage(ctx, &m); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, m)
+	}
+	sort.Slice(want, func(i, j int) bool {
+		if !want[i].Created.Equal(want[j].Created) {
+			return want[i].Created.Before(want[j].Created)
+		}
+		return bytes.Compare(want[i].Id.Bytes(), want[j].Id.Bytes()) < 0
+	})
+
+	for _, count := range []uint64{1, 2, 3, 4, 9, 10, 11} {
+		var got []entities.Message
+		var after *backend.Cursor
+		for pages := 0; ; pages++ {
+			if pages > len(want) {
+				t.Fatalf("count %d: paging does not end", count)
+			}
+			var page []entities.Message
+			err = b.GetMessageCollectionAfter(ctx, threadId, after, count, func(m entities.Message) {
+				page = append(page, m)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uint64(len(page)) > count {
+				t.Fatalf("count %d: page of %d messages", count, len(page))
+			}
+			if len(page) == 0 {
+				break
+			}
+			got = append(got, page...)
+			last := page[len(page)-1]
+			after = &backend.Cursor{Created: last.Created, Id: last.Id}
+		}
+
+		if len(got) != len(want) {
+			t.Fatalf("count %d: read %d messages, want %d", count, len(got), len(want))
+		}
+		for i := range want {
+			if !uuid.Equal(got[i].Id, want[i].Id) {
+				t.Fatalf("count %d: message %d is %s, want %s", count, i, got[i].Id, want[i].Id)
+			}
+		}
+	}
+}
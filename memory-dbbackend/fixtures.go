@@ -0,0 +1,43 @@
+package dbbackend
+
+import (
+	"github.com/john-sharp/jerver/entities"
+)
+
+type userBaseDetails struct {
+	FirstName  string
+	SecondName string
+	Username   string
+	Pwd        string
+	Role       entities.Role
+}
+
+var fixtureUsers = []userBaseDetails{
+	{"Robert", "Gascoyne-Cecil", "salisbury", "1895", entities.RoleAdmin},
+	{"Arthur", "Balfour", "abalfour", "1902", entities.RoleModerator},
+	{"Henry", "Campbell-Bannerman", "hcb", "1905", entities.RoleMember},
+	{"Herbert", "Asquith", "hasquith", "1908", entities.RoleMember},
+	{"David", "Lloyd George", "dlg", "1916", entities.RoleMember},
+}
+
+type threadBaseDetails struct {
+	Title string
+}
+
+var fixtureThreads = []threadBaseDetails{
+	{"Who's the best PM?"},
+	{"Favourite Commons memory?"},
+}
+
+type messageBaseDetails struct {
+	ThreadIndex uint
+	AuthorIndex uint
+	Content     string
+}
+
+var fixtureMessages = []messageBaseDetails{
+	{0, 3, "Asquith"},
+	{0, 4, "Lloyd George"},
+	{1, 3, "That day we declared war"},
+	{1, 4, "When I forced Asquith out"},
+}
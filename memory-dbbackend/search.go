@@ -0,0 +1,173 @@
+package dbbackend
+
+import (
+	"bytes"
+	"context"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// words of context given in snippets before the first match, and in
+// all
+const (
+	snippetBefore = 8
+	snippetWords  = 32
+)
+
+// searchMatch matches text against terms, a word matching a term when
+// it starts with it, in place of the stemming of the SQL backends. It
+// returns the number of words matching if every term does, and the
+// snippet of the text around the matches
+func searchMatch(text string, terms []string) (int, string) {
+	type span struct {
+		start, end int
+		match      bool
+	}
+	var words []span
+	start := -1
+	for i, r := range text + " " {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if inWord && start == -1 {
+			start = i
+		} else if !inWord && start != -1 {
+			words = append(words, span{start: start, end: i})
+			start = -1
+		}
+	}
+
+	matched := map[string]bool{}
+	n, first := 0, -1
+	for i := range words {
+		w := strings.ToLower(text[words[i].start:words[i].end])
+		for _, term := range terms {
+			if strings.HasPrefix(w, term) {
+				matched[term] = true
+				words[i].match = true
+			}
+		}
+		if words[i].match {
+			n += 1
+			if first == -1 {
+				first = i
+			}
+		}
+	}
+	if len(matched) < len(terms) || n == 0 {
+		return 0, ""
+	}
+
+	from := first - snippetBefore
+	if from < 0 {
+		from = 0
+	}
+	to := from + snippetWords
+	if to > len(words) {
+		to = len(words)
+	}
+	var snippet strings.Builder
+	if from > 0 {
+		snippet.WriteString("…")
+	}
+	pos := words[from].start
+	for _, w := range words[from:to] {
+		snippet.WriteString(text[pos:w.start])
+		if w.match {
+			snippet.WriteString(backend.SnippetStart + text[w.start:w.end] + backend.SnippetEnd)
+		} else {
+			snippet.WriteString(text[w.start:w.end])
+		}
+		pos = w.end
+	}
+	if to < len(words) {
+		snippet.WriteString("…")
+	} else {
+		snippet.WriteString(text[pos:])
+	}
+	return n, snippet.String()
+}
+
+func inSearchPeriod(q *backend.SearchQuery, created time.Time) bool {
+	return (q.Since == nil || !created.Before(*q.Since)) && (q.Until == nil || created.Before(*q.Until))
+}
+
+// search finds every result of q, in order. Rank is the number of
+// words matching per hundred words of text
+func (b *Backend) search(q *backend.SearchQuery) []entities.SearchResult {
+	results := []entities.SearchResult{}
+	rank := func(n int, text string) float64 {
+		return float64(n) * 100 / float64(len(strings.Fields(text))+1)
+	}
+
+	if q.Messages {
+		for _, m := range b.messages {
+			if q.AuthorId != nil && !uuid.Equal(m.AuthorId, *q.AuthorId) ||
+				q.ThreadId != nil && !uuid.Equal(m.ThreadId, *q.ThreadId) ||
+				!inSearchPeriod(q, m.Created) {
+				continue
+			}
+			if n, snippet := searchMatch(m.Content, q.Terms); n > 0 {
+				results = append(results, entities.SearchResult{
+					Kind:     entities.SearchMessage,
+					Id:       m.Id,
+					ThreadId: m.ThreadId,
+					AuthorId: m.AuthorId,
+					Created:  m.Created,
+					Snippet:  snippet,
+					Rank:     rank(n, m.Content),
+				})
+			}
+		}
+	}
+	if q.Threads && q.AuthorId == nil {
+		for _, t := range b.threads {
+			if q.ThreadId != nil && !uuid.Equal(t.Id, *q.ThreadId) || !inSearchPeriod(q, t.Created) {
+				continue
+			}
+			if n, snippet := searchMatch(t.Title, q.Terms); n > 0 {
+				results = append(results, entities.SearchResult{
+					Kind:     entities.SearchThread,
+					Id:       t.Id,
+					ThreadId: t.Id,
+					Created:  t.Created,
+					Snippet:  snippet,
+					Rank:     rank(n, t.Title),
+				})
+			}
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		if !results[i].Created.Equal(results[j].Created) {
+			return results[i].Created.After(results[j].Created)
+		}
+		return bytes.Compare(results[i].Id.Bytes(), results[j].Id.Bytes()) < 0
+	})
+	return results
+}
+
+func (b *Backend) Search(ctx context.Context, q *backend.SearchQuery, count uint64, page int64, appendToCollection func(entities.SearchResult)) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	results := b.search(q)
+	start, end := pageBounds(len(results), count, page)
+	for _, r := range results[start:end] {
+		appendToCollection(r)
+	}
+	return nil
+}
+
+func (b *Backend) SearchTotal(ctx context.Context, q *backend.SearchQuery) (uint, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return uint(len(b.search(q))), nil
+}
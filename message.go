@@ -2,10 +2,11 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
+	"github.com/john-sharp/jerver/backend"
 	"github.com/john-sharp/jerver/entities"
 	"github.com/satori/go.uuid"
 	"gitlab.com/johncolinsharp/entitycoll"
+	"time"
 )
 
 type message entities.Message
@@ -27,20 +28,21 @@ func (mc *messageCollection) CreateEntity(requestor entitycoll.Entity, parentEnt
 
 	threadId, ok := parentEntityUuids["threads"]
 	if !ok {
-		return "", errors.New("no thread ID supplied")
+		return "", entities.NewError(entities.Validation, "no thread ID supplied")
 	}
 
 	err := json.Unmarshal(body, &m)
 	if err != nil {
-		return "", err
+		return "", entities.WrapError(entities.Validation, "malformed message", err)
 	}
 
 	m.Id, _ = uuid.NewV4()
+	m.Created = time.Now().UTC()
 	m.ThreadId = threadId
-	user := requestor.(*user)
-	m.AuthorId = user.Uuid
+	author, _ := requestorUser(requestor)
+	m.AuthorId = author.Uuid
 
-	err = mc.create(&m)
+	err = mc.create(requestContext(requestor), &m)
 
 	if err != nil {
 		return "", err
@@ -51,33 +53,29 @@ func (mc *messageCollection) CreateEntity(requestor entitycoll.Entity, parentEnt
 }
 
 func (mc *messageCollection) GetEntity(requestor entitycoll.Entity, targetUuid uuid.UUID) (entitycoll.Entity, error) {
-	return mc.getByUuid(targetUuid)
+	return mc.getByUuid(requestContext(requestor), targetUuid)
 }
 
 func (mc *messageCollection) GetCollection(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID, filter entitycoll.CollFilter) (entitycoll.Collection, error) {
 	var ec entitycoll.Collection
 	threadId, ok := parentEntityUuids["threads"]
 	if !ok {
-		return entitycoll.Collection{}, errors.New("no thread ID supplied")
+		return entitycoll.Collection{}, entities.NewError(entities.Validation, "no thread ID supplied")
 	}
 
-	count := uint64(10)
-	page := int64(0)
-	if filter.Page != nil {
-		page = *filter.Page
-	}
-	if filter.Count != nil {
-		count = *filter.Count
+	count, page, err := checkPage(filter)
+	if err != nil {
+		return entitycoll.Collection{}, err
 	}
 
-	var err error
-	ec.Entities, err = mc.getCollection(threadId, count, page)
+	ctx := requestContext(requestor)
+	ec.Entities, err = mc.getCollection(ctx, threadId, count, page)
 
 	if err != nil {
 		return entitycoll.Collection{}, err
 	}
 
-	ec.TotalEntities, err = mc.getTotal(threadId)
+	ec.TotalEntities, err = mc.getTotal(ctx, threadId)
 
 	if err != nil {
 		return entitycoll.Collection{}, err
@@ -86,21 +84,87 @@ func (mc *messageCollection) GetCollection(requestor entitycoll.Entity, parentEn
 	return ec, nil
 }
 
+func (mc *messageCollection) GetCursorCollection(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID, cursor string, count uint64) (cursorCollection, error) {
+	var cc cursorCollection
+	threadId, ok := parentEntityUuids["threads"]
+	if !ok {
+		return cursorCollection{}, entities.NewError(entities.Validation, "no thread ID supplied")
+	}
+
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return cursorCollection{}, err
+	}
+
+	var next *backend.Cursor
+	ctx := requestContext(requestor)
+	cc.Entities, next, err = mc.getCollectionAfter(ctx, threadId, after, count)
+
+	if err != nil {
+		return cursorCollection{}, err
+	}
+	cc.NextCursor = encodeCursor(next)
+
+	cc.TotalEntities, err = mc.getTotal(ctx, threadId)
+
+	if err != nil {
+		return cursorCollection{}, err
+	}
+
+	return cc, nil
+}
+
 func (mc *messageCollection) EditEntity(requestor entitycoll.Entity, targetUuid uuid.UUID, body []byte) error {
 	var edit entities.MessageEdit
 
 	err := json.Unmarshal(body, &edit)
 	if err != nil {
-		return err
+		return entities.WrapError(entities.Validation, "malformed message edit", err)
 	}
 
 	if edit.ThreadId == nil && edit.AuthorId == nil && edit.Content == nil {
 		return nil
 	}
 
-	return mc.editByUuid(targetUuid, &edit)
+	ctx := requestContext(requestor)
+	m, err := mc.getByUuid(ctx, targetUuid)
+	if err != nil {
+		return err
+	}
+	if err = authorizeOwner(requestor, m.AuthorId, "message"); err != nil {
+		return err
+	}
+	// a key limited to some threads can neither edit messages outside
+	// them nor move messages out of them
+	if err = authorizeThreadId(requestor, m.ThreadId); err != nil {
+		return err
+	}
+	if edit.ThreadId != nil {
+		if err = authorizeThreadId(requestor, *edit.ThreadId); err != nil {
+			return err
+		}
+	}
+	if edit.AuthorId != nil && !uuid.Equal(*edit.AuthorId, m.AuthorId) {
+		if err = authorizeModerator(requestor, "change the author of a message"); err != nil {
+			return err
+		}
+	}
+
+	return mc.editByUuid(ctx, targetUuid, &edit)
 }
 
 func (mc *messageCollection) DelEntity(requestor entitycoll.Entity, targetUuid uuid.UUID) error {
-	return mc.deleteByUuid(targetUuid)
+	ctx := requestContext(requestor)
+	m, err := mc.getByUuid(ctx, targetUuid)
+	if err != nil {
+		return err
+	}
+	if err = authorizeOwner(requestor, m.AuthorId, "message"); err != nil {
+		return err
+	}
+	if err = authorizeThreadId(requestor, m.ThreadId); err != nil {
+		return err
+	}
+
+	return mc.deleteByUuid(ctx, targetUuid)
 }
@@ -0,0 +1,295 @@
+// Package migrate applies numbered schema migrations to a database
+// through database/sql. Each migration is run in its own transaction
+// together with the update of the schemaVersion table, and a whole run
+// holds a lock so that instances starting at the same time cannot race
+// each other
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Migration moves the schema from Version-1 to Version (Up) and back
+// again (Down)
+type Migration struct {
+	Version int
+	Up      string
+	Down    string
+}
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)\.(up|down)\.sql$`)
+
+// Load reads the migrations in dir of fsys, named <version>.up.sql and
+// <version>.down.sql. Versions must start at 0 and have no gaps
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileRegexp.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		f, err := fsys.Open(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sqlText, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version}
+			byVersion[version] = m
+		}
+		if match[2] == "up" {
+			m.Up = string(sqlText)
+		} else {
+			m.Down = string(sqlText)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for i, m := range migrations {
+		if m.Version != i {
+			return nil, fmt.Errorf("migration %d is missing", i)
+		}
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up script", i)
+		}
+	}
+	return migrations, nil
+}
+
+// Dialect holds what differs between databases
+type Dialect struct {
+	// Lock takes an exclusive lock, held on conn for the length of a
+	// run, and Unlock releases it
+	Lock   func(ctx context.Context, conn *sql.Conn) error
+	Unlock func(ctx context.Context, conn *sql.Conn) error
+
+	// Placeholder is the marker for the first query parameter
+	Placeholder string
+
+	// Baseline, if set, finds the version of a schema that was created
+	// before its migrations were tracked, or -1 for an empty database.
+	// It is called when the schemaVersion table is first created
+	Baseline func(ctx context.Context, conn *sql.Conn) (int, error)
+}
+
+// Migrator runs Migrations against DB
+type Migrator struct {
+	DB         *sql.DB
+	Dialect    Dialect
+	Migrations []Migration
+
+	// Out, if set, is told about each migration as it is run, and is
+	// given the SQL of the migrations that a DryRun would have run
+	Out    io.Writer
+	DryRun bool
+}
+
+var ErrNothingToRollBack = errors.New("fewer migrations applied than asked to roll back")
+
+// Latest is the version the schema is at once every migration is
+// applied
+func (m *Migrator) Latest() int {
+	return len(m.Migrations) - 1
+}
+
+func (m *Migrator) logf(format string, args ...interface{}) {
+	if m.Out != nil {
+		fmt.Fprintf(m.Out, format, args...)
+	}
+}
+
+// ensureVersionTable creates the schemaVersion table if needed, a
+// schema with no migrations applied is at version -1
+func (m *Migrator) ensureVersionTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS schemaVersion (
+        schemaVersion int)`)
+	if err != nil {
+		return err
+	}
+
+	var rows int
+	err = conn.QueryRowContext(ctx, "SELECT count(*) FROM schemaVersion").Scan(&rows)
+	if err != nil || rows > 0 {
+		return err
+	}
+
+	version := -1
+	if m.Dialect.Baseline != nil {
+		if version, err = m.Dialect.Baseline(ctx, conn); err != nil {
+			return err
+		}
+	}
+
+	_, err = conn.ExecContext(ctx, "INSERT INTO schemaVersion (schemaVersion) VALUES ("+m.Dialect.Placeholder+")", version)
+	return err
+}
+
+func currentVersion(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}) (int, error) {
+	var version int
+	err := q.QueryRowContext(ctx, `
+    SELECT
+        schemaVersion
+    FROM
+        schemaVersion`).Scan(&version)
+	return version, err
+}
+
+// Version returns the version the schema is currently at
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	version, err := currentVersion(ctx, m.DB)
+	if err != nil {
+		// before the first run the table does not exist
+		return -1, nil
+	}
+	return version, nil
+}
+
+// locked runs fn holding the migration lock on a single connection.
+// Outside a DryRun the schemaVersion table is created first if needed
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn, version int) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = m.Dialect.Lock(ctx, conn); err != nil {
+		return fmt.Errorf("taking migration lock: %s", err)
+	}
+	defer m.Dialect.Unlock(context.Background(), conn)
+
+	version := -1
+	if m.DryRun {
+		if v, err := currentVersion(ctx, conn); err == nil {
+			version = v
+		}
+	} else {
+		if err = m.ensureVersionTable(ctx, conn); err != nil {
+			return err
+		}
+		if version, err = currentVersion(ctx, conn); err != nil {
+			return err
+		}
+	}
+
+	if version > m.Latest() {
+		return fmt.Errorf("schema is at version %d, newer than the latest known migration %d", version, m.Latest())
+	}
+
+	return fn(conn, version)
+}
+
+// run executes script and records version as the schema version, in
+// one transaction
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, script string, version int) error {
+	if m.DryRun {
+		m.logf("%s\n", script)
+		return nil
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE schemaVersion SET schemaVersion = "+m.Dialect.Placeholder, version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Up applies every migration that has not been applied yet
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.locked(ctx, func(conn *sql.Conn, version int) error {
+		for _, migration := range m.Migrations[version+1:] {
+			m.logf("-- applying migration %d\n", migration.Version)
+			if err := m.run(ctx, conn, migration.Up, migration.Version); err != nil {
+				return fmt.Errorf("applying migration %d: %s", migration.Version, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Down rolls back the last steps migrations that were applied, if
+// fewer than steps were applied nothing is rolled back
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.locked(ctx, func(conn *sql.Conn, version int) error {
+		if steps > version+1 {
+			return ErrNothingToRollBack
+		}
+
+		for i := 0; i < steps; i++ {
+			migration := m.Migrations[version]
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d cannot be rolled back", migration.Version)
+			}
+
+			m.logf("-- rolling back migration %d\n", migration.Version)
+			if err := m.run(ctx, conn, migration.Down, version-1); err != nil {
+				return fmt.Errorf("rolling back migration %d: %s", migration.Version, err)
+			}
+			version -= 1
+		}
+		return nil
+	})
+}
+
+// Status writes the current version of the schema, and whether each
+// migration has been applied, to w
+func (m *Migrator) Status(ctx context.Context, w io.Writer) error {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "schema version %d, latest %d\n", version, m.Latest())
+	for _, migration := range m.Migrations {
+		state := "pending"
+		if migration.Version <= version {
+			state = "applied"
+		}
+		fmt.Fprintf(w, "%4d %s\n", migration.Version, state)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/john-sharp/jerver/entities"
+	"gitlab.com/johncolinsharp/entitycoll"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// defaultPageCount is the count of a page of a collection when none is
+// asked for
+const defaultPageCount = 10
+
+// checkPage reads the count and page of filter, defaulting them to
+// defaultPageCount and the first page. count must be 1 to the
+// MaxPageCount setting, and page neither negative nor so large that
+// the offset of the page overflows
+func checkPage(filter entitycoll.CollFilter) (uint64, int64, error) {
+	count := uint64(defaultPageCount)
+	page := int64(0)
+	if filter.Count != nil {
+		count = *filter.Count
+	}
+	if filter.Page != nil {
+		page = *filter.Page
+	}
+
+	if count < 1 || count > uint64(conf.MaxPageCount) {
+		return 0, 0, entities.NewError(entities.Validation, fmt.Sprintf("count must be 1 to %d", conf.MaxPageCount))
+	}
+	if page < 0 {
+		return 0, 0, entities.NewError(entities.Validation, "page must not be negative")
+	}
+	if page > math.MaxInt64/int64(count) {
+		return 0, 0, entities.NewError(entities.Validation, "page is too large")
+	}
+	return count, page, nil
+}
+
+// queryFilter reads the count and page query parameters of a request
+// to one of jerver's own handlers, as entitycoll reads them for the
+// collections
+func queryFilter(query url.Values) (entitycoll.CollFilter, error) {
+	var filter entitycoll.CollFilter
+	if c := query.Get("count"); c != "" {
+		count, err := strconv.ParseUint(c, 10, 64)
+		if err != nil {
+			return filter, entities.NewError(entities.Validation, "malformed count")
+		}
+		filter.Count = &count
+	}
+	if p := query.Get("page"); p != "" {
+		page, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return filter, entities.NewError(entities.Validation, "malformed page")
+		}
+		filter.Page = &page
+	}
+	return filter, nil
+}
+
+// serveRead serves a GET that one of jerver's own handlers reads rather
+// than entitycoll, allowing it cross-origin and authenticating the
+// requestor. read is given the requestor, whom it authorizes itself,
+// and the page asked for, checked by checkPage. What it returns is
+// written as JSON
+func serveRead(w http.ResponseWriter, r *http.Request, read func(requestor entitycoll.Entity, count uint64, page int64) (interface{}, error)) {
+	w.Header().Add("Access-Control-Allow-Origin", conf.AllowOrigin)
+	requestor, err := authenticateRequest(r)
+	if err != nil {
+		w.Header().Add("WWW-Authenticate", "Basic realm=\"a\"")
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+
+	var count uint64
+	var page int64
+	filter, err := queryFilter(r.URL.Query())
+	if err == nil {
+		count, page, err = checkPage(filter)
+	}
+	var v interface{}
+	if err == nil {
+		v, err = read(requestor, count, page)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"gitlab.com/johncolinsharp/entitycoll"
+	"math"
+	"testing"
+)
+
+func TestCheckPage(t *testing.T) {
+	conf = defaultConfig
+	conf.MaxPageCount = 100
+	u := func(v uint64) *uint64 { return &v }
+	i := func(v int64) *int64 { return &v }
+	tests := []struct {
+		name   string
+		filter entitycoll.CollFilter
+		count  uint64
+		page   int64
+		ok     bool
+	}{
+		{"defaults", entitycoll.CollFilter{}, defaultPageCount, 0, true},
+		{"given", entitycoll.CollFilter{Count: u(25), Page: i(3)}, 25, 3, true},
+		{"max count", entitycoll.CollFilter{Count: u(100)}, 100, 0, true},
+		{"zero count", entitycoll.CollFilter{Count: u(0)}, 0, 0, false},
+		{"count over max", entitycoll.CollFilter{Count: u(101)}, 0, 0, false},
+		{"huge count", entitycoll.CollFilter{Count: u(math.MaxUint64)}, 0, 0, false},
+		{"negative page", entitycoll.CollFilter{Page: i(-1)}, 0, 0, false},
+		{"last page", entitycoll.CollFilter{Count: u(1), Page: i(math.MaxInt64)}, 1, math.MaxInt64, true},
+		{"offset overflows", entitycoll.CollFilter{Count: u(2), Page: i(math.MaxInt64/2 + 1)}, 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			count, page, err := checkPage(test.filter)
+			if test.ok != (err == nil) {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+			if test.ok && (count != test.count || page != test.page) {
+				t.Fatalf("got count %d page %d, want count %d page %d", count, page, test.count, test.page)
+			}
+		})
+	}
+}
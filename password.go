@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/john-sharp/jerver/mail"
+	"github.com/satori/go.uuid"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// mailer sends password reset tokens, set by main from the MailSender
+// setting
+var mailer mail.Sender
+
+// mailSenders maps the names accepted by the MailSender setting to the
+// function making that sender
+var mailSenders = map[string]func(c *serverConfig) mail.Sender{
+	"log": func(c *serverConfig) mail.Sender { return mail.LogSender{} },
+	"file": func(c *serverConfig) mail.Sender {
+		return &mail.FileSender{Path: c.MailFile}
+	},
+	"smtp": func(c *serverConfig) mail.Sender {
+		return mail.SMTPSender{Addr: c.SmtpAddr, Username: c.SmtpUsername, Password: c.SmtpPassword, From: c.MailFrom}
+	},
+}
+
+// passwordResetMail is the payload of jobPasswordResetMail jobs. It
+// holds no token, so that none is kept in the job queue
+type passwordResetMail struct {
+	ResetId string
+	UserId  uuid.UUID
+}
+
+// sendPasswordResetMailJob runs the jobPasswordResetMail jobs, mailing
+// the user a new token for the reset, which replaces the reset's old
+// one. The payload is updated to the new token's reset id, for if the
+// mail has to be sent again. Resets used, revoked or expired meanwhile
+// are not mailed
+func sendPasswordResetMailJob(ctx context.Context, j *entities.Job) error {
+	var p passwordResetMail
+	if err := json.Unmarshal([]byte(j.Payload), &p); err != nil {
+		return err
+	}
+
+	u, err := users.getUserByUuid(ctx, p.UserId)
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if u.Email == "" {
+		return nil
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	r, err := users.replacePasswordReset(ctx, p.ResetId, tokenId(token))
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !time.Now().Before(r.Expires) {
+		return nil
+	}
+
+	p.ResetId = r.Id
+	b, _ := json.Marshal(p)
+	j.Payload = string(b)
+	if err = jobs.update(ctx, j); err != nil {
+		return err
+	}
+
+	link := conf.PasswordResetURL + "?token=" + url.QueryEscape(token)
+	return mailer.Send(ctx, mail.Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("A password reset was requested for %s. To choose a new password go to\n\n%s\n\n"+
+			"The link can be used once, until %s. If you did not ask for this you can ignore it.\n",
+			u.Username, link, r.Expires.Format(time.RFC1123)),
+	})
+}
+
+// password reset requests allowed for an account before further ones
+// are throttled, so that the endpoint cannot be used to flood a user
+// with mail
+const resetFreeRequests = 3
+
+func resetKey(uname string) string {
+	return "reset:" + accountKey(uname)
+}
+
+// changePassword sets a new password for u, which must give its old
+// one. Every session of u is revoked and a new one returned for the
+// client making the change
+func (uc *userCollection) changePassword(ctx context.Context, u *user, oldPwd, newPwd, remoteAddr string) (*tokenResponse, error) {
+	if _, err := uc.verifyUser(ctx, u.Username, oldPwd, remoteAddr); err != nil {
+		return nil, err
+	}
+	if err := validatePassword(u.Username, newPwd); err != nil {
+		return nil, err
+	}
+
+	hpwd, err := hashPassword(newPwd)
+	if err != nil {
+		return nil, err
+	}
+	if err = uc.setUserPassword(ctx, u.Uuid, hpwd); err != nil {
+		return nil, err
+	}
+	uc.securityEvent(ctx, "password_changed", u.Username, remoteAddr, time.Now())
+
+	// reread for the TokenGeneration setting the password bumped
+	changed, err := uc.getUserByUuid(ctx, u.Uuid)
+	if err != nil {
+		return nil, err
+	}
+	return uc.issueTokens(ctx, (*user)(changed))
+}
+
+// requestPasswordReset mails a reset token to the user uname. Nothing
+// is returned to say whether uname exists or has an email address,
+// only errors that would happen for any username
+func (uc *userCollection) requestPasswordReset(ctx context.Context, uname, remoteAddr string) error {
+	now := time.Now()
+	if wait := throttle.wait(resetKey(uname), now); wait > 0 {
+		return entities.NewError(entities.RateLimited,
+			fmt.Sprintf("too many password reset requests, try again in %s", wait.Round(time.Second)))
+	}
+	throttle.fail(resetKey(uname), resetFreeRequests, now)
+
+	u, err := uc.getUserByUsername(ctx, uname)
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	uc.securityEvent(ctx, "password_reset_requested", uname, remoteAddr, now)
+	if u.Email == "" || u.Service {
+		return nil
+	}
+
+	// the token is never sent, the job mailing the reset replacing it
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	r := entities.PasswordReset{
+		Id:      tokenId(token),
+		UserId:  u.Uuid,
+		Created: now.UTC(),
+		Expires: now.UTC().Add(time.Duration(conf.PasswordResetTTL)),
+	}
+	if err = uc.createPasswordReset(ctx, &r); err != nil {
+		return err
+	}
+
+	// sent by a job so that responses take no longer for users with an
+	// email address than for those without, and so that it is retried
+	return enqueueJob(ctx, jobPasswordResetMail, passwordResetMail{ResetId: r.Id, UserId: u.Uuid}, time.Time{})
+}
+
+var errBadResetToken = entities.NewError(entities.Unauthorized, "invalid or expired password reset token")
+
+// resetPassword sets a new password for the user a reset token was
+// sent to, using up the token and revoking every session of the user
+func (uc *userCollection) resetPassword(ctx context.Context, token, newPwd, remoteAddr string) error {
+	// checked before the token is used up, the username is checked
+	// against once the token shows whose it is
+	if err := validatePassword("", newPwd); err != nil {
+		return err
+	}
+
+	r, err := uc.takePasswordReset(ctx, tokenId(token))
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+		return errBadResetToken
+	}
+	if err != nil {
+		return err
+	}
+	if !time.Now().Before(r.Expires) {
+		return errBadResetToken
+	}
+
+	u, err := uc.getUserByUuid(ctx, r.UserId)
+	if err != nil {
+		return err
+	}
+	if err = validatePassword(u.Username, newPwd); err != nil {
+		// the token was not really used, so let it be tried again
+		if putErr := uc.createPasswordReset(ctx, r); putErr != nil {
+			log.Printf("restoring password reset: %s", putErr)
+		}
+		return err
+	}
+
+	hpwd, err := hashPassword(newPwd)
+	if err != nil {
+		return err
+	}
+	if err = uc.setUserPassword(ctx, u.Uuid, hpwd); err != nil {
+		return err
+	}
+	// whoever can reset the password may log in again straight away
+	throttle.succeed(accountKey(u.Username))
+	uc.securityEvent(ctx, "password_reset", u.Username, remoteAddr, time.Now())
+	return nil
+}
+
+// readJSON decodes the JSON body of r into v
+func readJSON(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<16)).Decode(v); err != nil {
+		return entities.WrapError(entities.Validation, "malformed request body", err)
+	}
+	return nil
+}
+
+// allowPost answers CORS preflight requests and rejects anything but a
+// POST, reporting whether the handler should carry on
+func allowPost(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Access-Control-Allow-Origin", conf.AllowOrigin)
+	if r.Method == "OPTIONS" {
+		w.Header().Add("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Add("Access-Control-Allow-Methods", "POST")
+		return false
+	}
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// passwordHandler serves POSTs to /password, by which a logged in user
+// changes their password. The response has new tokens, as those the
+// user had are revoked
+func passwordHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+
+	requestor, err := authenticateRequest(r)
+	if err != nil {
+		w.Header().Add("WWW-Authenticate", "Basic realm=\"a\"")
+		writeError(w, entities.WrapError(entities.Unauthorized, "not logged in", err))
+		return
+	}
+
+	var body struct {
+		OldPassword string
+		NewPassword string
+	}
+	if err = readJSON(r, &body); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	u, ok := withoutContext(requestor).(*user)
+	if !ok {
+		writeError(w, entities.NewError(entities.Forbidden, "API keys cannot change passwords"))
+		return
+	}
+
+	tokens, err := users.changePassword(r.Context(), u, body.OldPassword, body.NewPassword, remoteAddr(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// passwordResetHandler serves POSTs to /password/reset, mailing a reset
+// token to the user named in the body. It is accepted whether or not
+// the user exists
+func passwordResetHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+
+	var body struct {
+		Username string
+	}
+	if err := readJSON(r, &body); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := users.requestPasswordReset(r.Context(), body.Username, remoteAddr(r)); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// passwordResetConfirmHandler serves POSTs to /password/reset/confirm,
+// setting a new password with a reset token
+func passwordResetConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+
+	var body struct {
+		Token       string
+		NewPassword string
+	}
+	if err := readJSON(r, &body); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := users.resetPassword(r.Context(), body.Token, body.NewPassword, remoteAddr(r)); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,213 +1,550 @@
 package dbbackend
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"github.com/john-sharp/jerver/backend"
 	"github.com/john-sharp/jerver/entities"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/satori/go.uuid"
-	"log"
 	"strings"
+	"time"
 )
 
-var db *sql.DB
-var getMessageStmt *sql.Stmt
-var createMessageStmt *sql.Stmt
-var deleteMessageStmt *sql.Stmt
-var getThreadStmt *sql.Stmt
-var createThreadStmt *sql.Stmt
-var deleteThreadStmt *sql.Stmt
-var editThreadStmt *sql.Stmt
-var getUserByUnameStmt *sql.Stmt
-var getUserByUuidStmt *sql.Stmt
-
-func init() {
+// Backend implements backend.Backend on top of a postgres database
+type Backend struct {
+	db                 *sql.DB
+	getMessageStmt     *sql.Stmt
+	createMessageStmt  *sql.Stmt
+	deleteMessageStmt  *sql.Stmt
+	getThreadStmt      *sql.Stmt
+	createThreadStmt   *sql.Stmt
+	deleteThreadStmt   *sql.Stmt
+	editThreadStmt     *sql.Stmt
+	addThreadMsgStmt   *sql.Stmt
+	dropThreadMsgStmt  *sql.Stmt
+	getUserByUnameStmt *sql.Stmt
+	getUserByUuidStmt  *sql.Stmt
+	createUserStmt     *sql.Stmt
+	approveUserStmt    *sql.Stmt
+	setUserRoleStmt    *sql.Stmt
+	setUserPwdStmt     *sql.Stmt
+	upgradeUserPwdStmt *sql.Stmt
+	createInviteStmt   *sql.Stmt
+	redeemInviteStmt   *sql.Stmt
+	createSessionStmt  *sql.Stmt
+	takeSessionStmt    *sql.Stmt
+	createResetStmt    *sql.Stmt
+	takeResetStmt      *sql.Stmt
+	getApiKeyStmt      *sql.Stmt
+	listener           *pq.Listener
+	bus                *backend.Bus
+}
+
+// Open connects to the database named by config.DataSource and
+// prepares the statements used by the Backend. Any failure is returned
+// rather than being fatal so that the caller can retry
+func Open(config backend.Config) (backend.Backend, error) {
 	var err error
+	b := &Backend{bus: backend.NewBus()}
+
+	b.db, err = sql.Open("postgres", config.DataSource)
+	if err != nil {
+		b.bus.Close()
+		return nil, err
+	}
+
+	err = b.db.Ping()
+	if err == nil && config.Migrate {
+		err = b.migrate()
+	}
+	if err == nil {
+		err = b.messagePrepareStmts()
+	}
+	if err == nil {
+		err = b.threadPrepareStmts()
+	}
+	if err == nil {
+		err = b.userPrepareStatements()
+	}
+	if err == nil {
+		err = b.sessionPrepareStmts()
+	}
+	if err == nil {
+		err = b.listen(config.DataSource)
+	}
+
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
 
-	connStr := "user=jerver dbname=jerver sslmode=disable"
-	db, err = sql.Open("postgres", connStr)
+// migrate applies any migrations the schema is missing
+func (b *Backend) migrate() error {
+	m, err := newMigrator(b.db)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	return m.Up(context.Background())
+}
+
+func (b *Backend) Ping(ctx context.Context) error {
+	return b.db.PingContext(ctx)
+}
+
+// Close closes any statements that were prepared and then the
+// database handle itself
+func (b *Backend) Close() error {
+	stmts := []*sql.Stmt{
+		b.getMessageStmt,
+		b.createMessageStmt,
+		b.deleteMessageStmt,
+		b.getThreadStmt,
+		b.createThreadStmt,
+		b.deleteThreadStmt,
+		b.editThreadStmt,
+		b.addThreadMsgStmt,
+		b.dropThreadMsgStmt,
+		b.getUserByUnameStmt,
+		b.getUserByUuidStmt,
+		b.createUserStmt,
+		b.approveUserStmt,
+		b.setUserRoleStmt,
+		b.setUserPwdStmt,
+		b.upgradeUserPwdStmt,
+		b.createInviteStmt,
+		b.redeemInviteStmt,
+		b.createSessionStmt,
+		b.takeSessionStmt,
+		b.createResetStmt,
+		b.takeResetStmt,
+		b.getApiKeyStmt,
+	}
+	for _, stmt := range stmts {
+		if stmt != nil {
+			stmt.Close()
+		}
 	}
 
-	messagePrepareStmts()
-	threadPrepareStmts()
-	userPrepareStatements()
+	if b.listener != nil {
+		b.listener.Close()
+	}
+	b.bus.Close()
+	return b.db.Close()
 }
 
-func messagePrepareStmts() {
+func (b *Backend) messagePrepareStmts() error {
 	var err error
-	getMessageStmt, err = db.Prepare(`
+	b.getMessageStmt, err = b.db.Prepare(`
 	SELECT
 	     Uuid,
 	     ThreadId,
 	     AuthorId,
-	     Content
+	     Content,
+	     Created
 	FROM messages
 	WHERE Uuid = $1`)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	createMessageStmt, err = db.Prepare(`
+	b.createMessageStmt, err = b.db.Prepare(`
     INSERT INTO messages (
         Uuid,
         ThreadId,
         AuthorId,
-        Content)
-    VALUES ($1, $2, $3, $4)`)
+        Content,
+        Created)
+    VALUES ($1, $2, $3, $4, $5)`)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	deleteMessageStmt, err = db.Prepare(`
+	b.deleteMessageStmt, err = b.db.Prepare(`
     DELETE FROM messages
     WHERE Uuid = $1
     `)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+
+	return nil
 }
 
-func threadPrepareStmts() {
+func (b *Backend) threadPrepareStmts() error {
 	var err error
 
-	getThreadStmt, err = db.Prepare(`
+	b.getThreadStmt, err = b.db.Prepare(`
     SELECT 
          Uuid,
-         Title
+         Title,
+         NumMsgs,
+         LastMsgTime,
+         Created
     FROM threads 
     WHERE Uuid = $1`)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	createThreadStmt, err = db.Prepare(`
+	b.createThreadStmt, err = b.db.Prepare(`
     INSERT INTO threads (
         Uuid,
-        Title )
-    VALUES ($1, $2)`)
+        Title,
+        Created )
+    VALUES ($1, $2, $3)`)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	editThreadStmt, err = db.Prepare(`
+	b.editThreadStmt, err = b.db.Prepare(`
     UPDATE threads SET Title=$1
     WHERE Uuid = $2
     `)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	// NumMsgs and LastMsgTime are kept up to date as messages are
+	// added to and dropped from a thread, these are always run in the
+	// same transaction as the change to messages
+	b.addThreadMsgStmt, err = b.db.Prepare(`
+    UPDATE threads SET
+        NumMsgs = NumMsgs + 1,
+        LastMsgTime = GREATEST(LastMsgTime, $2)
+    WHERE Uuid = $1
+    `)
+
+	if err != nil {
+		return err
+	}
+
+	b.dropThreadMsgStmt, err = b.db.Prepare(`
+    UPDATE threads SET
+        NumMsgs = NumMsgs - 1,
+        LastMsgTime = (SELECT max(Created) FROM messages WHERE ThreadId = $1)
+    WHERE Uuid = $1
+    `)
+
+	if err != nil {
+		return err
 	}
 
-	deleteThreadStmt, err = db.Prepare(`
+	b.deleteThreadStmt, err = b.db.Prepare(`
     DELETE FROM threads
-    WHERE Uuid = $3
+    WHERE Uuid = $1
     `)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+
+	return nil
 }
 
-func userPrepareStatements() {
+func (b *Backend) userPrepareStatements() error {
 	var err error
-	getUserByUnameStmt, err = db.Prepare(`
+	b.getUserByUnameStmt, err = b.db.Prepare(`
     SELECT 
          Uuid,
          FirstName,
          SecondName,
          Username,
-         HashedPwd
+         HashedPwd,
+         Approved,
+         Role,
+         Email,
+         DisplayName,
+         Bio,
+         Service,
+         TokenGeneration
     FROM users 
-    WHERE Username = $1`)
+    WHERE lower(Username) = lower($1)`)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	getUserByUuidStmt, err = db.Prepare(`
+	b.getUserByUuidStmt, err = b.db.Prepare(`
     SELECT 
          Uuid,
          FirstName,
          SecondName,
          Username,
-         HashedPwd
+         HashedPwd,
+         Approved,
+         Role,
+         Email,
+         DisplayName,
+         Bio,
+         Service,
+         TokenGeneration
     FROM users 
     WHERE Uuid = $1`)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	b.createUserStmt, err = b.db.Prepare(`
+    INSERT INTO users (
+        Uuid,
+        FirstName,
+        SecondName,
+        Username,
+        HashedPwd,
+        Approved,
+        Role,
+        Email,
+        Service)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`)
+
+	if err != nil {
+		return err
 	}
+
+	b.approveUserStmt, err = b.db.Prepare(`
+    UPDATE users SET
+        Approved = true
+    WHERE lower(Username) = lower($1)`)
+
+	if err != nil {
+		return err
+	}
+
+	b.setUserRoleStmt, err = b.db.Prepare(`
+    UPDATE users SET
+        Role = $1
+    WHERE Uuid = $2`)
+
+	if err != nil {
+		return err
+	}
+
+	b.setUserPwdStmt, err = b.db.Prepare(`
+    UPDATE users SET
+        HashedPwd = $1,
+        TokenGeneration = TokenGeneration + 1
+    WHERE Uuid = $2`)
+
+	if err != nil {
+		return err
+	}
+
+	b.upgradeUserPwdStmt, err = b.db.Prepare(`
+    UPDATE users SET
+        HashedPwd = $1
+    WHERE Uuid = $2 AND HashedPwd = $3`)
+
+	if err != nil {
+		return err
+	}
+
+	b.createInviteStmt, err = b.db.Prepare(`
+    INSERT INTO invites (
+        Code,
+        Created)
+    VALUES ($1, $2)`)
+
+	if err != nil {
+		return err
+	}
+
+	b.redeemInviteStmt, err = b.db.Prepare(`
+    UPDATE invites SET
+        UsedBy = $1
+    WHERE Code = $2 AND UsedBy IS NULL`)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
-func GetMessageByUuid(targetUuid uuid.UUID) (*entities.Message, error) {
+func (b *Backend) GetMessageByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.Message, error) {
 	var m entities.Message
-	err := getMessageStmt.QueryRow(targetUuid).Scan(&m.Id, &m.ThreadId, &m.AuthorId, &m.Content)
+	err := b.getMessageStmt.QueryRowContext(ctx, targetUuid).Scan(&m.Id, &m.ThreadId, &m.AuthorId, &m.Content, &m.Created)
 
 	if err != nil {
-		return nil, err
+		return nil, translateError(err, "message")
 	}
 	return &m, nil
 }
 
-func CreateMessage(m *entities.Message) error {
-	_, err := createMessageStmt.Exec(
+func (b *Backend) CreateMessage(ctx context.Context, m *entities.Message) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err, "message")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.StmtContext(ctx, b.createMessageStmt).ExecContext(ctx,
 		m.Id,
 		m.ThreadId,
 		m.AuthorId,
-		m.Content)
+		m.Content,
+		m.Created)
+
+	if err != nil {
+		return translateError(err, "message")
+	}
+
+	res, err := tx.StmtContext(ctx, b.addThreadMsgStmt).ExecContext(ctx, m.ThreadId, m.Created)
+	if err != nil {
+		return translateError(err, "message")
+	}
+	if err = checkAffected(res, "thread"); err != nil {
+		return entities.WrapError(entities.Validation, "message refers to a thread that does not exist", err)
+	}
+
+	err = notify(ctx, tx, backend.Event{Type: backend.MessageCreated, ThreadId: m.ThreadId, MessageId: m.Id})
+	if err != nil {
+		return translateError(err, "message")
+	}
 
-	return err
+	return translateError(tx.Commit(), "message")
 }
 
-func DeleteMessageByUuid(targetUuid uuid.UUID) error {
-	_, err := deleteMessageStmt.Exec(targetUuid)
-	return err
+func (b *Backend) DeleteMessageByUuid(ctx context.Context, targetUuid uuid.UUID) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err, "message")
+	}
+	defer tx.Rollback()
+
+	var threadId uuid.UUID
+	err = tx.QueryRowContext(ctx, `
+    SELECT ThreadId FROM messages
+    WHERE Uuid = $1
+    FOR UPDATE
+    `, targetUuid).Scan(&threadId)
+
+	if err != nil {
+		return translateError(err, "message")
+	}
+
+	_, err = tx.StmtContext(ctx, b.deleteMessageStmt).ExecContext(ctx, targetUuid)
+	if err != nil {
+		return translateError(err, "message")
+	}
+
+	_, err = tx.StmtContext(ctx, b.dropThreadMsgStmt).ExecContext(ctx, threadId)
+	if err != nil {
+		return translateError(err, "message")
+	}
+
+	err = notify(ctx, tx, backend.Event{Type: backend.MessageDeleted, ThreadId: threadId, MessageId: targetUuid})
+	if err != nil {
+		return translateError(err, "message")
+	}
+
+	return translateError(tx.Commit(), "message")
 }
 
-func GetMessageCollection(threadId uuid.UUID, count uint64, page int64, appendToCollection func(entities.Message)) error {
+func (b *Backend) GetMessageCollection(ctx context.Context, threadId uuid.UUID, count uint64, page int64, appendToCollection func(entities.Message)) error {
 	offset := page * int64(count)
 
 	// TODO put in filtering
-	rows, err := db.Query(`
+	rows, err := b.db.QueryContext(ctx, `
     SELECT
          Uuid,
          ThreadId,
          AuthorId,
-         Content
+         Content,
+         Created
     FROM
         messages
     WHERE ThreadId = $1
-    LIMIT $2, $3
-    `, threadId.Bytes(), offset, count)
+    ORDER BY Created, Uuid
+    LIMIT $2 OFFSET $3
+    `, threadId, count, offset)
 
 	if err != nil {
-		return err
+		return translateError(err, "message")
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var m entities.Message
-		err = rows.Scan(&m.Id, &m.ThreadId, &m.AuthorId, &m.Content)
+		err = rows.Scan(&m.Id, &m.ThreadId, &m.AuthorId, &m.Content, &m.Created)
 		if err != nil {
-			return err
+			return translateError(err, "message")
 		}
 		appendToCollection(m)
 	}
 	err = rows.Err()
-	return err
+	return translateError(err, "message")
 }
 
-func GetMessageTotal(threadId uuid.UUID) (uint, error) {
+// GetMessageCollectionAfter reads the messages of the thread in
+// (Created, Uuid) order starting after the cursor, which is nil to
+// start from the beginning
+func (b *Backend) GetMessageCollectionAfter(ctx context.Context, threadId uuid.UUID, after *backend.Cursor, count uint64, appendToCollection func(entities.Message)) error {
+	var rows *sql.Rows
+	var err error
+
+	if after == nil {
+		rows, err = b.db.QueryContext(ctx, `
+    SELECT
+         Uuid,
+         ThreadId,
+         AuthorId,
+         Content,
+         Created
+    FROM
+        messages
+    WHERE ThreadId = $1
+    ORDER BY Created, Uuid
+    LIMIT $2
+    `, threadId, count)
+	} else {
+		rows, err = b.db.QueryContext(ctx, `
+    SELECT
+         Uuid,
+         ThreadId,
+         AuthorId,
+         Content,
+         Created
+    FROM
+        messages
+    WHERE ThreadId = $1
+    AND (Created, Uuid) > ($2, $3)
+    ORDER BY Created, Uuid
+    LIMIT $4
+    `, threadId, after.Created, after.Id, count)
+	}
+
+	if err != nil {
+		return translateError(err, "message")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m entities.Message
+		err = rows.Scan(&m.Id, &m.ThreadId, &m.AuthorId, &m.Content, &m.Created)
+		if err != nil {
+			return translateError(err, "message")
+		}
+		appendToCollection(m)
+	}
+	err = rows.Err()
+	return translateError(err, "message")
+}
+
+func (b *Backend) GetMessageTotal(ctx context.Context, threadId uuid.UUID) (uint, error) {
 	ret := uint(0)
 
 	// TODO also need to put filtering in here
-	err := db.QueryRow(`
+	err := b.db.QueryRowContext(ctx, `
     SELECT
         count(*) 
     FROM
@@ -215,10 +552,10 @@ func GetMessageTotal(threadId uuid.UUID) (uint, error) {
     WHERE ThreadId = $1
     `, threadId).Scan(&ret)
 
-	return ret, err
+	return ret, translateError(err, "message")
 }
 
-func EditMessageByUuid(targetUuid uuid.UUID, m *entities.MessageEdit) error {
+func (b *Backend) EditMessageByUuid(ctx context.Context, targetUuid uuid.UUID, m *entities.MessageEdit) error {
 	// TODO cache prepared update statements based on the
 	// 'mask' of set fields
 	// TODO can use reflect to loop through the fields of
@@ -230,13 +567,13 @@ func EditMessageByUuid(targetUuid uuid.UUID, m *entities.MessageEdit) error {
 	if m.ThreadId != nil {
 		updateFieldSql = append(updateFieldSql, fmt.Sprintf("ThreadId = $%d", paramIndex))
 		paramIndex += 1
-		params = append(params, m.ThreadId.Bytes())
+		params = append(params, *m.ThreadId)
 	}
 
 	if m.AuthorId != nil {
 		updateFieldSql = append(updateFieldSql, fmt.Sprintf("AuthorId = $%d", paramIndex))
 		paramIndex += 1
-		params = append(params, m.AuthorId.Bytes())
+		params = append(params, *m.AuthorId)
 	}
 
 	if m.Content != nil {
@@ -247,110 +584,985 @@ func EditMessageByUuid(targetUuid uuid.UUID, m *entities.MessageEdit) error {
 	query += strings.Join(updateFieldSql, ", ")
 	query += fmt.Sprintf(" WHERE Uuid = $%d", paramIndex)
 	paramIndex += 1
-	params = append(params, targetUuid.Bytes())
+	params = append(params, targetUuid)
 
-	stmt, err := db.Prepare(query)
+	tx, err := b.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return translateError(err, "message")
+	}
+	defer tx.Rollback()
+
+	// moving the message to another thread changes the message
+	// counts of both threads
+	var oldThreadId uuid.UUID
+	var created time.Time
+	err = tx.QueryRowContext(ctx, `
+    SELECT ThreadId, Created FROM messages
+    WHERE Uuid = $1
+    FOR UPDATE
+    `, targetUuid).Scan(&oldThreadId, &created)
+
+	if err != nil {
+		return translateError(err, "message")
+	}
+
+	_, err = tx.ExecContext(ctx, query, params...)
+	if err != nil {
+		return translateError(err, "message")
+	}
+
+	if m.ThreadId != nil && !uuid.Equal(*m.ThreadId, oldThreadId) {
+		_, err = tx.StmtContext(ctx, b.dropThreadMsgStmt).ExecContext(ctx, oldThreadId)
+		if err != nil {
+			return translateError(err, "message")
+		}
+
+		res, err := tx.StmtContext(ctx, b.addThreadMsgStmt).ExecContext(ctx, *m.ThreadId, created)
+		if err != nil {
+			return translateError(err, "message")
+		}
+		if err = checkAffected(res, "thread"); err != nil {
+			return entities.WrapError(entities.Validation, "message refers to a thread that does not exist", err)
+		}
+	}
+
+	err = notify(ctx, tx, backend.MessageEditedEvent(targetUuid, oldThreadId, m.ThreadId))
+	if err != nil {
+		return translateError(err, "message")
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec(params...)
 
-	return err
+	return translateError(tx.Commit(), "message")
 }
 
-func GetThreadByUuid(targetUuid uuid.UUID) (*entities.Thread, error) {
+func (b *Backend) GetThreadByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.Thread, error) {
 	var t entities.Thread
-	err := getThreadStmt.QueryRow(targetUuid).Scan(&t.Id, &t.Title)
+	err := b.getThreadStmt.QueryRowContext(ctx, targetUuid).Scan(&t.Id, &t.Title, &t.NumMsgs, &t.LastMsgTime, &t.Created)
 
 	if err != nil {
-		return nil, err
+		return nil, translateError(err, "thread")
 	}
 
 	return &t, nil
 }
 
-func CreateThread(t *entities.Thread) error {
-	_, err := createThreadStmt.Exec(t.Id, t.Title)
+func (b *Backend) CreateThread(ctx context.Context, t *entities.Thread) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err, "thread")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.StmtContext(ctx, b.createThreadStmt).ExecContext(ctx, t.Id, t.Title, t.Created)
+	if err != nil {
+		return translateError(err, "thread")
+	}
+
+	err = notify(ctx, tx, backend.Event{Type: backend.ThreadCreated, ThreadId: t.Id})
+	if err != nil {
+		return translateError(err, "thread")
+	}
 
-	return err
+	return translateError(tx.Commit(), "thread")
 }
 
-func DeleteThreadByUuid(targetUuid uuid.UUID) error {
-	_, err := deleteThreadStmt.Exec(targetUuid)
-	return err
+func (b *Backend) DeleteThreadByUuid(ctx context.Context, targetUuid uuid.UUID) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err, "thread")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.StmtContext(ctx, b.deleteThreadStmt).ExecContext(ctx, targetUuid)
+	if err != nil {
+		return translateError(err, "thread")
+	}
+	if err = checkAffected(res, "thread"); err != nil {
+		return err
+	}
+
+	err = notify(ctx, tx, backend.Event{Type: backend.ThreadDeleted, ThreadId: targetUuid})
+	if err != nil {
+		return translateError(err, "thread")
+	}
+
+	return translateError(tx.Commit(), "thread")
 }
 
-func GetThreadCollection(count uint64, page int64, appendToCollection func(entities.Thread)) error {
+func (b *Backend) GetThreadCollection(ctx context.Context, count uint64, page int64, appendToCollection func(entities.Thread)) error {
 	offset := page * int64(count)
 
 	// TODO put in filtering
-	rows, err := db.Query(`
+	rows, err := b.db.QueryContext(ctx, `
     SELECT
         Uuid,
-        Title
+        Title,
+        NumMsgs,
+        LastMsgTime,
+        Created
     FROM
         threads
-    LIMIT $1, $2
-    `, offset, count)
+    ORDER BY Created, Uuid
+    LIMIT $1 OFFSET $2
+    `, count, offset)
 	if err != nil {
-		return err
+		return translateError(err, "thread")
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var t entities.Thread
-		err = rows.Scan(&t.Id, &t.Title)
+		err = rows.Scan(&t.Id, &t.Title, &t.NumMsgs, &t.LastMsgTime, &t.Created)
 		if err != nil {
-			log.Fatal(err)
+			return translateError(err, "thread")
 		}
 		appendToCollection(t)
 	}
 	err = rows.Err()
 	if err != nil {
-		return err
+		return translateError(err, "thread")
+	}
+
+	err = rows.Err()
+	return translateError(err, "thread")
+}
+
+// GetThreadCollectionAfter reads threads in (Created, Uuid) order
+// starting after the cursor, which is nil to start from the beginning
+func (b *Backend) GetThreadCollectionAfter(ctx context.Context, after *backend.Cursor, count uint64, appendToCollection func(entities.Thread)) error {
+	var rows *sql.Rows
+	var err error
+
+	if after == nil {
+		rows, err = b.db.QueryContext(ctx, `
+    SELECT
+        Uuid,
+        Title,
+        NumMsgs,
+        LastMsgTime,
+        Created
+    FROM
+        threads
+    ORDER BY Created, Uuid
+    LIMIT $1
+    `, count)
+	} else {
+		rows, err = b.db.QueryContext(ctx, `
+    SELECT
+        Uuid,
+        Title,
+        NumMsgs,
+        LastMsgTime,
+        Created
+    FROM
+        threads
+    WHERE (Created, Uuid) > ($1, $2)
+    ORDER BY Created, Uuid
+    LIMIT $3
+    `, after.Created, after.Id, count)
 	}
 
+	if err != nil {
+		return translateError(err, "thread")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t entities.Thread
+		err = rows.Scan(&t.Id, &t.Title, &t.NumMsgs, &t.LastMsgTime, &t.Created)
+		if err != nil {
+			return translateError(err, "thread")
+		}
+		appendToCollection(t)
+	}
 	err = rows.Err()
-	return err
+	return translateError(err, "thread")
 }
 
-func GetThreadTotal() (uint, error) {
+func (b *Backend) GetThreadTotal(ctx context.Context) (uint, error) {
 	ret := uint(0)
 
 	// TODO also need to put filtering in here
-	err := db.QueryRow(`
+	err := b.db.QueryRowContext(ctx, `
     SELECT
         count(*) 
     FROM
         threads
     `).Scan(&ret)
 
-	return ret, err
+	return ret, translateError(err, "thread")
 }
 
-func EditThreadByUuid(targetUuid uuid.UUID, t *entities.ThreadEdit) error {
-	_, err := editThreadStmt.Exec(t.Title, targetUuid)
-	return err
+func (b *Backend) EditThreadByUuid(ctx context.Context, targetUuid uuid.UUID, t *entities.ThreadEdit) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err, "thread")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.StmtContext(ctx, b.editThreadStmt).ExecContext(ctx, t.Title, targetUuid)
+	if err != nil {
+		return translateError(err, "thread")
+	}
+	if err = checkAffected(res, "thread"); err != nil {
+		return err
+	}
+
+	err = notify(ctx, tx, backend.Event{Type: backend.ThreadEdited, ThreadId: targetUuid})
+	if err != nil {
+		return translateError(err, "thread")
+	}
+
+	return translateError(tx.Commit(), "thread")
+}
+
+// ReconcileThreadStats recomputes NumMsgs and LastMsgTime of every
+// thread from the messages table
+func (b *Backend) ReconcileThreadStats(ctx context.Context) error {
+	_, err := b.db.ExecContext(ctx, `
+    UPDATE threads SET
+        NumMsgs = (SELECT count(*) FROM messages WHERE messages.ThreadId = threads.Uuid),
+        LastMsgTime = (SELECT max(Created) FROM messages WHERE messages.ThreadId = threads.Uuid)
+    `)
+	return translateError(err, "thread")
 }
 
-func GetUserByUsername(uname string) (*entities.User, error) {
+func (b *Backend) GetUserByUsername(ctx context.Context, uname string) (*entities.User, error) {
 	var u entities.User
-	err := getUserByUnameStmt.QueryRow(uname).Scan(&u.Uuid, &u.FirstName, &u.SecondName, &u.Username, &u.HashedPwd)
+	err := b.getUserByUnameStmt.QueryRowContext(ctx, uname).Scan(&u.Uuid, &u.FirstName, &u.SecondName, &u.Username, &u.HashedPwd, &u.Approved, &u.Role, &u.Email, &u.DisplayName, &u.Bio, &u.Service, &u.TokenGeneration)
 
 	if err != nil {
-		return nil, err
+		return nil, translateError(err, "user")
 	}
 
 	return &u, nil
 }
 
-func GetUserByUuid(targetUuid uuid.UUID) (*entities.User, error) {
+func (b *Backend) GetUserByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.User, error) {
 	var u entities.User
-	err := getUserByUuidStmt.QueryRow(targetUuid).Scan(&u.Uuid, &u.FirstName, &u.SecondName, &u.Username, &u.HashedPwd)
+	err := b.getUserByUuidStmt.QueryRowContext(ctx, targetUuid).Scan(&u.Uuid, &u.FirstName, &u.SecondName, &u.Username, &u.HashedPwd, &u.Approved, &u.Role, &u.Email, &u.DisplayName, &u.Bio, &u.Service, &u.TokenGeneration)
 
 	if err != nil {
-		return nil, err
+		return nil, translateError(err, "user")
 	}
 
 	return &u, nil
 }
+
+func (b *Backend) GetUserCollection(ctx context.Context, prefix string, count uint64, page int64, appendToCollection func(entities.User)) error {
+	offset := page * int64(count)
+
+	rows, err := b.db.QueryContext(ctx, `
+    SELECT
+        Uuid,
+        FirstName,
+        SecondName,
+        Username,
+        HashedPwd,
+        Approved,
+        Role,
+        Email,
+        DisplayName,
+        Bio,
+        Service,
+        TokenGeneration
+    FROM
+        users
+    WHERE lower(Username) LIKE $1 ESCAPE '\'
+    ORDER BY lower(Username)
+    LIMIT $2 OFFSET $3
+    `, backend.LikePrefix(prefix), count, offset)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u entities.User
+		err = rows.Scan(&u.Uuid, &u.FirstName, &u.SecondName, &u.Username, &u.HashedPwd, &u.Approved, &u.Role, &u.Email, &u.DisplayName, &u.Bio, &u.Service, &u.TokenGeneration)
+		if err != nil {
+			return translateError(err, "user")
+		}
+		appendToCollection(u)
+	}
+	return translateError(rows.Err(), "user")
+}
+
+func (b *Backend) GetUserTotal(ctx context.Context, prefix string) (uint, error) {
+	ret := uint(0)
+
+	err := b.db.QueryRowContext(ctx, `
+    SELECT
+        count(*)
+    FROM
+        users
+    WHERE lower(Username) LIKE $1 ESCAPE '\'
+    `, backend.LikePrefix(prefix)).Scan(&ret)
+
+	return ret, translateError(err, "user")
+}
+
+func (b *Backend) EditUserByUuid(ctx context.Context, targetUuid uuid.UUID, u *entities.UserEdit) error {
+	query := "UPDATE users SET "
+	updateFieldSql := []string{}
+	params := []interface{}{}
+	if u.FirstName != nil {
+		updateFieldSql = append(updateFieldSql, fmt.Sprintf("FirstName = $%d", len(params)+1))
+		params = append(params, *u.FirstName)
+	}
+	if u.SecondName != nil {
+		updateFieldSql = append(updateFieldSql, fmt.Sprintf("SecondName = $%d", len(params)+1))
+		params = append(params, *u.SecondName)
+	}
+	if u.DisplayName != nil {
+		updateFieldSql = append(updateFieldSql, fmt.Sprintf("DisplayName = $%d", len(params)+1))
+		params = append(params, *u.DisplayName)
+	}
+	if u.Bio != nil {
+		updateFieldSql = append(updateFieldSql, fmt.Sprintf("Bio = $%d", len(params)+1))
+		params = append(params, *u.Bio)
+	}
+	if u.Role != nil {
+		updateFieldSql = append(updateFieldSql, fmt.Sprintf("Role = $%d", len(params)+1))
+		params = append(params, *u.Role)
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	query += strings.Join(updateFieldSql, ", ")
+	query += fmt.Sprintf(" WHERE Uuid = $%d", len(params)+1)
+	params = append(params, targetUuid)
+
+	res, err := b.db.ExecContext(ctx, query, params...)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	return checkAffected(res, "user")
+}
+
+// CreateUser inserts u and, in the same transaction, marks inviteCode
+// as used by it
+func (b *Backend) CreateUser(ctx context.Context, u *entities.User, inviteCode string) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.StmtContext(ctx, b.createUserStmt).ExecContext(ctx,
+		u.Uuid,
+		u.FirstName,
+		u.SecondName,
+		u.Username,
+		u.HashedPwd,
+		u.Approved,
+		u.Role,
+		u.Email,
+		u.Service)
+
+	if err != nil {
+		return translateError(err, "user")
+	}
+
+	if inviteCode != "" {
+		res, err := tx.StmtContext(ctx, b.redeemInviteStmt).ExecContext(ctx, u.Uuid, inviteCode)
+		if err != nil {
+			return translateError(err, "invite")
+		}
+		if err = checkAffected(res, "invite"); err != nil {
+			return entities.WrapError(entities.Validation, "invite code is not valid or has been used", err)
+		}
+	}
+
+	return translateError(tx.Commit(), "user")
+}
+
+func (b *Backend) SetUserRole(ctx context.Context, targetUuid uuid.UUID, role entities.Role) error {
+	res, err := b.setUserRoleStmt.ExecContext(ctx, role, targetUuid)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	return checkAffected(res, "user")
+}
+
+// SetUserPassword updates the hash and, in the same transaction,
+// deletes the sessions and password resets of the user
+func (b *Backend) SetUserPassword(ctx context.Context, targetUuid uuid.UUID, hashedPwd []byte) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.StmtContext(ctx, b.setUserPwdStmt).ExecContext(ctx, hashedPwd, targetUuid)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	if err = checkAffected(res, "user"); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+    DELETE FROM sessions
+    WHERE UserId = $1`, targetUuid)
+	if err != nil {
+		return translateError(err, "session")
+	}
+
+	_, err = tx.ExecContext(ctx, `
+    DELETE FROM passwordResets
+    WHERE UserId = $1`, targetUuid)
+	if err != nil {
+		return translateError(err, "password reset")
+	}
+
+	return translateError(tx.Commit(), "user")
+}
+
+func (b *Backend) UpgradeUserPassword(ctx context.Context, targetUuid uuid.UUID, oldHash, newHash []byte) error {
+	res, err := b.upgradeUserPwdStmt.ExecContext(ctx, newHash, targetUuid, oldHash)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	return checkAffected(res, "user")
+}
+
+func (b *Backend) ApproveUser(ctx context.Context, uname string) error {
+	res, err := b.approveUserStmt.ExecContext(ctx, uname)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	return checkAffected(res, "user")
+}
+
+func (b *Backend) CreateInvite(ctx context.Context, code string) error {
+	_, err := b.createInviteStmt.ExecContext(ctx, code, time.Now())
+	return translateError(err, "invite")
+}
+
+func (b *Backend) sessionPrepareStmts() error {
+	var err error
+	b.createSessionStmt, err = b.db.Prepare(`
+    INSERT INTO sessions (
+        Id,
+        UserId,
+        Created,
+        Expires)
+    VALUES ($1, $2, $3, $4)`)
+
+	if err != nil {
+		return err
+	}
+
+	b.takeSessionStmt, err = b.db.Prepare(`
+    DELETE FROM sessions
+    WHERE Id = $1
+    RETURNING
+        Id,
+        UserId,
+        Created,
+        Expires`)
+
+	if err != nil {
+		return err
+	}
+
+	b.createResetStmt, err = b.db.Prepare(`
+    INSERT INTO passwordResets (
+        Id,
+        UserId,
+        Created,
+        Expires)
+    VALUES ($1, $2, $3, $4)`)
+
+	if err != nil {
+		return err
+	}
+
+	b.takeResetStmt, err = b.db.Prepare(`
+    DELETE FROM passwordResets
+    WHERE Id = $1
+    RETURNING
+        Id,
+        UserId,
+        Created,
+        Expires`)
+
+	if err != nil {
+		return err
+	}
+
+	b.getApiKeyStmt, err = b.db.Prepare(`
+    SELECT
+        Id,
+        UserId,
+        Name,
+        Scope,
+        Threads,
+        Created,
+        Expires
+    FROM apiKeys
+    WHERE Id = $1`)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *Backend) CreateSession(ctx context.Context, s *entities.Session) error {
+	_, err := b.createSessionStmt.ExecContext(ctx, s.Id, s.UserId, s.Created, s.Expires)
+	return translateError(err, "session")
+}
+
+func (b *Backend) TakeSession(ctx context.Context, id string) (*entities.Session, error) {
+	var s entities.Session
+	err := b.takeSessionStmt.QueryRowContext(ctx, id).Scan(&s.Id, &s.UserId, &s.Created, &s.Expires)
+
+	if err != nil {
+		return nil, translateError(err, "session")
+	}
+	return &s, nil
+}
+
+func (b *Backend) DeleteUserSessions(ctx context.Context, userId uuid.UUID) error {
+	_, err := b.db.ExecContext(ctx, `
+    DELETE FROM sessions
+    WHERE UserId = $1`, userId)
+	return translateError(err, "session")
+}
+
+func (b *Backend) CreatePasswordReset(ctx context.Context, r *entities.PasswordReset) error {
+	_, err := b.createResetStmt.ExecContext(ctx, r.Id, r.UserId, r.Created, r.Expires)
+	return translateError(err, "password reset")
+}
+
+func (b *Backend) TakePasswordReset(ctx context.Context, id string) (*entities.PasswordReset, error) {
+	var r entities.PasswordReset
+	err := b.takeResetStmt.QueryRowContext(ctx, id).Scan(&r.Id, &r.UserId, &r.Created, &r.Expires)
+
+	if err != nil {
+		return nil, translateError(err, "password reset")
+	}
+	return &r, nil
+}
+
+func (b *Backend) ReplacePasswordReset(ctx context.Context, oldId, newId string) (*entities.PasswordReset, error) {
+	var r entities.PasswordReset
+	err := b.db.QueryRowContext(ctx, `
+    UPDATE passwordResets
+    SET Id = $1
+    WHERE Id = $2
+    RETURNING Id, UserId, Created, Expires`, newId, oldId).Scan(&r.Id, &r.UserId, &r.Created, &r.Expires)
+
+	if err != nil {
+		return nil, translateError(err, "password reset")
+	}
+	return &r, nil
+}
+
+func (b *Backend) RecordSecurityEvent(ctx context.Context, e *entities.SecurityEvent) error {
+	_, err := b.db.ExecContext(ctx, `
+    INSERT INTO securityEvents (
+        Kind,
+        Username,
+        RemoteAddr,
+        Created)
+    VALUES ($1, $2, $3, $4)`, e.Kind, e.Username, e.RemoteAddr, e.Created)
+	return translateError(err, "security event")
+}
+
+func (b *Backend) CreateApiKey(ctx context.Context, k *entities.ApiKey) error {
+	_, err := b.db.ExecContext(ctx, `
+    INSERT INTO apiKeys (
+        Id,
+        UserId,
+        Name,
+        Scope,
+        Threads,
+        Created,
+        Expires)
+    VALUES ($1, $2, $3, $4, $5, $6, $7)`, k.Id, k.UserId, k.Name, k.Scope, backend.JoinUuids(k.Threads), k.Created, k.Expires)
+	return translateError(err, "API key")
+}
+
+// scanApiKey reads an API key from a row of the columns selected by
+// getApiKeyStmt
+func scanApiKey(scan func(dest ...interface{}) error) (*entities.ApiKey, error) {
+	var k entities.ApiKey
+	var threads string
+	err := scan(&k.Id, &k.UserId, &k.Name, &k.Scope, &threads, &k.Created, &k.Expires)
+	if err != nil {
+		return nil, translateError(err, "API key")
+	}
+	if k.Threads, err = backend.SplitUuids(threads); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (b *Backend) GetApiKey(ctx context.Context, id string) (*entities.ApiKey, error) {
+	return scanApiKey(b.getApiKeyStmt.QueryRowContext(ctx, id).Scan)
+}
+
+func (b *Backend) GetUserApiKeys(ctx context.Context, userId uuid.UUID, appendToCollection func(entities.ApiKey)) error {
+	rows, err := b.db.QueryContext(ctx, `
+    SELECT
+        Id,
+        UserId,
+        Name,
+        Scope,
+        Threads,
+        Created,
+        Expires
+    FROM apiKeys
+    WHERE UserId = $1
+    ORDER BY Name
+    `, userId)
+	if err != nil {
+		return translateError(err, "API key")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		k, err := scanApiKey(rows.Scan)
+		if err != nil {
+			return err
+		}
+		appendToCollection(*k)
+	}
+	return translateError(rows.Err(), "API key")
+}
+
+func (b *Backend) DeleteApiKey(ctx context.Context, userId uuid.UUID, name string) error {
+	res, err := b.db.ExecContext(ctx, `
+    DELETE FROM apiKeys
+    WHERE UserId = $1 AND Name = $2`, userId, name)
+	if err != nil {
+		return translateError(err, "API key")
+	}
+	return checkAffected(res, "API key")
+}
+
+func (b *Backend) CreateWebhook(ctx context.Context, w *entities.Webhook) error {
+	_, err := b.db.ExecContext(ctx, `
+    INSERT INTO webhooks (
+        Id,
+        Url,
+        Secret,
+        Events,
+        Created)
+    VALUES ($1, $2, $3, $4, $5)`, w.Id, w.Url, w.Secret, backend.JoinEvents(w.Events), w.Created)
+	return translateError(err, "webhook")
+}
+
+const webhookColumns = `
+        Id,
+        Url,
+        Secret,
+        Events,
+        Created`
+
+// scanWebhook reads a webhook from a row of webhookColumns
+func scanWebhook(scan func(dest ...interface{}) error) (*entities.Webhook, error) {
+	var w entities.Webhook
+	var events string
+	err := scan(&w.Id, &w.Url, &w.Secret, &events, &w.Created)
+	if err != nil {
+		return nil, translateError(err, "webhook")
+	}
+	w.Events = backend.SplitEvents(events)
+	return &w, nil
+}
+
+func (b *Backend) GetWebhook(ctx context.Context, id uuid.UUID) (*entities.Webhook, error) {
+	return scanWebhook(b.db.QueryRowContext(ctx, `
+    SELECT`+webhookColumns+`
+    FROM webhooks
+    WHERE Id = $1`, id).Scan)
+}
+
+func (b *Backend) GetWebhooks(ctx context.Context, appendToCollection func(entities.Webhook)) error {
+	rows, err := b.db.QueryContext(ctx, `
+    SELECT`+webhookColumns+`
+    FROM webhooks
+    ORDER BY Created, Id`)
+	if err != nil {
+		return translateError(err, "webhook")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		w, err := scanWebhook(rows.Scan)
+		if err != nil {
+			return err
+		}
+		appendToCollection(*w)
+	}
+	return translateError(rows.Err(), "webhook")
+}
+
+func (b *Backend) EditWebhookByUuid(ctx context.Context, id uuid.UUID, w *entities.WebhookEdit) error {
+	query := "UPDATE webhooks SET "
+	updateFieldSql := []string{}
+	params := []interface{}{}
+	var paramIndex = 1
+	if w.Url != nil {
+		updateFieldSql = append(updateFieldSql, fmt.Sprintf("Url = $%d", paramIndex))
+		paramIndex += 1
+		params = append(params, *w.Url)
+	}
+
+	if w.Secret != nil {
+		updateFieldSql = append(updateFieldSql, fmt.Sprintf("Secret = $%d", paramIndex))
+		paramIndex += 1
+		params = append(params, *w.Secret)
+	}
+
+	if w.Events != nil {
+		updateFieldSql = append(updateFieldSql, fmt.Sprintf("Events = $%d", paramIndex))
+		paramIndex += 1
+		params = append(params, backend.JoinEvents(*w.Events))
+	}
+
+	if len(updateFieldSql) == 0 {
+		return nil
+	}
+	query += strings.Join(updateFieldSql, ", ")
+	query += fmt.Sprintf(" WHERE Id = $%d", paramIndex)
+	params = append(params, id)
+
+	res, err := b.db.ExecContext(ctx, query, params...)
+	if err != nil {
+		return translateError(err, "webhook")
+	}
+	return checkAffected(res, "webhook")
+}
+
+func (b *Backend) DeleteWebhookByUuid(ctx context.Context, id uuid.UUID) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err, "webhook")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+    DELETE FROM webhookDeliveries
+    WHERE WebhookId = $1`, id)
+	if err != nil {
+		return translateError(err, "webhook")
+	}
+
+	res, err := tx.ExecContext(ctx, `
+    DELETE FROM webhooks
+    WHERE Id = $1`, id)
+	if err != nil {
+		return translateError(err, "webhook")
+	}
+	if err = checkAffected(res, "webhook"); err != nil {
+		return err
+	}
+
+	return translateError(tx.Commit(), "webhook")
+}
+
+func (b *Backend) CreateWebhookDelivery(ctx context.Context, d *entities.WebhookDelivery) error {
+	_, err := b.db.ExecContext(ctx, `
+    INSERT INTO webhookDeliveries (
+        Id,
+        WebhookId,
+        EventId,
+        Event,
+        Payload,
+        Status,
+        Attempts,
+        ResponseStatus,
+        Error,
+        Created,
+        Updated)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		d.Id, d.WebhookId, d.EventId, d.Event, d.Payload, d.Status, d.Attempts, d.ResponseStatus, d.Error, d.Created, d.Updated)
+	return translateError(err, "webhook delivery")
+}
+
+func (b *Backend) UpdateWebhookDelivery(ctx context.Context, d *entities.WebhookDelivery) error {
+	res, err := b.db.ExecContext(ctx, `
+    UPDATE webhookDeliveries
+    SET Status = $1, Attempts = $2, ResponseStatus = $3, Error = $4, Updated = $5
+    WHERE Id = $6`, d.Status, d.Attempts, d.ResponseStatus, d.Error, d.Updated, d.Id)
+	if err != nil {
+		return translateError(err, "webhook delivery")
+	}
+	return checkAffected(res, "webhook delivery")
+}
+
+const deliveryColumns = `
+        Id,
+        WebhookId,
+        EventId,
+        Event,
+        Payload,
+        Status,
+        Attempts,
+        ResponseStatus,
+        Error,
+        Created,
+        Updated`
+
+// scanDelivery reads a webhook delivery from a row of deliveryColumns
+func scanDelivery(scan func(dest ...interface{}) error) (*entities.WebhookDelivery, error) {
+	var d entities.WebhookDelivery
+	err := scan(&d.Id, &d.WebhookId, &d.EventId, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.ResponseStatus, &d.Error, &d.Created, &d.Updated)
+	if err != nil {
+		return nil, translateError(err, "webhook delivery")
+	}
+	return &d, nil
+}
+
+func (b *Backend) GetWebhookDelivery(ctx context.Context, id uuid.UUID) (*entities.WebhookDelivery, error) {
+	return scanDelivery(b.db.QueryRowContext(ctx, `
+    SELECT`+deliveryColumns+`
+    FROM webhookDeliveries
+    WHERE Id = $1`, id).Scan)
+}
+
+func (b *Backend) GetWebhookDeliveries(ctx context.Context, webhookId uuid.UUID, count uint64, page int64, appendToCollection func(entities.WebhookDelivery)) error {
+	offset := page * int64(count)
+
+	rows, err := b.db.QueryContext(ctx, `
+    SELECT`+deliveryColumns+`
+    FROM webhookDeliveries
+    WHERE WebhookId = $1
+    ORDER BY Created DESC, Id DESC
+    LIMIT $2 OFFSET $3`, webhookId, count, offset)
+	if err != nil {
+		return translateError(err, "webhook delivery")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d, err := scanDelivery(rows.Scan)
+		if err != nil {
+			return err
+		}
+		appendToCollection(*d)
+	}
+	return translateError(rows.Err(), "webhook delivery")
+}
+
+func (b *Backend) GetWebhookDeliveryTotal(ctx context.Context, webhookId uuid.UUID) (uint, error) {
+	ret := uint(0)
+	err := b.db.QueryRowContext(ctx, `
+    SELECT count(*)
+    FROM webhookDeliveries
+    WHERE WebhookId = $1`, webhookId).Scan(&ret)
+	return ret, translateError(err, "webhook delivery")
+}
+
+func (b *Backend) CreateJob(ctx context.Context, j *entities.Job) error {
+	_, err := b.db.ExecContext(ctx, `
+    INSERT INTO jobs (
+        Id,
+        Kind,
+        Payload,
+        Status,
+        Attempts,
+        MaxAttempts,
+        Error,
+        RunAt,
+        LockedUntil,
+        Created,
+        Updated)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		j.Id, j.Kind, j.Payload, j.Status, j.Attempts, j.MaxAttempts, j.Error, j.RunAt, j.LockedUntil, j.Created, j.Updated)
+	return translateError(err, "job")
+}
+
+const jobColumns = `
+        Id,
+        Kind,
+        Payload,
+        Status,
+        Attempts,
+        MaxAttempts,
+        Error,
+        RunAt,
+        LockedUntil,
+        Created,
+        Updated`
+
+// scanJob reads a job from a row of jobColumns
+func scanJob(scan func(dest ...interface{}) error) (*entities.Job, error) {
+	var j entities.Job
+	err := scan(&j.Id, &j.Kind, &j.Payload, &j.Status, &j.Attempts, &j.MaxAttempts, &j.Error, &j.RunAt, &j.LockedUntil, &j.Created, &j.Updated)
+	if err != nil {
+		return nil, translateError(err, "job")
+	}
+	return &j, nil
+}
+
+// ClaimJob skips the jobs other instances have locked while claiming
+// them, rather than waiting for them
+func (b *Backend) ClaimJob(ctx context.Context, now time.Time, lease time.Duration) (*entities.Job, error) {
+	j, err := scanJob(b.db.QueryRowContext(ctx, `
+    UPDATE jobs
+    SET Status = $1, Attempts = Attempts + 1, LockedUntil = $2, Updated = $3
+    WHERE Id = (
+        SELECT Id
+        FROM jobs
+        WHERE (Status = $4 AND RunAt <= $3) OR (Status = $1 AND LockedUntil <= $3)
+        ORDER BY RunAt
+        LIMIT 1
+        FOR UPDATE SKIP LOCKED)
+    RETURNING`+jobColumns,
+		entities.JobRunning, now.Add(lease), now, entities.JobPending).Scan)
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+		return nil, entities.NewError(entities.NotFound, "no job is due")
+	}
+	return j, err
+}
+
+func (b *Backend) UpdateJob(ctx context.Context, j *entities.Job) error {
+	res, err := b.db.ExecContext(ctx, `
+    UPDATE jobs
+    SET Payload = $1, Status = $2, Attempts = $3, Error = $4, RunAt = $5, LockedUntil = $6, Updated = $7
+    WHERE Id = $8`, j.Payload, j.Status, j.Attempts, j.Error, j.RunAt, j.LockedUntil, j.Updated, j.Id)
+	if err != nil {
+		return translateError(err, "job")
+	}
+	return checkAffected(res, "job")
+}
+
+func (b *Backend) DeleteJob(ctx context.Context, id uuid.UUID) error {
+	res, err := b.db.ExecContext(ctx, `
+    DELETE FROM jobs
+    WHERE Id = $1`, id)
+	if err != nil {
+		return translateError(err, "job")
+	}
+	return checkAffected(res, "job")
+}
+
+func (b *Backend) GetJob(ctx context.Context, id uuid.UUID) (*entities.Job, error) {
+	return scanJob(b.db.QueryRowContext(ctx, `
+    SELECT`+jobColumns+`
+    FROM jobs
+    WHERE Id = $1`, id).Scan)
+}
+
+func (b *Backend) GetJobs(ctx context.Context, status entities.JobStatus, count uint64, page int64, appendToCollection func(entities.Job)) error {
+	offset := page * int64(count)
+
+	rows, err := b.db.QueryContext(ctx, `
+    SELECT`+jobColumns+`
+    FROM jobs
+    WHERE Status = $1
+    ORDER BY RunAt, Id
+    LIMIT $2 OFFSET $3`, status, count, offset)
+	if err != nil {
+		return translateError(err, "job")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		j, err := scanJob(rows.Scan)
+		if err != nil {
+			return err
+		}
+		appendToCollection(*j)
+	}
+	return translateError(rows.Err(), "job")
+}
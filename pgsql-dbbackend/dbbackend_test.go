@@ -0,0 +1,166 @@
+package dbbackend
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// argsDriver is a database/sql driver recording the arguments each
+// statement is run with, as lib/pq would be given them. Queries
+// locking a message for update read back oldThreadId, other queries
+// read no rows
+type argsDriver struct {
+	oldThreadId uuid.UUID
+	runs        []argsRun
+}
+
+type argsRun struct {
+	query string
+	args  []driver.Value
+}
+
+var testDriver = &argsDriver{}
+
+func init() {
+	sql.Register("pgsql-args", testDriver)
+}
+
+func (d *argsDriver) Open(name string) (driver.Conn, error) { return argsConn{d}, nil }
+
+type argsConn struct{ d *argsDriver }
+
+func (c argsConn) Prepare(query string) (driver.Stmt, error) { return argsStmt{c.d, query}, nil }
+func (c argsConn) Close() error                              { return nil }
+func (c argsConn) Begin() (driver.Tx, error)                 { return argsTx{}, nil }
+
+type argsTx struct{}
+
+func (argsTx) Commit() error   { return nil }
+func (argsTx) Rollback() error { return nil }
+
+type argsStmt struct {
+	d     *argsDriver
+	query string
+}
+
+func (s argsStmt) Close() error  { return nil }
+func (s argsStmt) NumInput() int { return -1 }
+
+func (s argsStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.runs = append(s.d.runs, argsRun{s.query, args})
+	return driver.RowsAffected(1), nil
+}
+
+func (s argsStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.runs = append(s.d.runs, argsRun{s.query, args})
+	if strings.Contains(s.query, "FOR UPDATE") {
+		return &argsRows{row: []driver.Value{s.d.oldThreadId.String(), time.Now()}}, nil
+	}
+	return &argsRows{}, nil
+}
+
+type argsRows struct {
+	row []driver.Value
+}
+
+func (r *argsRows) Columns() []string {
+	return make([]string, len(r.row))
+}
+
+func (r *argsRows) Close() error { return nil }
+
+func (r *argsRows) Next(dest []driver.Value) error {
+	if r.row == nil {
+		return io.EOF
+	}
+	copy(dest, r.row)
+	r.row = nil
+	return nil
+}
+
+// testBackend opens a Backend on the recording driver, clearing what
+// it recorded
+func testBackend(t *testing.T) *Backend {
+	db, err := sql.Open("pgsql-args", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	b := &Backend{db: db}
+	if err = b.messagePrepareStmts(); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.threadPrepareStmts(); err != nil {
+		t.Fatal(err)
+	}
+	testDriver.runs = nil
+	return b
+}
+
+// checkUuidArgs checks the queries run were given ids as uuids. lib/pq
+// sends a []byte as it is, which postgres rejects for a uuid column
+func checkUuidArgs(t *testing.T, ids ...uuid.UUID) {
+	if len(testDriver.runs) == 0 {
+		t.Fatal("no queries were run")
+	}
+	given := map[string]bool{}
+	for _, run := range testDriver.runs {
+		for _, arg := range run.args {
+			if b, ok := arg.([]byte); ok {
+				t.Errorf("%q was given %d bytes", strings.Join(strings.Fields(run.query), " "), len(b))
+			}
+			if s, ok := arg.(string); ok {
+				given[s] = true
+			}
+		}
+	}
+	for _, id := range ids {
+		if !given[id.String()] {
+			t.Errorf("no query was given %s", id)
+		}
+	}
+}
+
+func TestUuidArgs(t *testing.T) {
+	ctx := context.Background()
+	threadId, _ := uuid.NewV4()
+	messageId, _ := uuid.NewV4()
+	authorId, _ := uuid.NewV4()
+	content := "Campbell-Bannerman"
+
+	tests := []struct {
+		name string
+		run  func(b *Backend) error
+		ids  []uuid.UUID
+	}{
+		{"message collection", func(b *Backend) error {
+			return b.GetMessageCollection(ctx, threadId, 10, 2, func(entities.Message) {
+				panic("no messages were read")
+			})
+		}, []uuid.UUID{threadId}},
+		{"message edit", func(b *Backend) error {
+			testDriver.oldThreadId = threadId
+			return b.EditMessageByUuid(ctx, messageId, &entities.MessageEdit{AuthorId: &authorId, Content: &content})
+		}, []uuid.UUID{messageId, authorId}},
+		{"message move", func(b *Backend) error {
+			testDriver.oldThreadId, _ = uuid.NewV4()
+			return b.EditMessageByUuid(ctx, messageId, &entities.MessageEdit{ThreadId: &threadId, Content: &content})
+		}, []uuid.UUID{messageId, threadId}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := testBackend(t)
+			if err := test.run(b); err != nil {
+				t.Fatal(err)
+			}
+			checkUuidArgs(t, test.ids...)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package dbbackend
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/lib/pq"
+	"net"
+	"strings"
+)
+
+// translateError maps database/sql and pq errors on to the kinds of
+// entities.Error, what names the entity the query was about. Errors
+// that are not recognised are returned unchanged
+func translateError(err error, what string) error {
+	if err == nil {
+		return nil
+	}
+
+	if err == sql.ErrNoRows {
+		return entities.WrapError(entities.NotFound, what+" not found", err)
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", "53", "57": // connection, resources, operator intervention
+			return entities.WrapError(entities.Unavailable, "database unavailable", err)
+		case "22": // data exception
+			return entities.WrapError(entities.Validation, "invalid "+what, err)
+		case "23": // integrity constraint violation
+			switch pqErr.Code {
+			case "23505":
+				return entities.WrapError(entities.Conflict, what+" already exists", err)
+			case "23503":
+				if strings.Contains(pqErr.Detail, "still referenced") {
+					return entities.WrapError(entities.Conflict, what+" is still in use", err)
+				}
+				return entities.WrapError(entities.Validation, what+" refers to something that does not exist", err)
+			default:
+				return entities.WrapError(entities.Validation, "invalid "+what, err)
+			}
+		}
+		return err
+	}
+
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr) {
+		return entities.WrapError(entities.Unavailable, "database unavailable", err)
+	}
+
+	return err
+}
+
+// checkAffected reports a NotFound error when an UPDATE or DELETE did
+// not match any row
+func checkAffected(res sql.Result, what string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return entities.NewError(entities.NotFound, what+" not found")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package dbbackend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/lib/pq"
+	"github.com/satori/go.uuid"
+	"log"
+	"time"
+)
+
+// eventChannel is the channel events are sent on with NOTIFY, every
+// instance of the server using the database LISTENs to it
+const eventChannel = "jerver_events"
+
+// bounds on the wait between attempts to reconnect the listener, and
+// how long it may be idle before its connection is checked
+const (
+	listenMinReconnect = time.Second
+	listenMaxReconnect = time.Minute
+	listenPingInterval = 90 * time.Second
+)
+
+// notify sends e to the listening instances, this one included, when
+// tx commits, and not at all if it does not
+func notify(ctx context.Context, tx *sql.Tx, e backend.Event) error {
+	// the id is given here so that it is the same on every instance
+	e.Id, _ = uuid.NewV4()
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "SELECT pg_notify($1, $2)", eventChannel, string(payload))
+	return err
+}
+
+// listen starts passing the events sent on eventChannel to the bus
+func (b *Backend) listen(dataSource string) error {
+	b.listener = pq.NewListener(dataSource, listenMinReconnect, listenMaxReconnect, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("event listener: %s", err)
+		}
+	})
+	if err := b.listener.Listen(eventChannel); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case n, ok := <-b.listener.Notify:
+				if !ok {
+					return
+				}
+				// sent after the listener has reconnected, anything
+				// notified in between is lost
+				if n == nil {
+					b.bus.Publish(backend.Event{Type: backend.EventsLost})
+					continue
+				}
+				var e backend.Event
+				if err := json.Unmarshal([]byte(n.Extra), &e); err != nil {
+					log.Printf("event listener: malformed event: %s", err)
+					continue
+				}
+				b.bus.Publish(e)
+			case <-time.After(listenPingInterval):
+				go b.listener.Ping()
+			}
+		}
+	}()
+	return nil
+}
+
+// Subscribe receives the events of every instance of the server using
+// the database, through LISTEN
+func (b *Backend) Subscribe(handler func(backend.Event)) func() {
+	return b.bus.Subscribe(handler)
+}
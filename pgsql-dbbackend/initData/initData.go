@@ -6,6 +6,7 @@ import (
 	"github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
 	"log"
+	"time"
 )
 
 type userBaseDetails struct {
@@ -13,14 +14,15 @@ type userBaseDetails struct {
 	SecondName string
 	Username   string
 	Pwd        string
+	Role       string
 }
 
 var users = []userBaseDetails{
-	{"Robert", "Gascoyne-Cecil", "salisbury", "1895"},
-	{"Arthur", "Balfour", "abalfour", "1902"},
-	{"Henry", "Campbell-Bannerman", "hcb", "1905"},
-	{"Herbert", "Asquith", "hasquith", "1908"},
-	{"David", "Lloyd George", "dlg", "1916"},
+	{"Robert", "Gascoyne-Cecil", "salisbury", "1895", "admin"},
+	{"Arthur", "Balfour", "abalfour", "1902", "moderator"},
+	{"Henry", "Campbell-Bannerman", "hcb", "1905", "member"},
+	{"Herbert", "Asquith", "hasquith", "1908", "member"},
+	{"David", "Lloyd George", "dlg", "1916", "member"},
 }
 
 type threadBaseDetails struct {
@@ -64,8 +66,9 @@ func main() {
         FirstName,
         SecondName,
         Username,
-        HashedPwd)
-    VALUES ($1, $2, $3, $4, $5)`)
+        HashedPwd,
+        Role)
+    VALUES ($1, $2, $3, $4, $5, $6)`)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -81,7 +84,7 @@ func main() {
 		}
 
 		_, err = stmt.Exec(userUuids[i], user.FirstName,
-			user.SecondName, user.Username, hpwd)
+			user.SecondName, user.Username, hpwd, user.Role)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -96,8 +99,9 @@ func main() {
 	stmt, err = tx.Prepare(`
     INSERT INTO threads(
         Uuid,
-        Title)
-    VALUES ($1, $2)`)
+        Title,
+        Created)
+    VALUES ($1, $2, $3)`)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -107,7 +111,7 @@ func main() {
 	for i, thread := range threads {
 		threadUuid, _ := uuid.NewV4()
 		threadUuids = append(threadUuids, threadUuid)
-		_, err = stmt.Exec(threadUuids[i], thread.Title)
+		_, err = stmt.Exec(threadUuids[i], thread.Title, time.Now().UTC())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -124,8 +128,9 @@ func main() {
         Uuid,
         ThreadId,
         AuthorId,
-        Content)
-    VALUES ($1, $2, $3, $4)`)
+        Content,
+        Created)
+    VALUES ($1, $2, $3, $4, $5)`)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -137,11 +142,22 @@ func main() {
 			messageUuid,
 			threadUuids[message.ThreadIndex],
 			userUuids[message.AuthorIndex],
-			message.Content)
+			message.Content,
+			time.Now().UTC())
 
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 	tx.Commit()
+
+	// FILL IN THREAD MESSAGE COUNTS
+	_, err = db.Exec(`
+    UPDATE threads SET
+        NumMsgs = (SELECT count(*) FROM messages WHERE messages.ThreadId = threads.Uuid),
+        LastMsgTime = (SELECT max(Created) FROM messages WHERE messages.ThreadId = threads.Uuid)
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
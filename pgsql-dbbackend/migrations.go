@@ -0,0 +1,50 @@
+package dbbackend
+
+import (
+	"context"
+	"database/sql"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/migrate"
+	"github.com/john-sharp/jerver/schema"
+)
+
+// migrateLockKey identifies jerver's advisory lock, taken while
+// migrating so that only one instance changes the schema at a time
+const migrateLockKey = 0x6a65727665720001
+
+var dialect = migrate.Dialect{
+	Lock: func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrateLockKey)
+		return err
+	},
+	Unlock: func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrateLockKey)
+		return err
+	},
+	Placeholder: "$1",
+}
+
+func newMigrator(db *sql.DB) (*migrate.Migrator, error) {
+	migrations, err := schema.Migrations(schema.Pgsql)
+	if err != nil {
+		return nil, err
+	}
+	return &migrate.Migrator{DB: db, Dialect: dialect, Migrations: migrations}, nil
+}
+
+// Migrator connects to the database named by config.DataSource for
+// running migrations against it. Unlike Open it does not need the
+// schema to be up to date. The caller closes the Migrator's DB
+func Migrator(config backend.Config) (*migrate.Migrator, error) {
+	db, err := sql.Open("postgres", config.DataSource)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := newMigrator(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
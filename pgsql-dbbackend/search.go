@@ -0,0 +1,110 @@
+package dbbackend
+
+import (
+	"context"
+	"fmt"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"strings"
+)
+
+// headlineOptions has ts_headline mark matches as the backend package
+// expects, and give a few fragments of long text
+const headlineOptions = `StartSel="` + backend.SnippetStart + `", StopSel="` + backend.SnippetEnd + `", ` +
+	`MaxFragments=3, MaxWords=20, MinWords=8, FragmentDelimiter=" … "`
+
+// searchResults returns SQL selecting the results of q, as Kind, Id,
+// ThreadId, AuthorId, Created, Text and Rank, with its arguments. $1
+// is the text searched for. It is empty if q searches nothing
+func searchResults(q *backend.SearchQuery) (string, []interface{}) {
+	args := []interface{}{strings.Join(q.Terms, " ")}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	filter := func(where []string, created string) []string {
+		if q.Since != nil {
+			where = append(where, created+" >= "+arg(*q.Since))
+		}
+		if q.Until != nil {
+			where = append(where, created+" < "+arg(*q.Until))
+		}
+		return where
+	}
+
+	var selects []string
+	if q.Messages {
+		where := []string{"m.SearchVector @@ query"}
+		if q.AuthorId != nil {
+			where = append(where, "m.AuthorId = "+arg(*q.AuthorId))
+		}
+		if q.ThreadId != nil {
+			where = append(where, "m.ThreadId = "+arg(*q.ThreadId))
+		}
+		where = filter(where, "m.Created")
+		selects = append(selects, `
+        SELECT '`+string(entities.SearchMessage)+`' AS Kind, m.Uuid AS Id, m.ThreadId, m.AuthorId, m.Created,
+            coalesce(m.Content, '') AS Text, ts_rank_cd(m.SearchVector, query) AS Rank
+        FROM messages m, plainto_tsquery('english', $1) query
+        WHERE `+strings.Join(where, " AND "))
+	}
+	if q.Threads && q.AuthorId == nil {
+		where := []string{"t.SearchVector @@ query"}
+		if q.ThreadId != nil {
+			where = append(where, "t.Uuid = "+arg(*q.ThreadId))
+		}
+		where = filter(where, "t.Created")
+		selects = append(selects, `
+        SELECT '`+string(entities.SearchThread)+`' AS Kind, t.Uuid AS Id, t.Uuid AS ThreadId, `+arg(uuid.Nil)+`::uuid AS AuthorId, t.Created,
+            coalesce(t.Title, '') AS Text, ts_rank_cd(t.SearchVector, query) AS Rank
+        FROM threads t, plainto_tsquery('english', $1) query
+        WHERE `+strings.Join(where, " AND "))
+	}
+
+	return strings.Join(selects, "\n        UNION ALL"), args
+}
+
+// Search only makes headlines of the page of results, as ts_headline
+// reads the whole text
+func (b *Backend) Search(ctx context.Context, q *backend.SearchQuery, count uint64, page int64, appendToCollection func(entities.SearchResult)) error {
+	results, args := searchResults(q)
+	if results == "" {
+		return nil
+	}
+	offset := page * int64(count)
+	n := len(args)
+	args = append(args, headlineOptions, count, offset)
+
+	rows, err := b.db.QueryContext(ctx, fmt.Sprintf(`
+    SELECT Kind, Id, ThreadId, AuthorId, Created,
+        ts_headline('english', Text, plainto_tsquery('english', $1), $%d), Rank
+    FROM (%s) results
+    ORDER BY Rank DESC, Created DESC, Id
+    LIMIT $%d OFFSET $%d`, n+1, results, n+2, n+3), args...)
+	if err != nil {
+		return translateError(err, "search result")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r entities.SearchResult
+		if err = rows.Scan(&r.Kind, &r.Id, &r.ThreadId, &r.AuthorId, &r.Created, &r.Snippet, &r.Rank); err != nil {
+			return translateError(err, "search result")
+		}
+		appendToCollection(r)
+	}
+	return translateError(rows.Err(), "search result")
+}
+
+func (b *Backend) SearchTotal(ctx context.Context, q *backend.SearchQuery) (uint, error) {
+	results, args := searchResults(q)
+	if results == "" {
+		return 0, nil
+	}
+
+	ret := uint(0)
+	err := b.db.QueryRowContext(ctx, `
+    SELECT count(*)
+    FROM (`+results+`) results`, args...).Scan(&ret)
+	return ret, translateError(err, "search result")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"gitlab.com/johncolinsharp/entitycoll"
+	"html"
+	"strings"
+	"time"
+)
+
+// publicUser is what anyone may see of a user, never its credentials
+type publicUser struct {
+	Uuid        uuid.UUID
+	FirstName   string
+	SecondName  string
+	Username    string
+	DisplayName string
+	Bio         string
+	Role        entities.Role
+	Service     bool
+}
+
+// selfUser is what users see of themselves
+type selfUser struct {
+	publicUser
+	Approved bool
+	Email    string
+}
+
+// publicThread and publicMessage are converted to from the entities
+// types, so a field added there does not compile until it is decided
+// here whether it is public
+type publicThread struct {
+	Id          uuid.UUID
+	Title       string
+	NumMsgs     uint
+	LastMsgTime *time.Time
+	Created     time.Time
+}
+
+type publicMessage struct {
+	Id       uuid.UUID
+	ThreadId uuid.UUID
+	AuthorId uuid.UUID
+	Content  string
+	Created  time.Time
+}
+
+// publicWebhook includes the Secret, as webhooks are only seen by
+// admins, who need it to check signatures
+type publicWebhook struct {
+	Id      uuid.UUID
+	Url     string
+	Secret  string
+	Events  []string
+	Created time.Time
+}
+
+type publicWebhookDelivery struct {
+	Id             uuid.UUID
+	WebhookId      uuid.UUID
+	EventId        uuid.UUID
+	Event          string
+	Payload        string
+	Status         entities.DeliveryStatus
+	Attempts       int
+	ResponseStatus int
+	Error          string
+	Created        time.Time
+	Updated        time.Time
+}
+
+// publicSearchResult has the Snippet as HTML, the text escaped and
+// the matches in <mark> elements
+type publicSearchResult struct {
+	Kind     entities.SearchKind
+	Id       uuid.UUID
+	ThreadId uuid.UUID
+	AuthorId *uuid.UUID `json:",omitempty"`
+	Created  time.Time
+	Snippet  string
+	Rank     float64
+}
+
+// errNoProjection is returned for entities without a public
+// representation, so that nothing is sent that has not been chosen to
+// be
+var errNoProjection = errors.New("entity has no public representation")
+
+func projectUser(viewer entitycoll.Entity, u *entities.User) entitycoll.Entity {
+	p := publicUser{
+		Uuid:        u.Uuid,
+		FirstName:   u.FirstName,
+		SecondName:  u.SecondName,
+		Username:    u.Username,
+		DisplayName: u.DisplayName,
+		Bio:         u.Bio,
+		Role:        u.Role,
+		Service:     u.Service,
+	}
+	if v, ok := requestorUser(viewer); ok && uuid.Equal(v.Uuid, u.Uuid) {
+		return selfUser{publicUser: p, Approved: u.Approved, Email: u.Email}
+	}
+	return p
+}
+
+func publicSearch(r entities.SearchResult) publicSearchResult {
+	p := publicSearchResult{
+		Kind:     r.Kind,
+		Id:       r.Id,
+		ThreadId: r.ThreadId,
+		Created:  r.Created,
+		Snippet:  snippetHTML(r.Snippet),
+		Rank:     r.Rank,
+	}
+	if r.Kind == entities.SearchMessage {
+		p.AuthorId = &r.AuthorId
+	}
+	return p
+}
+
+// snippetHTML escapes a snippet from the backend, turning its marked
+// matches into <mark> elements. Stray marks are dropped, so that the
+// elements are always balanced
+func snippetHTML(snippet string) string {
+	var b strings.Builder
+	marked := false
+	for {
+		i := strings.IndexAny(snippet, backend.SnippetStart+backend.SnippetEnd)
+		if i == -1 {
+			break
+		}
+		b.WriteString(html.EscapeString(snippet[:i]))
+		start := snippet[i:i+1] == backend.SnippetStart
+		if start && !marked {
+			b.WriteString("<mark>")
+			marked = true
+		} else if !start && marked {
+			b.WriteString("</mark>")
+			marked = false
+		}
+		snippet = snippet[i+1:]
+	}
+	b.WriteString(html.EscapeString(snippet))
+	if marked {
+		b.WriteString("</mark>")
+	}
+	return b.String()
+}
+
+// project returns the representation of e to be sent to viewer
+func project(viewer entitycoll.Entity, e entitycoll.Entity) (entitycoll.Entity, error) {
+	switch e := e.(type) {
+	case *user:
+		return projectUser(viewer, (*entities.User)(e)), nil
+	case *entities.User:
+		return projectUser(viewer, e), nil
+	case entities.User:
+		return projectUser(viewer, &e), nil
+	case *entities.Thread:
+		return publicThread(*e), nil
+	case entities.Thread:
+		return publicThread(e), nil
+	case *entities.Message:
+		return publicMessage(*e), nil
+	case entities.Message:
+		return publicMessage(e), nil
+	case *entities.Webhook:
+		return publicWebhook(*e), nil
+	case entities.Webhook:
+		return publicWebhook(e), nil
+	case *entities.WebhookDelivery:
+		return publicWebhookDelivery(*e), nil
+	case entities.WebhookDelivery:
+		return publicWebhookDelivery(e), nil
+	case entities.SearchResult:
+		return publicSearch(e), nil
+	}
+	return nil, errNoProjection
+}
+
+func projectAll(viewer entitycoll.Entity, es []entitycoll.Entity) ([]entitycoll.Entity, error) {
+	projected := make([]entitycoll.Entity, len(es))
+	for i, e := range es {
+		p, err := project(viewer, e)
+		if err != nil {
+			return nil, err
+		}
+		projected[i] = p
+	}
+	return projected, nil
+}
+
+// projectedCollection is registered with entitycoll around each
+// collection, so that entities are only ever sent in their public
+// representation
+type projectedCollection struct {
+	entitycoll.EntityCollection
+}
+
+func (pc projectedCollection) GetEntity(requestor entitycoll.Entity, targetUuid uuid.UUID) (entitycoll.Entity, error) {
+	e, err := pc.EntityCollection.GetEntity(requestor, targetUuid)
+	if err != nil {
+		return nil, err
+	}
+	return project(requestor, e)
+}
+
+func (pc projectedCollection) GetCollection(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID, filter entitycoll.CollFilter) (entitycoll.Collection, error) {
+	c, err := pc.EntityCollection.GetCollection(requestor, parentEntityUuids, filter)
+	if err != nil {
+		return entitycoll.Collection{}, err
+	}
+	c.Entities, err = projectAll(requestor, c.Entities)
+	return c, err
+}
@@ -0,0 +1,175 @@
+// Package pwhash hashes and checks passwords. Hashes describe how they
+// were made, bcrypt in its own "$2a$<cost>$" form and argon2id in the
+// PHC string format ("$argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$
+// <salt>$<key>"), so that new hashes can be made differently while
+// older ones still check, and be upgraded when they do
+package pwhash
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// the algorithms new hashes can be made with
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// the longest passwords hashed, bcrypt ignoring anything past 72 bytes
+// and argon2id being bounded only to bound the work of hashing
+const (
+	bcryptMaxPasswordLen = 72
+	argon2MaxPasswordLen = 1024
+)
+
+var (
+	ErrMismatch      = errors.New("password does not match hash")
+	ErrUnknownFormat = errors.New("unknown password hash format")
+)
+
+// Params are how new hashes are made
+type Params struct {
+	Algorithm  string
+	BcryptCost int
+	// Argon2Memory is in KiB
+	Argon2Time    uint32
+	Argon2Memory  uint32
+	Argon2Threads uint8
+}
+
+// Validate checks that p describes hashes that can be made
+func (p Params) Validate() error {
+	switch p.Algorithm {
+	case Bcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be %d to %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case Argon2id:
+		if p.Argon2Time < 1 || p.Argon2Threads < 1 || p.Argon2Memory < 8*uint32(p.Argon2Threads) {
+			return errors.New("argon2id needs a time and threads of at least 1, and 8KiB of memory per thread")
+		}
+	default:
+		return fmt.Errorf("unknown password hash algorithm %q", p.Algorithm)
+	}
+	return nil
+}
+
+// MaxPasswordLen is the length in bytes of the longest password p can
+// hash
+func (p Params) MaxPasswordLen() int {
+	if p.Algorithm == Bcrypt {
+		return bcryptMaxPasswordLen
+	}
+	return argon2MaxPasswordLen
+}
+
+// Hash returns a new hash of pwd made as p says
+func Hash(p Params, pwd []byte) ([]byte, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if p.Algorithm == Bcrypt {
+		return bcrypt.GenerateFromPassword(pwd, p.BcryptCost)
+	}
+
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey(pwd, salt, p.Argon2Time, p.Argon2Memory, p.Argon2Threads, argon2KeyLen)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Argon2Memory, p.Argon2Time, p.Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// argon2Hash is a parsed argon2id hash
+type argon2Hash struct {
+	version int
+	params  Params
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2(hash []byte) (*argon2Hash, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != Argon2id {
+		return nil, ErrUnknownFormat
+	}
+
+	h := argon2Hash{params: Params{Algorithm: Argon2id}}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &h.version); err != nil || h.version != argon2.Version {
+		return nil, ErrUnknownFormat
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.params.Argon2Memory, &h.params.Argon2Time, &h.params.Argon2Threads)
+	if err != nil || h.params.Validate() != nil {
+		return nil, ErrUnknownFormat
+	}
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrUnknownFormat
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, ErrUnknownFormat
+	}
+	return &h, nil
+}
+
+func isBcrypt(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$2"))
+}
+
+// Check returns nil if pwd is the password hash was made from,
+// ErrMismatch if it is not, or another error if hash cannot be read
+func Check(hash, pwd []byte) error {
+	if isBcrypt(hash) {
+		err := bcrypt.CompareHashAndPassword(hash, pwd)
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrMismatch
+		}
+		return err
+	}
+
+	h, err := parseArgon2(hash)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey(pwd, h.salt, h.params.Argon2Time, h.params.Argon2Memory, h.params.Argon2Threads, uint32(len(h.key)))
+	if subtle.ConstantTimeCompare(key, h.key) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// NeedsRehash reports whether hash was made differently to how p
+// makes new hashes. Hashes that cannot be read are left alone, as they
+// can never be checked to rehash them
+func NeedsRehash(p Params, hash []byte) bool {
+	if isBcrypt(hash) {
+		cost, err := bcrypt.Cost(hash)
+		return err == nil && (p.Algorithm != Bcrypt || cost != p.BcryptCost)
+	}
+
+	h, err := parseArgon2(hash)
+	if err != nil {
+		return false
+	}
+	return p.Algorithm != Argon2id ||
+		h.params.Argon2Time != p.Argon2Time ||
+		h.params.Argon2Memory != p.Argon2Memory ||
+		h.params.Argon2Threads != p.Argon2Threads ||
+		len(h.salt) != argon2SaltLen ||
+		len(h.key) != argon2KeyLen
+}
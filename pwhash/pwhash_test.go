@@ -0,0 +1,92 @@
+package pwhash
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+// cheap parameters, so that the tests run quickly
+var (
+	bcryptMin    = Params{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost}
+	bcryptMore   = Params{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost + 1}
+	argon2Small  = Params{Algorithm: Argon2id, Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 1}
+	argon2Longer = Params{Algorithm: Argon2id, Argon2Time: 2, Argon2Memory: 64, Argon2Threads: 1}
+	argon2Bigger = Params{Algorithm: Argon2id, Argon2Time: 1, Argon2Memory: 128, Argon2Threads: 1}
+	argon2Wider  = Params{Algorithm: Argon2id, Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 2}
+)
+
+func TestNeedsRehash(t *testing.T) {
+	tests := []struct {
+		name string
+		made Params
+		now  Params
+		want bool
+	}{
+		{"bcrypt unchanged", bcryptMin, bcryptMin, false},
+		{"bcrypt cost changed", bcryptMin, bcryptMore, true},
+		{"bcrypt to argon2id", bcryptMin, argon2Small, true},
+		{"argon2id unchanged", argon2Small, argon2Small, false},
+		{"argon2id time changed", argon2Small, argon2Longer, true},
+		{"argon2id memory changed", argon2Small, argon2Bigger, true},
+		{"argon2id threads changed", argon2Small, argon2Wider, true},
+		{"argon2id to bcrypt", argon2Small, bcryptMin, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hash, err := Hash(test.made, []byte("password"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := NeedsRehash(test.now, hash); got != test.want {
+				t.Fatalf("NeedsRehash = %v, want %v for %s", got, test.want, hash)
+			}
+			if err = Check(hash, []byte("password")); err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			if err = Check(hash, []byte("passwore")); err != ErrMismatch {
+				t.Fatalf("Check of the wrong password: %v", err)
+			}
+		})
+	}
+}
+
+func TestNeedsRehashUnreadable(t *testing.T) {
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"empty", ""},
+		{"plain text", "password"},
+		{"bad bcrypt", "$2a$xx$"},
+		{"unknown algorithm", "$scrypt$ln=15,r=8,p=1$c2FsdA$a2V5"},
+		{"argon2 bad version", "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"},
+		{"argon2 bad params", "$argon2id$v=19$m=0,t=0,p=0$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"},
+		{"argon2 bad salt", "$argon2id$v=19$m=64,t=1,p=1$!!$a2V5"},
+		{"argon2 no key", "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, p := range []Params{bcryptMin, argon2Small} {
+				if NeedsRehash(p, []byte(test.hash)) {
+					t.Fatalf("unreadable hash %q needs rehash for %s", test.hash, p.Algorithm)
+				}
+			}
+			if Check([]byte(test.hash), []byte("password")) == nil {
+				t.Fatalf("unreadable hash %q checks", test.hash)
+			}
+		})
+	}
+}
+
+func TestMaxPasswordLen(t *testing.T) {
+	long := make([]byte, bcryptMaxPasswordLen+1)
+	for i := range long {
+		long[i] = 'a'
+	}
+	if _, err := Hash(argon2Small, long); err != nil {
+		t.Fatalf("argon2id hash of %d bytes: %v", len(long), err)
+	}
+	if bcryptMin.MaxPasswordLen() != bcryptMaxPasswordLen || argon2Small.MaxPasswordLen() < len(long) {
+		t.Fatalf("bcrypt allows %d bytes, argon2id %d", bcryptMin.MaxPasswordLen(), argon2Small.MaxPasswordLen())
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/john-sharp/jerver/entities"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// the registration modes, set by the Registration setting
+const (
+	registrationClosed   = "closed"
+	registrationOpen     = "open"
+	registrationInvite   = "invite"
+	registrationApproval = "approval"
+)
+
+// registration is the body of a POST to /users
+type registration struct {
+	FirstName  string
+	SecondName string
+	Username   string
+	Password   string
+	// Email is optional, but without it the password cannot be reset
+	Email string
+	// InviteCode is needed when registration is by invite
+	InviteCode string
+}
+
+var usernameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+const (
+	minPasswordLen = 8
+	maxNameLen     = 100
+	maxEmailLen    = 254
+)
+
+// validatePassword checks pwd as a new password for the user uname,
+// the longest allowed depending on the PasswordHash setting
+func validatePassword(uname, pwd string) error {
+	maxLen := conf.passwordHashParams().MaxPasswordLen()
+	if len(pwd) < minPasswordLen || len(pwd) > maxLen {
+		return entities.NewError(entities.Validation, fmt.Sprintf("password must be %d to %d bytes long", minPasswordLen, maxLen))
+	}
+	if strings.EqualFold(pwd, uname) {
+		return entities.NewError(entities.Validation, "password must not be the username")
+	}
+	return nil
+}
+
+// validateEmail accepts a bare address, such as user@example.com
+func validateEmail(email string) error {
+	a, err := mail.ParseAddress(email)
+	if err != nil || a.Address != email || len(email) > maxEmailLen {
+		return entities.NewError(entities.Validation, "malformed email address")
+	}
+	return nil
+}
+
+func (r *registration) validate() error {
+	if !usernameRegexp.MatchString(r.Username) {
+		return entities.NewError(entities.Validation, "username must be 3 to 32 letters, digits, '_', '.' or '-'")
+	}
+	if err := validatePassword(r.Username, r.Password); err != nil {
+		return err
+	}
+	if r.Email != "" {
+		if err := validateEmail(r.Email); err != nil {
+			return err
+		}
+	}
+	if utf8.RuneCountInString(r.FirstName) > maxNameLen || utf8.RuneCountInString(r.SecondName) > maxNameLen {
+		return entities.NewError(entities.Validation, "names must be at most 100 characters")
+	}
+	return nil
+}
+
+// register creates a user from a registration body, as allowed by the
+// configured registration mode, and returns its path
+func (uc *userCollection) register(ctx context.Context, body []byte) (string, error) {
+	if conf.Registration == registrationClosed {
+		return "", entities.NewError(entities.Forbidden, "registration is closed")
+	}
+
+	var r registration
+	if err := json.Unmarshal(body, &r); err != nil {
+		return "", entities.WrapError(entities.Validation, "malformed registration", err)
+	}
+	if err := r.validate(); err != nil {
+		return "", err
+	}
+
+	inviteCode := ""
+	if conf.Registration == registrationInvite {
+		if r.InviteCode == "" {
+			return "", entities.NewError(entities.Validation, "an invite code is needed to register")
+		}
+		inviteCode = r.InviteCode
+	}
+
+	var u user
+	if err := u.popNew(r.FirstName, r.SecondName, r.Username, r.Password); err != nil {
+		return "", err
+	}
+	u.Approved = conf.Registration != registrationApproval
+	u.Role = entities.RoleMember
+	u.Email = r.Email
+
+	if err := uc.createUser(ctx, &u, inviteCode); err != nil {
+		return "", err
+	}
+
+	return "/" + uc.GetRestName() + "/" + u.Uuid.String(), nil
+}
+
+// registrationHandler serves POSTs to /users. entitycoll asks for
+// credentials on every request, which someone registering does not yet
+// have, so these never reach it
+func registrationHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || strings.Trim(r.URL.Path, "/") != users.GetRestName() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Access-Control-Allow-Origin", conf.AllowOrigin)
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+		if err != nil {
+			writeError(w, entities.WrapError(entities.Validation, "registration too large", err))
+			return
+		}
+
+		path, err := users.register(r.Context(), body)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Location", path)
+		w.WriteHeader(http.StatusCreated)
+	})
+}
+
+// newInviteCode returns a random code for registering by invite
+func newInviteCode() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
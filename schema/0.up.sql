@@ -0,0 +1,28 @@
+-- the pgsql database and role are created once by an administrator,
+-- e.g. `createdb jerver` and `CREATE ROLE jerver WITH LOGIN`, after
+-- which jerver applies its migrations itself
+
+CREATE TABLE users (
+   Uuid {{.Uuid}} NOT NULL PRIMARY KEY, 
+   FirstName text,
+   SecondName text,
+   Username text,
+   HashedPwd {{.Bytes}});
+
+
+CREATE TABLE threads (
+   Uuid {{.Uuid}} NOT NULL PRIMARY KEY, 
+   Title text);
+
+CREATE TABLE messages (
+   Uuid {{.Uuid}} NOT NULL PRIMARY KEY,
+   ThreadId {{.Uuid}} NOT NULL,
+   AuthorId {{.Uuid}} NOT NULL,
+   Content text,
+   FOREIGN KEY(ThreadId) REFERENCES threads(Uuid),
+   FOREIGN KEY(AuthorId) REFERENCES users(Uuid));
+{{if .Pgsql}}
+GRANT SELECT, INSERT, UPDATE, DELETE
+ON ALL TABLES IN SCHEMA public 
+TO jerver;
+{{end}}
@@ -0,0 +1,5 @@
+DROP INDEX messages_thread_created_idx;
+DROP INDEX threads_created_idx;
+
+ALTER TABLE messages DROP COLUMN Created;
+ALTER TABLE threads DROP COLUMN Created;
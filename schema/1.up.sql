@@ -0,0 +1,16 @@
+-- creation times give threads and messages a stable order, ties are
+-- broken by Uuid so that (Created, Uuid) can be used as a keyset
+{{if .Pgsql}}
+ALTER TABLE threads ADD COLUMN Created timestamptz NOT NULL DEFAULT now();
+ALTER TABLE messages ADD COLUMN Created timestamptz NOT NULL DEFAULT now();
+{{else}}
+-- sqlite only allows constant defaults for added columns, so existing
+-- rows are given the current time afterwards
+ALTER TABLE threads ADD COLUMN Created timestamp NOT NULL DEFAULT '1970-01-01 00:00:00';
+ALTER TABLE messages ADD COLUMN Created timestamp NOT NULL DEFAULT '1970-01-01 00:00:00';
+
+UPDATE threads SET Created = datetime('now');
+UPDATE messages SET Created = datetime('now');
+{{end}}
+CREATE INDEX threads_created_idx ON threads (Created, Uuid);
+CREATE INDEX messages_thread_created_idx ON messages (ThreadId, Created, Uuid);
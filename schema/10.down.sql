@@ -0,0 +1,3 @@
+DROP TABLE webhookDeliveries;
+
+DROP TABLE webhooks;
@@ -0,0 +1,32 @@
+-- webhooks post the events named in Events, comma separated, to Url
+-- signed with Secret
+CREATE TABLE webhooks (
+   Id {{.Uuid}} NOT NULL PRIMARY KEY,
+   Url text NOT NULL,
+   Secret text NOT NULL,
+   Events text NOT NULL,
+   Created {{.Time}} NOT NULL);
+
+-- the log of posting events to webhooks. Each event is delivered once
+-- to each webhook however many instances of the server receive it, as
+-- only the first to insert the delivery sends it
+CREATE TABLE webhookDeliveries (
+   Id {{.Uuid}} NOT NULL PRIMARY KEY,
+   WebhookId {{.Uuid}} NOT NULL,
+   EventId {{.Uuid}} NOT NULL,
+   Event text NOT NULL,
+   Payload text NOT NULL,
+   Status text NOT NULL,
+   Attempts integer NOT NULL DEFAULT 0,
+   ResponseStatus integer NOT NULL DEFAULT 0,
+   Error text NOT NULL DEFAULT '',
+   Created {{.Time}} NOT NULL,
+   Updated {{.Time}} NOT NULL,
+   UNIQUE (WebhookId, EventId),
+   FOREIGN KEY(WebhookId) REFERENCES webhooks(Id));
+
+CREATE INDEX webhookDeliveries_webhook_idx ON webhookDeliveries (WebhookId, Created);
+{{if .Pgsql}}
+GRANT SELECT, INSERT, UPDATE, DELETE ON webhooks TO jerver;
+GRANT SELECT, INSERT, UPDATE, DELETE ON webhookDeliveries TO jerver;
+{{end}}
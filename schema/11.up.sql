@@ -0,0 +1,19 @@
+-- jobs queued to run in the background, see entities.Job. Workers take
+-- the pending job due soonest, or a running one whose lease has ended
+CREATE TABLE jobs (
+   Id {{.Uuid}} NOT NULL PRIMARY KEY,
+   Kind text NOT NULL,
+   Payload text NOT NULL,
+   Status text NOT NULL,
+   Attempts integer NOT NULL DEFAULT 0,
+   MaxAttempts integer NOT NULL,
+   Error text NOT NULL DEFAULT '',
+   RunAt {{.Time}} NOT NULL,
+   LockedUntil {{.Time}} NOT NULL,
+   Created {{.Time}} NOT NULL,
+   Updated {{.Time}} NOT NULL);
+
+CREATE INDEX jobs_due_idx ON jobs (Status, RunAt);
+{{if .Pgsql}}
+GRANT SELECT, INSERT, UPDATE, DELETE ON jobs TO jerver;
+{{end}}
@@ -0,0 +1,16 @@
+{{if .Pgsql}}
+ALTER TABLE threads DROP COLUMN SearchVector;
+ALTER TABLE messages DROP COLUMN SearchVector;
+{{else}}
+DROP TRIGGER threads_search_update;
+DROP TRIGGER threads_search_delete;
+DROP TRIGGER threads_search_insert;
+DROP TRIGGER messages_search_update;
+DROP TRIGGER messages_search_delete;
+DROP TRIGGER messages_search_insert;
+
+DROP TABLE threadsSearch;
+DROP TABLE messagesSearch;
+DROP TABLE threadsSearchIds;
+DROP TABLE messagesSearchIds;
+{{end}}
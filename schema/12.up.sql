@@ -0,0 +1,65 @@
+-- full-text search of message contents and thread titles, kept up to
+-- date by the database itself as messages and threads change
+{{if .Pgsql}}
+ALTER TABLE messages ADD COLUMN SearchVector tsvector
+    GENERATED ALWAYS AS (to_tsvector('english', coalesce(Content, ''))) STORED;
+ALTER TABLE threads ADD COLUMN SearchVector tsvector
+    GENERATED ALWAYS AS (to_tsvector('english', coalesce(Title, ''))) STORED;
+
+CREATE INDEX messages_search_idx ON messages USING GIN (SearchVector);
+CREATE INDEX threads_search_idx ON threads USING GIN (SearchVector);
+{{else}}
+-- FTS5 indexes of message contents and thread titles. Their rowids are
+-- those of the ...SearchIds tables, which map them to the Uuids of the
+-- messages and threads: being INTEGER PRIMARY KEYs they are kept by
+-- VACUUM, which may renumber the implicit rowids of messages and
+-- threads
+CREATE TABLE messagesSearchIds (
+   Rowid INTEGER PRIMARY KEY,
+   Uuid {{.Uuid}} NOT NULL UNIQUE);
+CREATE TABLE threadsSearchIds (
+   Rowid INTEGER PRIMARY KEY,
+   Uuid {{.Uuid}} NOT NULL UNIQUE);
+
+CREATE VIRTUAL TABLE messagesSearch USING fts5 (
+   Content, tokenize='porter unicode61');
+CREATE VIRTUAL TABLE threadsSearch USING fts5 (
+   Title, tokenize='porter unicode61');
+
+CREATE TRIGGER messages_search_insert AFTER INSERT ON messages BEGIN
+    INSERT INTO messagesSearchIds (Uuid) VALUES (new.Uuid);
+    INSERT INTO messagesSearch (rowid, Content)
+        SELECT Rowid, new.Content FROM messagesSearchIds WHERE Uuid = new.Uuid;
+END;
+CREATE TRIGGER messages_search_delete AFTER DELETE ON messages BEGIN
+    DELETE FROM messagesSearch
+        WHERE rowid = (SELECT Rowid FROM messagesSearchIds WHERE Uuid = old.Uuid);
+    DELETE FROM messagesSearchIds WHERE Uuid = old.Uuid;
+END;
+CREATE TRIGGER messages_search_update AFTER UPDATE OF Content ON messages BEGIN
+    UPDATE messagesSearch SET Content = new.Content
+        WHERE rowid = (SELECT Rowid FROM messagesSearchIds WHERE Uuid = new.Uuid);
+END;
+
+CREATE TRIGGER threads_search_insert AFTER INSERT ON threads BEGIN
+    INSERT INTO threadsSearchIds (Uuid) VALUES (new.Uuid);
+    INSERT INTO threadsSearch (rowid, Title)
+        SELECT Rowid, new.Title FROM threadsSearchIds WHERE Uuid = new.Uuid;
+END;
+CREATE TRIGGER threads_search_delete AFTER DELETE ON threads BEGIN
+    DELETE FROM threadsSearch
+        WHERE rowid = (SELECT Rowid FROM threadsSearchIds WHERE Uuid = old.Uuid);
+    DELETE FROM threadsSearchIds WHERE Uuid = old.Uuid;
+END;
+CREATE TRIGGER threads_search_update AFTER UPDATE OF Title ON threads BEGIN
+    UPDATE threadsSearch SET Title = new.Title
+        WHERE rowid = (SELECT Rowid FROM threadsSearchIds WHERE Uuid = new.Uuid);
+END;
+
+INSERT INTO messagesSearchIds (Uuid) SELECT Uuid FROM messages;
+INSERT INTO messagesSearch (rowid, Content)
+    SELECT i.Rowid, m.Content FROM messages m JOIN messagesSearchIds i ON i.Uuid = m.Uuid;
+INSERT INTO threadsSearchIds (Uuid) SELECT Uuid FROM threads;
+INSERT INTO threadsSearch (rowid, Title)
+    SELECT i.Rowid, t.Title FROM threads t JOIN threadsSearchIds i ON i.Uuid = t.Uuid;
+{{end}}
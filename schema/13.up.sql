@@ -0,0 +1,3 @@
+-- bumped whenever the password of the user changes, access tokens
+-- carrying an older generation no longer being accepted
+ALTER TABLE users ADD COLUMN TokenGeneration integer NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE threads DROP COLUMN LastMsgTime;
+ALTER TABLE threads DROP COLUMN NumMsgs;
@@ -0,0 +1,9 @@
+-- message count and time of latest message of each thread, kept up
+-- to date by the backend whenever messages are created, deleted or
+-- moved between threads
+ALTER TABLE threads ADD COLUMN NumMsgs integer NOT NULL DEFAULT 0;
+ALTER TABLE threads ADD COLUMN LastMsgTime {{.Time}};
+
+UPDATE threads SET
+    NumMsgs = (SELECT count(*) FROM messages WHERE messages.ThreadId = threads.Uuid),
+    LastMsgTime = (SELECT max(Created) FROM messages WHERE messages.ThreadId = threads.Uuid);
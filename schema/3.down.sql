@@ -0,0 +1,5 @@
+DROP TABLE invites;
+
+ALTER TABLE users DROP COLUMN Approved;
+
+DROP INDEX users_username_idx;
@@ -0,0 +1,18 @@
+-- usernames are unique regardless of case, registration relies on
+-- this rather than checking before inserting
+CREATE UNIQUE INDEX users_username_idx ON users (lower(Username));
+
+-- users registered while registration needs admin approval cannot log
+-- in until approved
+ALTER TABLE users ADD COLUMN Approved boolean NOT NULL DEFAULT true;
+
+-- single use codes handed out by admins for registering when
+-- registration is by invite
+CREATE TABLE invites (
+   Code text NOT NULL PRIMARY KEY,
+   Created {{.Time}} NOT NULL,
+   UsedBy {{.Uuid}},
+   FOREIGN KEY(UsedBy) REFERENCES users(Uuid));
+{{if .Pgsql}}
+GRANT SELECT, INSERT, UPDATE, DELETE ON invites TO jerver;
+{{end}}
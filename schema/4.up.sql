@@ -0,0 +1,13 @@
+-- refresh token sessions, Id is the hex SHA-256 of the refresh token
+-- so that the tokens themselves are never stored
+CREATE TABLE sessions (
+   Id text NOT NULL PRIMARY KEY,
+   UserId {{.Uuid}} NOT NULL,
+   Created {{.Time}} NOT NULL,
+   Expires {{.Time}} NOT NULL,
+   FOREIGN KEY(UserId) REFERENCES users(Uuid));
+
+CREATE INDEX sessions_user_idx ON sessions (UserId);
+{{if .Pgsql}}
+GRANT SELECT, INSERT, UPDATE, DELETE ON sessions TO jerver;
+{{end}}
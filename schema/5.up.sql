@@ -0,0 +1,3 @@
+-- admin, moderator, member or read-only, what each may do is set out
+-- by the permissions table of the server
+ALTER TABLE users ADD COLUMN Role text NOT NULL DEFAULT 'member';
@@ -0,0 +1,11 @@
+-- failed logins and lockouts, kept for auditing attempts on accounts
+CREATE TABLE securityEvents (
+   Kind text NOT NULL,
+   Username text NOT NULL,
+   RemoteAddr text NOT NULL,
+   Created {{.Time}} NOT NULL);
+
+CREATE INDEX securityEvents_created_idx ON securityEvents (Created);
+{{if .Pgsql}}
+GRANT SELECT, INSERT, UPDATE, DELETE ON securityEvents TO jerver;
+{{end}}
@@ -0,0 +1,3 @@
+DROP TABLE passwordResets;
+
+ALTER TABLE users DROP COLUMN Email;
@@ -0,0 +1,16 @@
+-- where password reset tokens are sent, empty if the user gave none
+ALTER TABLE users ADD COLUMN Email text NOT NULL DEFAULT '';
+
+-- outstanding password resets, Id is the hex SHA-256 of the reset
+-- token so that the tokens themselves are never stored
+CREATE TABLE passwordResets (
+   Id text NOT NULL PRIMARY KEY,
+   UserId {{.Uuid}} NOT NULL,
+   Created {{.Time}} NOT NULL,
+   Expires {{.Time}} NOT NULL,
+   FOREIGN KEY(UserId) REFERENCES users(Uuid));
+
+CREATE INDEX passwordResets_user_idx ON passwordResets (UserId);
+{{if .Pgsql}}
+GRANT SELECT, INSERT, UPDATE, DELETE ON passwordResets TO jerver;
+{{end}}
@@ -0,0 +1,6 @@
+{{if .Pgsql}}
+DROP INDEX users_username_prefix_idx;
+{{end}}
+ALTER TABLE users DROP COLUMN Bio;
+
+ALTER TABLE users DROP COLUMN DisplayName;
@@ -0,0 +1,8 @@
+ALTER TABLE users ADD COLUMN DisplayName text NOT NULL DEFAULT '';
+
+ALTER TABLE users ADD COLUMN Bio text NOT NULL DEFAULT '';
+{{if .Pgsql}}
+-- lets username prefix searches, lower(Username) LIKE 'ab%', use an
+-- index whatever the collation of the database
+CREATE INDEX users_username_prefix_idx ON users (lower(Username) text_pattern_ops);
+{{end}}
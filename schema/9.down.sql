@@ -0,0 +1,3 @@
+DROP TABLE apiKeys;
+
+ALTER TABLE users DROP COLUMN Service;
@@ -0,0 +1,21 @@
+-- service accounts are used by integrations through API keys, and
+-- cannot log in with a password
+ALTER TABLE users ADD COLUMN Service boolean NOT NULL DEFAULT false;
+
+-- API keys of service accounts, Id is the hex SHA-256 of the key so
+-- that the keys themselves are never stored. Scope is "full", "read"
+-- or "post", Threads the comma separated threads a "post" key is
+-- limited to (empty for any), and Expires NULL for keys that never do
+CREATE TABLE apiKeys (
+   Id text NOT NULL PRIMARY KEY,
+   UserId {{.Uuid}} NOT NULL,
+   Name text NOT NULL,
+   Scope text NOT NULL,
+   Threads text NOT NULL DEFAULT '',
+   Created {{.Time}} NOT NULL,
+   Expires {{.Time}},
+   UNIQUE (UserId, Name),
+   FOREIGN KEY(UserId) REFERENCES users(Uuid));
+{{if .Pgsql}}
+GRANT SELECT, INSERT, UPDATE, DELETE ON apiKeys TO jerver;
+{{end}}
@@ -0,0 +1,60 @@
+// Package schema holds the migrations of jerver's database schema,
+// shared by the pgsql and sqlite backends. The migrations are
+// text/template files into which the column types, and any statements,
+// that differ between the databases are filled for each Dialect
+package schema
+
+import (
+	"bytes"
+	"embed"
+	"github.com/john-sharp/jerver/migrate"
+	"text/template"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// Dialect is what the migrations are rendered with
+type Dialect struct {
+	Pgsql bool
+	Uuid  string
+	Bytes string
+	Time  string
+}
+
+var Pgsql = Dialect{Pgsql: true, Uuid: "uuid", Bytes: "bytea", Time: "timestamptz"}
+
+// Sqlite uses the timestamp type as it is the one go-sqlite3 reads
+// back as a time.Time
+var Sqlite = Dialect{Uuid: "blob", Bytes: "blob", Time: "timestamp"}
+
+// Migrations returns the migrations rendered for d
+func Migrations(d Dialect) ([]migrate.Migration, error) {
+	migrations, err := migrate.Load(files, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range migrations {
+		if migrations[i].Up, err = render(migrations[i].Up, d); err != nil {
+			return nil, err
+		}
+		if migrations[i].Down, err = render(migrations[i].Down, d); err != nil {
+			return nil, err
+		}
+	}
+	return migrations, nil
+}
+
+func render(text string, d Dialect) (string, error) {
+	t, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err = t.Execute(&b, d); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"gitlab.com/johncolinsharp/entitycoll"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// bounds on searches, so that they stay cheap to run
+const (
+	maxSearchLen   = 256
+	maxSearchTerms = 16
+)
+
+var searches searchCollection
+
+// parseSearch reads the search made by the query of a request to
+// /search
+func parseSearch(ctx context.Context, query url.Values) (*backend.SearchQuery, error) {
+	text := query.Get("q")
+	if len(text) > maxSearchLen {
+		return nil, entities.NewError(entities.Validation, fmt.Sprintf("search is longer than %d characters", maxSearchLen))
+	}
+	q := &backend.SearchQuery{Terms: backend.SearchTerms(text), Messages: true, Threads: true}
+	if len(q.Terms) == 0 {
+		return nil, entities.NewError(entities.Validation, "search has no words to search for")
+	}
+	if len(q.Terms) > maxSearchTerms {
+		return nil, entities.NewError(entities.Validation, fmt.Sprintf("search has more than %d words", maxSearchTerms))
+	}
+
+	switch query.Get("in") {
+	case "":
+	case "messages":
+		q.Threads = false
+	case "threads":
+		q.Messages = false
+	default:
+		return nil, entities.NewError(entities.Validation, "in must be messages or threads")
+	}
+
+	if author := query.Get("author"); author != "" {
+		u, err := users.getUserByUsername(ctx, author)
+		if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+			return nil, entities.NewError(entities.Validation, "unknown author "+strconv.Quote(author))
+		}
+		if err != nil {
+			return nil, err
+		}
+		q.AuthorId = &u.Uuid
+	}
+	if thread := query.Get("thread"); thread != "" {
+		id, err := uuid.FromString(thread)
+		if err != nil {
+			return nil, entities.NewError(entities.Validation, "malformed thread id")
+		}
+		q.ThreadId = &id
+	}
+	for _, bound := range []struct {
+		name string
+		t    **time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if s := query.Get(bound.name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, entities.NewError(entities.Validation, bound.name+" must be an RFC 3339 time")
+			}
+			*bound.t = &t
+		}
+	}
+	return q, nil
+}
+
+// searchHandler serves GET /search, ranked full-text search of the
+// contents of messages and titles of threads. q is the text to search
+// for, every word of which must match, in any form. The search is
+// narrowed by
+//
+//	in      "messages" or "threads", to search only those
+//	author  username of the author of the messages, threads having none
+//	thread  id of the thread to search in
+//	since   RFC 3339 time the results were created at or after
+//	until   RFC 3339 time the results were created before
+//
+// and paged with page and count
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.Header().Add("Access-Control-Allow-Origin", conf.AllowOrigin)
+		w.Header().Add("Access-Control-Allow-Headers", "Authorization")
+		w.Header().Add("Access-Control-Allow-Methods", "GET")
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	serveRead(w, r, func(requestor entitycoll.Entity, count uint64, page int64) (interface{}, error) {
+		q, err := parseSearch(r.Context(), r.URL.Query())
+		if err == nil && q.Messages {
+			err = authorize(requestor, messages.GetRestName(), actionRead)
+		}
+		if err == nil && q.Threads {
+			err = authorize(requestor, threads.GetRestName(), actionRead)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var collection entitycoll.Collection
+		collection.Entities, err = searches.search(r.Context(), q, count, page)
+		if err == nil {
+			collection.TotalEntities, err = searches.total(r.Context(), q)
+		}
+		if err == nil {
+			collection.Entities, err = projectAll(requestor, collection.Entities)
+		}
+		return collection, err
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSearch(t *testing.T) {
+	testMemoryBackend(t)
+	ctx := context.Background()
+	author, err := users.getUserByUsername(ctx, "hasquith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread, _ := uuid.NewV4()
+	since := time.Date(1908, 4, 5, 0, 0, 0, 0, time.UTC)
+	until := time.Date(1916, 12, 5, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		query string
+		// want is nil when the search is malformed
+		want *backend.SearchQuery
+	}{
+		{"words", "q=Best+PM", &backend.SearchQuery{Terms: []string{"best", "pm"}, Messages: true, Threads: true}},
+		{"longest", "q=" + strings.Repeat("a", maxSearchLen), &backend.SearchQuery{Terms: []string{strings.Repeat("a", maxSearchLen)}, Messages: true, Threads: true}},
+		{"most words", "q=" + strings.Repeat("a+", maxSearchTerms), &backend.SearchQuery{Terms: strings.Fields(strings.Repeat("a ", maxSearchTerms)), Messages: true, Threads: true}},
+		{"messages", "q=pm&in=messages", &backend.SearchQuery{Terms: []string{"pm"}, Messages: true}},
+		{"threads", "q=pm&in=threads", &backend.SearchQuery{Terms: []string{"pm"}, Threads: true}},
+		{"author", "q=pm&author=hasquith", &backend.SearchQuery{Terms: []string{"pm"}, Messages: true, Threads: true, AuthorId: &author.Uuid}},
+		{"author any case", "q=pm&author=HAsquith", &backend.SearchQuery{Terms: []string{"pm"}, Messages: true, Threads: true, AuthorId: &author.Uuid}},
+		{"thread", "q=pm&thread=" + thread.String(), &backend.SearchQuery{Terms: []string{"pm"}, Messages: true, Threads: true, ThreadId: &thread}},
+		{"period", "q=pm&since=1908-04-05T00:00:00Z&until=1916-12-05T12:30:00Z", &backend.SearchQuery{Terms: []string{"pm"}, Messages: true, Threads: true, Since: &since, Until: &until}},
+
+		{"no q", "", nil},
+		{"empty q", "q=", nil},
+		{"no words", "q=+-%3F!", nil},
+		{"too long", "q=" + strings.Repeat("a", maxSearchLen+1), nil},
+		{"too many words", "q=" + strings.Repeat("a+", maxSearchTerms+1), nil},
+		{"bad in", "q=pm&in=users", nil},
+		{"unknown author", "q=pm&author=gladstone", nil},
+		{"bad thread", "q=pm&thread=1234", nil},
+		{"bad since", "q=pm&since=1908-04-05", nil},
+		{"bad until", "q=pm&until=yesterday", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q, err := parseSearch(ctx, query)
+			if test.want == nil {
+				if kind, _ := entities.ErrorKindOf(err); kind != entities.Validation {
+					t.Fatalf("got %+v, %v, want a validation error", q, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(q, test.want) {
+				t.Fatalf("got %+v, want %+v", q, test.want)
+			}
+		})
+	}
+}
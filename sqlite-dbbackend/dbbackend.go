@@ -1,211 +1,566 @@
+// Package dbbackend (sqlite-dbbackend) keeps users, threads and
+// messages in a sqlite database. Messages and threads are searched with
+// FTS5, which go-sqlite3 only includes when built with the sqlite_fts5
+// tag, as in `go build -tags sqlite_fts5`. Built without it the
+// backend fails to open with backend.ErrUnsupported
 package dbbackend
 
 import (
+	"context"
 	"database/sql"
+	"github.com/john-sharp/jerver/backend"
 	"github.com/john-sharp/jerver/entities"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/satori/go.uuid"
-	"log"
 	"strings"
+	"time"
 )
 
-var db *sql.DB
-var getMessageStmt *sql.Stmt
-var createMessageStmt *sql.Stmt
-var deleteMessageStmt *sql.Stmt
-var getThreadStmt *sql.Stmt
-var createThreadStmt *sql.Stmt
-var deleteThreadStmt *sql.Stmt
-var editThreadStmt *sql.Stmt
-var getUserByUnameStmt *sql.Stmt
-var getUserByUuidStmt *sql.Stmt
+// Backend implements backend.Backend on top of a sqlite database
+type Backend struct {
+	db                 *sql.DB
+	getMessageStmt     *sql.Stmt
+	createMessageStmt  *sql.Stmt
+	deleteMessageStmt  *sql.Stmt
+	getThreadStmt      *sql.Stmt
+	createThreadStmt   *sql.Stmt
+	deleteThreadStmt   *sql.Stmt
+	editThreadStmt     *sql.Stmt
+	addThreadMsgStmt   *sql.Stmt
+	dropThreadMsgStmt  *sql.Stmt
+	getUserByUnameStmt *sql.Stmt
+	getUserByUuidStmt  *sql.Stmt
+	createUserStmt     *sql.Stmt
+	approveUserStmt    *sql.Stmt
+	setUserRoleStmt    *sql.Stmt
+	setUserPwdStmt     *sql.Stmt
+	upgradeUserPwdStmt *sql.Stmt
+	createInviteStmt   *sql.Stmt
+	redeemInviteStmt   *sql.Stmt
+	createSessionStmt  *sql.Stmt
+	takeSessionStmt    *sql.Stmt
+	createResetStmt    *sql.Stmt
+	takeResetStmt      *sql.Stmt
+	getApiKeyStmt      *sql.Stmt
+	bus                *backend.Bus
+}
+
+// driverName is go-sqlite3 with foreign keys enforced, which sqlite
+// leaves off for each new connection unless asked
+const driverName = "sqlite3-jerver"
 
 func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec("PRAGMA foreign_keys = ON", nil)
+			return err
+		},
+	})
+}
+
+// Open connects to the database named by config.DataSource and
+// prepares the statements used by the Backend. Any failure is returned
+// rather than being fatal so that the caller can retry
+func Open(config backend.Config) (backend.Backend, error) {
 	var err error
+	b := &Backend{bus: backend.NewBus()}
 
-	db, err = sql.Open("sqlite3", "./jerver.db")
+	b.db, err = sql.Open(driverName, config.DataSource)
 	if err != nil {
-		log.Fatal(err)
+		b.bus.Close()
+		return nil, err
+	}
+
+	err = b.db.Ping()
+	if err == nil {
+		err = checkFts5(b.db)
+	}
+	if err == nil && config.Migrate {
+		err = b.migrate()
+	}
+	if err == nil {
+		err = b.messagePrepareStmts()
+	}
+	if err == nil {
+		err = b.threadPrepareStmts()
+	}
+	if err == nil {
+		err = b.userPrepareStatements()
+	}
+	if err == nil {
+		err = b.sessionPrepareStmts()
 	}
 
-	messagePrepareStmts()
-	threadPrepareStmts()
-	userPrepareStatements()
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// migrate applies any migrations the schema is missing
+func (b *Backend) migrate() error {
+	m, err := newMigrator(b.db)
+	if err != nil {
+		return err
+	}
+	return m.Up(context.Background())
+}
+
+func (b *Backend) Ping(ctx context.Context) error {
+	return b.db.PingContext(ctx)
 }
 
-func messagePrepareStmts() {
+// Close closes any statements that were prepared and then the
+// database handle itself
+func (b *Backend) Close() error {
+	stmts := []*sql.Stmt{
+		b.getMessageStmt,
+		b.createMessageStmt,
+		b.deleteMessageStmt,
+		b.getThreadStmt,
+		b.createThreadStmt,
+		b.deleteThreadStmt,
+		b.editThreadStmt,
+		b.addThreadMsgStmt,
+		b.dropThreadMsgStmt,
+		b.getUserByUnameStmt,
+		b.getUserByUuidStmt,
+		b.createUserStmt,
+		b.approveUserStmt,
+		b.setUserRoleStmt,
+		b.setUserPwdStmt,
+		b.upgradeUserPwdStmt,
+		b.createInviteStmt,
+		b.redeemInviteStmt,
+		b.createSessionStmt,
+		b.takeSessionStmt,
+		b.createResetStmt,
+		b.takeResetStmt,
+		b.getApiKeyStmt,
+	}
+	for _, stmt := range stmts {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+
+	b.bus.Close()
+	return b.db.Close()
+}
+
+// Subscribe is only for this process, each instance of the server
+// needs its own sqlite database
+func (b *Backend) Subscribe(handler func(backend.Event)) func() {
+	return b.bus.Subscribe(handler)
+}
+
+func (b *Backend) messagePrepareStmts() error {
 	var err error
-	getMessageStmt, err = db.Prepare(`
+	b.getMessageStmt, err = b.db.Prepare(`
 	SELECT
 	     Uuid,
 	     ThreadId,
 	     AuthorId,
-	     Content
+	     Content,
+	     Created
 	FROM messages
 	WHERE Uuid = ?`)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	createMessageStmt, err = db.Prepare(`
+	b.createMessageStmt, err = b.db.Prepare(`
     INSERT INTO messages (
         Uuid,
         ThreadId,
         AuthorId,
-        Content)
-    VALUES (?, ?, ?, ?)`)
+        Content,
+        Created)
+    VALUES (?, ?, ?, ?, ?)`)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	deleteMessageStmt, err = db.Prepare(`
+	b.deleteMessageStmt, err = b.db.Prepare(`
     DELETE FROM messages
     WHERE Uuid = ?
     `)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+
+	return nil
 }
 
-func threadPrepareStmts() {
+func (b *Backend) threadPrepareStmts() error {
 	var err error
 
-	getThreadStmt, err = db.Prepare(`
+	b.getThreadStmt, err = b.db.Prepare(`
     SELECT 
          Uuid,
-         Title
+         Title,
+         NumMsgs,
+         LastMsgTime,
+         Created
     FROM threads 
     WHERE Uuid = ?`)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	createThreadStmt, err = db.Prepare(`
+	b.createThreadStmt, err = b.db.Prepare(`
     INSERT INTO threads (
         Uuid,
-        Title )
-    VALUES (?, ?)`)
+        Title,
+        Created )
+    VALUES (?, ?, ?)`)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	editThreadStmt, err = db.Prepare(`
+	b.editThreadStmt, err = b.db.Prepare(`
     UPDATE threads SET Title=?
     WHERE Uuid = ?
     `)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	// NumMsgs and LastMsgTime are kept up to date as messages are
+	// added to and dropped from a thread, these are always run in the
+	// same transaction as the change to messages
+	b.addThreadMsgStmt, err = b.db.Prepare(`
+    UPDATE threads SET
+        NumMsgs = NumMsgs + 1,
+        LastMsgTime = max(coalesce(LastMsgTime, ?2), ?2)
+    WHERE Uuid = ?1
+    `)
+
+	if err != nil {
+		return err
+	}
+
+	b.dropThreadMsgStmt, err = b.db.Prepare(`
+    UPDATE threads SET
+        NumMsgs = NumMsgs - 1,
+        LastMsgTime = (SELECT max(Created) FROM messages WHERE ThreadId = ?1)
+    WHERE Uuid = ?1
+    `)
+
+	if err != nil {
+		return err
 	}
 
-	deleteThreadStmt, err = db.Prepare(`
+	b.deleteThreadStmt, err = b.db.Prepare(`
     DELETE FROM threads
     WHERE Uuid = ?
     `)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+
+	return nil
 }
 
-func userPrepareStatements() {
+func (b *Backend) userPrepareStatements() error {
 	var err error
-	getUserByUnameStmt, err = db.Prepare(`
+	b.getUserByUnameStmt, err = b.db.Prepare(`
     SELECT 
          Uuid,
          FirstName,
          SecondName,
          Username,
-         HashedPwd
+         HashedPwd,
+         Approved,
+         Role,
+         Email,
+         DisplayName,
+         Bio,
+         Service,
+         TokenGeneration
     FROM users 
-    WHERE Username = ?`)
+    WHERE lower(Username) = lower(?)`)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	getUserByUuidStmt, err = db.Prepare(`
+	b.getUserByUuidStmt, err = b.db.Prepare(`
     SELECT 
          Uuid,
          FirstName,
          SecondName,
          Username,
-         HashedPwd
+         HashedPwd,
+         Approved,
+         Role,
+         Email,
+         DisplayName,
+         Bio,
+         Service,
+         TokenGeneration
     FROM users 
     WHERE Uuid = ?`)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	b.createUserStmt, err = b.db.Prepare(`
+    INSERT INTO users (
+        Uuid,
+        FirstName,
+        SecondName,
+        Username,
+        HashedPwd,
+        Approved,
+        Role,
+        Email,
+        Service)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+
+	if err != nil {
+		return err
+	}
+
+	b.approveUserStmt, err = b.db.Prepare(`
+    UPDATE users SET
+        Approved = true
+    WHERE lower(Username) = lower(?)`)
+
+	if err != nil {
+		return err
+	}
+
+	b.setUserRoleStmt, err = b.db.Prepare(`
+    UPDATE users SET
+        Role = ?
+    WHERE Uuid = ?`)
+
+	if err != nil {
+		return err
 	}
+
+	b.setUserPwdStmt, err = b.db.Prepare(`
+    UPDATE users SET
+        HashedPwd = ?,
+        TokenGeneration = TokenGeneration + 1
+    WHERE Uuid = ?`)
+
+	if err != nil {
+		return err
+	}
+
+	b.upgradeUserPwdStmt, err = b.db.Prepare(`
+    UPDATE users SET
+        HashedPwd = ?
+    WHERE Uuid = ? AND HashedPwd = ?`)
+
+	if err != nil {
+		return err
+	}
+
+	b.createInviteStmt, err = b.db.Prepare(`
+    INSERT INTO invites (
+        Code,
+        Created)
+    VALUES (?, ?)`)
+
+	if err != nil {
+		return err
+	}
+
+	b.redeemInviteStmt, err = b.db.Prepare(`
+    UPDATE invites SET
+        UsedBy = ?
+    WHERE Code = ? AND UsedBy IS NULL`)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
-func GetMessageByUuid(targetUuid uuid.UUID) (*entities.Message, error) {
+func (b *Backend) GetMessageByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.Message, error) {
 	var m entities.Message
-	err := getMessageStmt.QueryRow(targetUuid.Bytes()).Scan(&m.Id, &m.ThreadId, &m.AuthorId, &m.Content)
+	err := b.getMessageStmt.QueryRowContext(ctx, targetUuid.Bytes()).Scan(&m.Id, &m.ThreadId, &m.AuthorId, &m.Content, &m.Created)
 
 	if err != nil {
-		return nil, err
+		return nil, translateError(err, "message")
 	}
 	return &m, nil
 }
 
-func CreateMessage(m *entities.Message) error {
-	_, err := createMessageStmt.Exec(
+func (b *Backend) CreateMessage(ctx context.Context, m *entities.Message) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err, "message")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.StmtContext(ctx, b.createMessageStmt).ExecContext(ctx,
 		m.Id.Bytes(),
 		m.ThreadId.Bytes(),
 		m.AuthorId.Bytes(),
-		m.Content)
+		m.Content,
+		m.Created.UTC())
+
+	if err != nil {
+		return translateRefError(err, "message")
+	}
+
+	res, err := tx.StmtContext(ctx, b.addThreadMsgStmt).ExecContext(ctx, m.ThreadId.Bytes(), m.Created.UTC())
+	if err != nil {
+		return translateError(err, "message")
+	}
+	if err = checkAffected(res, "thread"); err != nil {
+		return entities.WrapError(entities.Validation, "message refers to a thread that does not exist", err)
+	}
 
-	return err
+	if err = tx.Commit(); err != nil {
+		return translateError(err, "message")
+	}
+	b.bus.Publish(backend.Event{Type: backend.MessageCreated, ThreadId: m.ThreadId, MessageId: m.Id})
+	return nil
 }
 
-func DeleteMessageByUuid(targetUuid uuid.UUID) error {
-	_, err := deleteMessageStmt.Exec(targetUuid.Bytes())
-	return err
+func (b *Backend) DeleteMessageByUuid(ctx context.Context, targetUuid uuid.UUID) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err, "message")
+	}
+	defer tx.Rollback()
+
+	var threadId uuid.UUID
+	err = tx.QueryRowContext(ctx, `
+    SELECT ThreadId FROM messages
+    WHERE Uuid = ?
+    `, targetUuid.Bytes()).Scan(&threadId)
+
+	if err != nil {
+		return translateError(err, "message")
+	}
+
+	_, err = tx.StmtContext(ctx, b.deleteMessageStmt).ExecContext(ctx, targetUuid.Bytes())
+	if err != nil {
+		return translateError(err, "message")
+	}
+
+	_, err = tx.StmtContext(ctx, b.dropThreadMsgStmt).ExecContext(ctx, threadId.Bytes())
+	if err != nil {
+		return translateError(err, "message")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return translateError(err, "message")
+	}
+	b.bus.Publish(backend.Event{Type: backend.MessageDeleted, ThreadId: threadId, MessageId: targetUuid})
+	return nil
 }
 
-func GetMessageCollection(threadId uuid.UUID, count uint64, page int64, appendToCollection func(entities.Message)) error {
+func (b *Backend) GetMessageCollection(ctx context.Context, threadId uuid.UUID, count uint64, page int64, appendToCollection func(entities.Message)) error {
 	offset := page * int64(count)
 
 	// TODO put in filtering
-	rows, err := db.Query(`
+	rows, err := b.db.QueryContext(ctx, `
     SELECT
          Uuid,
          ThreadId,
          AuthorId,
-         Content
+         Content,
+         Created
     FROM
         messages
     WHERE ThreadId = ?
-    LIMIT ?, ?
-    `, threadId.Bytes(), offset, count)
+    ORDER BY Created, Uuid
+    LIMIT ? OFFSET ?
+    `, threadId.Bytes(), count, offset)
 
 	if err != nil {
-		return err
+		return translateError(err, "message")
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var m entities.Message
-		err = rows.Scan(&m.Id, &m.ThreadId, &m.AuthorId, &m.Content)
+		err = rows.Scan(&m.Id, &m.ThreadId, &m.AuthorId, &m.Content, &m.Created)
 		if err != nil {
-			return err
+			return translateError(err, "message")
 		}
 		appendToCollection(m)
 	}
 	err = rows.Err()
-	return err
+	return translateError(err, "message")
 }
 
-func GetMessageTotal(threadId uuid.UUID) (uint, error) {
+// GetMessageCollectionAfter reads the messages of the thread in
+// (Created, Uuid) order starting after the cursor, which is nil to
+// start from the beginning
+func (b *Backend) GetMessageCollectionAfter(ctx context.Context, threadId uuid.UUID, after *backend.Cursor, count uint64, appendToCollection func(entities.Message)) error {
+	var rows *sql.Rows
+	var err error
+
+	if after == nil {
+		rows, err = b.db.QueryContext(ctx, `
+    SELECT
+         Uuid,
+         ThreadId,
+         AuthorId,
+         Content,
+         Created
+    FROM
+        messages
+    WHERE ThreadId = ?
+    ORDER BY Created, Uuid
+    LIMIT ?
+    `, threadId.Bytes(), count)
+	} else {
+		rows, err = b.db.QueryContext(ctx, `
+    SELECT
+         Uuid,
+         ThreadId,
+         AuthorId,
+         Content,
+         Created
+    FROM
+        messages
+    WHERE ThreadId = ?
+    AND (Created, Uuid) > (?, ?)
+    ORDER BY Created, Uuid
+    LIMIT ?
+    `, threadId.Bytes(), after.Created.UTC(), after.Id.Bytes(), count)
+	}
+
+	if err != nil {
+		return translateError(err, "message")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m entities.Message
+		err = rows.Scan(&m.Id, &m.ThreadId, &m.AuthorId, &m.Content, &m.Created)
+		if err != nil {
+			return translateError(err, "message")
+		}
+		appendToCollection(m)
+	}
+	err = rows.Err()
+	return translateError(err, "message")
+}
+
+func (b *Backend) GetMessageTotal(ctx context.Context, threadId uuid.UUID) (uint, error) {
 	ret := uint(0)
 
 	// TODO also need to put filtering in here
-	err := db.QueryRow(`
+	err := b.db.QueryRowContext(ctx, `
     SELECT
         count(*) 
     FROM
@@ -213,10 +568,10 @@ func GetMessageTotal(threadId uuid.UUID) (uint, error) {
     WHERE ThreadId = ?
     `, threadId.Bytes()).Scan(&ret)
 
-	return ret, err
+	return ret, translateError(err, "message")
 }
 
-func EditMessageByUuid(targetUuid uuid.UUID, m *entities.MessageEdit) error {
+func (b *Backend) EditMessageByUuid(ctx context.Context, targetUuid uuid.UUID, m *entities.MessageEdit) error {
 	// TODO cache prepared update statements based on the
 	// 'mask' of set fields
 	// TODO can use reflect to loop through the fields of
@@ -242,108 +597,948 @@ func EditMessageByUuid(targetUuid uuid.UUID, m *entities.MessageEdit) error {
 	query += " WHERE Uuid = ?"
 	params = append(params, targetUuid.Bytes())
 
-	stmt, err := db.Prepare(query)
+	tx, err := b.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return translateError(err, "message")
+	}
+	defer tx.Rollback()
+
+	// moving the message to another thread changes the message
+	// counts of both threads
+	var oldThreadId uuid.UUID
+	var created time.Time
+	err = tx.QueryRowContext(ctx, `
+    SELECT ThreadId, Created FROM messages
+    WHERE Uuid = ?
+    `, targetUuid.Bytes()).Scan(&oldThreadId, &created)
+
+	if err != nil {
+		return translateError(err, "message")
+	}
+
+	_, err = tx.ExecContext(ctx, query, params...)
+	if err != nil {
+		return translateRefError(err, "message")
+	}
+
+	if m.ThreadId != nil && !uuid.Equal(*m.ThreadId, oldThreadId) {
+		_, err = tx.StmtContext(ctx, b.dropThreadMsgStmt).ExecContext(ctx, oldThreadId.Bytes())
+		if err != nil {
+			return translateError(err, "message")
+		}
+
+		res, err := tx.StmtContext(ctx, b.addThreadMsgStmt).ExecContext(ctx, m.ThreadId.Bytes(), created.UTC())
+		if err != nil {
+			return translateError(err, "message")
+		}
+		if err = checkAffected(res, "thread"); err != nil {
+			return entities.WrapError(entities.Validation, "message refers to a thread that does not exist", err)
+		}
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec(params...)
 
-	return err
+	if err = tx.Commit(); err != nil {
+		return translateError(err, "message")
+	}
+	b.bus.Publish(backend.MessageEditedEvent(targetUuid, oldThreadId, m.ThreadId))
+	return nil
 }
 
-func GetThreadByUuid(targetUuid uuid.UUID) (*entities.Thread, error) {
+func (b *Backend) GetThreadByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.Thread, error) {
 	var t entities.Thread
-	err := getThreadStmt.QueryRow(targetUuid.Bytes()).Scan(&t.Id, &t.Title)
+	err := b.getThreadStmt.QueryRowContext(ctx, targetUuid.Bytes()).Scan(&t.Id, &t.Title, &t.NumMsgs, &t.LastMsgTime, &t.Created)
 
 	if err != nil {
-		return nil, err
+		return nil, translateError(err, "thread")
 	}
 
 	return &t, nil
 }
 
-func CreateThread(t *entities.Thread) error {
-	_, err := createThreadStmt.Exec(t.Id.Bytes(), t.Title)
-
-	return err
+func (b *Backend) CreateThread(ctx context.Context, t *entities.Thread) error {
+	_, err := b.createThreadStmt.ExecContext(ctx, t.Id.Bytes(), t.Title, t.Created.UTC())
+	if err != nil {
+		return translateError(err, "thread")
+	}
+	b.bus.Publish(backend.Event{Type: backend.ThreadCreated, ThreadId: t.Id})
+	return nil
 }
 
-func DeleteThreadByUuid(targetUuid uuid.UUID) error {
-	_, err := deleteThreadStmt.Exec(targetUuid.Bytes())
-	return err
+func (b *Backend) DeleteThreadByUuid(ctx context.Context, targetUuid uuid.UUID) error {
+	res, err := b.deleteThreadStmt.ExecContext(ctx, targetUuid.Bytes())
+	if err != nil {
+		return translateError(err, "thread")
+	}
+	if err = checkAffected(res, "thread"); err != nil {
+		return err
+	}
+	b.bus.Publish(backend.Event{Type: backend.ThreadDeleted, ThreadId: targetUuid})
+	return nil
 }
 
-func GetThreadCollection(count uint64, page int64, appendToCollection func(entities.Thread)) error {
+func (b *Backend) GetThreadCollection(ctx context.Context, count uint64, page int64, appendToCollection func(entities.Thread)) error {
 	offset := page * int64(count)
 
 	// TODO put in filtering
-	rows, err := db.Query(`
+	rows, err := b.db.QueryContext(ctx, `
     SELECT
         Uuid,
-        Title
+        Title,
+        NumMsgs,
+        LastMsgTime,
+        Created
     FROM
         threads
-    LIMIT ?, ?
-    `, offset, count)
+    ORDER BY Created, Uuid
+    LIMIT ? OFFSET ?
+    `, count, offset)
 	if err != nil {
-		return err
+		return translateError(err, "thread")
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var t entities.Thread
-		err = rows.Scan(&t.Id, &t.Title)
+		err = rows.Scan(&t.Id, &t.Title, &t.NumMsgs, &t.LastMsgTime, &t.Created)
 		if err != nil {
-			log.Fatal(err)
+			return translateError(err, "thread")
 		}
 		appendToCollection(t)
 	}
 	err = rows.Err()
 	if err != nil {
-		return err
+		return translateError(err, "thread")
+	}
+
+	err = rows.Err()
+	return translateError(err, "thread")
+}
+
+// GetThreadCollectionAfter reads threads in (Created, Uuid) order
+// starting after the cursor, which is nil to start from the beginning
+func (b *Backend) GetThreadCollectionAfter(ctx context.Context, after *backend.Cursor, count uint64, appendToCollection func(entities.Thread)) error {
+	var rows *sql.Rows
+	var err error
+
+	if after == nil {
+		rows, err = b.db.QueryContext(ctx, `
+    SELECT
+        Uuid,
+        Title,
+        NumMsgs,
+        LastMsgTime,
+        Created
+    FROM
+        threads
+    ORDER BY Created, Uuid
+    LIMIT ?
+    `, count)
+	} else {
+		rows, err = b.db.QueryContext(ctx, `
+    SELECT
+        Uuid,
+        Title,
+        NumMsgs,
+        LastMsgTime,
+        Created
+    FROM
+        threads
+    WHERE (Created, Uuid) > (?, ?)
+    ORDER BY Created, Uuid
+    LIMIT ?
+    `, after.Created.UTC(), after.Id.Bytes(), count)
 	}
 
+	if err != nil {
+		return translateError(err, "thread")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t entities.Thread
+		err = rows.Scan(&t.Id, &t.Title, &t.NumMsgs, &t.LastMsgTime, &t.Created)
+		if err != nil {
+			return translateError(err, "thread")
+		}
+		appendToCollection(t)
+	}
 	err = rows.Err()
-	return err
+	return translateError(err, "thread")
 }
 
-func GetThreadTotal() (uint, error) {
+func (b *Backend) GetThreadTotal(ctx context.Context) (uint, error) {
 	ret := uint(0)
 
 	// TODO also need to put filtering in here
-	err := db.QueryRow(`
+	err := b.db.QueryRowContext(ctx, `
     SELECT
         count(*) 
     FROM
         threads
     `).Scan(&ret)
 
-	return ret, err
+	return ret, translateError(err, "thread")
+}
+
+func (b *Backend) EditThreadByUuid(ctx context.Context, targetUuid uuid.UUID, t *entities.ThreadEdit) error {
+	res, err := b.editThreadStmt.ExecContext(ctx, t.Title, targetUuid.Bytes())
+	if err != nil {
+		return translateError(err, "thread")
+	}
+	if err = checkAffected(res, "thread"); err != nil {
+		return err
+	}
+	b.bus.Publish(backend.Event{Type: backend.ThreadEdited, ThreadId: targetUuid})
+	return nil
 }
 
-func EditThreadByUuid(targetUuid uuid.UUID, t *entities.ThreadEdit) error {
-	_, err := editThreadStmt.Exec(t.Title, targetUuid.Bytes())
-	return err
+// ReconcileThreadStats recomputes NumMsgs and LastMsgTime of every
+// thread from the messages table
+func (b *Backend) ReconcileThreadStats(ctx context.Context) error {
+	_, err := b.db.ExecContext(ctx, `
+    UPDATE threads SET
+        NumMsgs = (SELECT count(*) FROM messages WHERE messages.ThreadId = threads.Uuid),
+        LastMsgTime = (SELECT max(Created) FROM messages WHERE messages.ThreadId = threads.Uuid)
+    `)
+	return translateError(err, "thread")
 }
 
-func GetUserByUsername(uname string) (*entities.User, error) {
+func (b *Backend) GetUserByUsername(ctx context.Context, uname string) (*entities.User, error) {
 	var u entities.User
-	err := getUserByUnameStmt.QueryRow(uname).Scan(&u.Uuid, &u.FirstName, &u.SecondName, &u.Username, &u.HashedPwd)
+	err := b.getUserByUnameStmt.QueryRowContext(ctx, uname).Scan(&u.Uuid, &u.FirstName, &u.SecondName, &u.Username, &u.HashedPwd, &u.Approved, &u.Role, &u.Email, &u.DisplayName, &u.Bio, &u.Service, &u.TokenGeneration)
 
 	if err != nil {
-		return nil, err
+		return nil, translateError(err, "user")
 	}
 
 	return &u, nil
 }
 
-func GetUserByUuid(targetUuid uuid.UUID) (*entities.User, error) {
+func (b *Backend) GetUserByUuid(ctx context.Context, targetUuid uuid.UUID) (*entities.User, error) {
 	var u entities.User
-	err := getUserByUuidStmt.QueryRow(targetUuid.Bytes()).Scan(&u.Uuid, &u.FirstName, &u.SecondName, &u.Username, &u.HashedPwd)
+	err := b.getUserByUuidStmt.QueryRowContext(ctx, targetUuid.Bytes()).Scan(&u.Uuid, &u.FirstName, &u.SecondName, &u.Username, &u.HashedPwd, &u.Approved, &u.Role, &u.Email, &u.DisplayName, &u.Bio, &u.Service, &u.TokenGeneration)
 
 	if err != nil {
-		return nil, err
+		return nil, translateError(err, "user")
 	}
 
 	return &u, nil
 }
+
+func (b *Backend) GetUserCollection(ctx context.Context, prefix string, count uint64, page int64, appendToCollection func(entities.User)) error {
+	offset := page * int64(count)
+
+	rows, err := b.db.QueryContext(ctx, `
+    SELECT
+        Uuid,
+        FirstName,
+        SecondName,
+        Username,
+        HashedPwd,
+        Approved,
+        Role,
+        Email,
+        DisplayName,
+        Bio,
+        Service,
+        TokenGeneration
+    FROM
+        users
+    WHERE lower(Username) LIKE ? ESCAPE '\'
+    ORDER BY lower(Username)
+    LIMIT ? OFFSET ?
+    `, backend.LikePrefix(prefix), count, offset)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u entities.User
+		err = rows.Scan(&u.Uuid, &u.FirstName, &u.SecondName, &u.Username, &u.HashedPwd, &u.Approved, &u.Role, &u.Email, &u.DisplayName, &u.Bio, &u.Service, &u.TokenGeneration)
+		if err != nil {
+			return translateError(err, "user")
+		}
+		appendToCollection(u)
+	}
+	return translateError(rows.Err(), "user")
+}
+
+func (b *Backend) GetUserTotal(ctx context.Context, prefix string) (uint, error) {
+	ret := uint(0)
+
+	err := b.db.QueryRowContext(ctx, `
+    SELECT
+        count(*)
+    FROM
+        users
+    WHERE lower(Username) LIKE ? ESCAPE '\'
+    `, backend.LikePrefix(prefix)).Scan(&ret)
+
+	return ret, translateError(err, "user")
+}
+
+func (b *Backend) EditUserByUuid(ctx context.Context, targetUuid uuid.UUID, u *entities.UserEdit) error {
+	query := "UPDATE users SET "
+	updateFieldSql := []string{}
+	params := []interface{}{}
+	if u.FirstName != nil {
+		updateFieldSql = append(updateFieldSql, "FirstName = ?")
+		params = append(params, *u.FirstName)
+	}
+	if u.SecondName != nil {
+		updateFieldSql = append(updateFieldSql, "SecondName = ?")
+		params = append(params, *u.SecondName)
+	}
+	if u.DisplayName != nil {
+		updateFieldSql = append(updateFieldSql, "DisplayName = ?")
+		params = append(params, *u.DisplayName)
+	}
+	if u.Bio != nil {
+		updateFieldSql = append(updateFieldSql, "Bio = ?")
+		params = append(params, *u.Bio)
+	}
+	if u.Role != nil {
+		updateFieldSql = append(updateFieldSql, "Role = ?")
+		params = append(params, *u.Role)
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	query += strings.Join(updateFieldSql, ", ")
+	query += " WHERE Uuid = ?"
+	params = append(params, targetUuid.Bytes())
+
+	res, err := b.db.ExecContext(ctx, query, params...)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	return checkAffected(res, "user")
+}
+
+// CreateUser inserts u and, in the same transaction, marks inviteCode
+// as used by it
+func (b *Backend) CreateUser(ctx context.Context, u *entities.User, inviteCode string) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.StmtContext(ctx, b.createUserStmt).ExecContext(ctx,
+		u.Uuid.Bytes(),
+		u.FirstName,
+		u.SecondName,
+		u.Username,
+		u.HashedPwd,
+		u.Approved,
+		u.Role,
+		u.Email,
+		u.Service)
+
+	if err != nil {
+		return translateError(err, "user")
+	}
+
+	if inviteCode != "" {
+		res, err := tx.StmtContext(ctx, b.redeemInviteStmt).ExecContext(ctx, u.Uuid.Bytes(), inviteCode)
+		if err != nil {
+			return translateError(err, "invite")
+		}
+		if err = checkAffected(res, "invite"); err != nil {
+			return entities.WrapError(entities.Validation, "invite code is not valid or has been used", err)
+		}
+	}
+
+	return translateError(tx.Commit(), "user")
+}
+
+func (b *Backend) SetUserRole(ctx context.Context, targetUuid uuid.UUID, role entities.Role) error {
+	res, err := b.setUserRoleStmt.ExecContext(ctx, role, targetUuid.Bytes())
+	if err != nil {
+		return translateError(err, "user")
+	}
+	return checkAffected(res, "user")
+}
+
+// SetUserPassword updates the hash and, in the same transaction,
+// deletes the sessions and password resets of the user
+func (b *Backend) SetUserPassword(ctx context.Context, targetUuid uuid.UUID, hashedPwd []byte) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.StmtContext(ctx, b.setUserPwdStmt).ExecContext(ctx, hashedPwd, targetUuid.Bytes())
+	if err != nil {
+		return translateError(err, "user")
+	}
+	if err = checkAffected(res, "user"); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+    DELETE FROM sessions
+    WHERE UserId = ?`, targetUuid.Bytes())
+	if err != nil {
+		return translateError(err, "session")
+	}
+
+	_, err = tx.ExecContext(ctx, `
+    DELETE FROM passwordResets
+    WHERE UserId = ?`, targetUuid.Bytes())
+	if err != nil {
+		return translateError(err, "password reset")
+	}
+
+	return translateError(tx.Commit(), "user")
+}
+
+func (b *Backend) UpgradeUserPassword(ctx context.Context, targetUuid uuid.UUID, oldHash, newHash []byte) error {
+	res, err := b.upgradeUserPwdStmt.ExecContext(ctx, newHash, targetUuid.Bytes(), oldHash)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	return checkAffected(res, "user")
+}
+
+func (b *Backend) ApproveUser(ctx context.Context, uname string) error {
+	res, err := b.approveUserStmt.ExecContext(ctx, uname)
+	if err != nil {
+		return translateError(err, "user")
+	}
+	return checkAffected(res, "user")
+}
+
+func (b *Backend) CreateInvite(ctx context.Context, code string) error {
+	_, err := b.createInviteStmt.ExecContext(ctx, code, time.Now().UTC())
+	return translateError(err, "invite")
+}
+
+func (b *Backend) sessionPrepareStmts() error {
+	var err error
+	b.createSessionStmt, err = b.db.Prepare(`
+    INSERT INTO sessions (
+        Id,
+        UserId,
+        Created,
+        Expires)
+    VALUES (?, ?, ?, ?)`)
+
+	if err != nil {
+		return err
+	}
+
+	b.takeSessionStmt, err = b.db.Prepare(`
+    DELETE FROM sessions
+    WHERE Id = ?
+    RETURNING
+        Id,
+        UserId,
+        Created,
+        Expires`)
+
+	if err != nil {
+		return err
+	}
+
+	b.createResetStmt, err = b.db.Prepare(`
+    INSERT INTO passwordResets (
+        Id,
+        UserId,
+        Created,
+        Expires)
+    VALUES (?, ?, ?, ?)`)
+
+	if err != nil {
+		return err
+	}
+
+	b.takeResetStmt, err = b.db.Prepare(`
+    DELETE FROM passwordResets
+    WHERE Id = ?
+    RETURNING
+        Id,
+        UserId,
+        Created,
+        Expires`)
+
+	if err != nil {
+		return err
+	}
+
+	b.getApiKeyStmt, err = b.db.Prepare(`
+    SELECT
+        Id,
+        UserId,
+        Name,
+        Scope,
+        Threads,
+        Created,
+        Expires
+    FROM apiKeys
+    WHERE Id = ?`)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *Backend) CreateSession(ctx context.Context, s *entities.Session) error {
+	_, err := b.createSessionStmt.ExecContext(ctx, s.Id, s.UserId.Bytes(), s.Created.UTC(), s.Expires.UTC())
+	return translateRefError(err, "session")
+}
+
+func (b *Backend) TakeSession(ctx context.Context, id string) (*entities.Session, error) {
+	var s entities.Session
+	err := b.takeSessionStmt.QueryRowContext(ctx, id).Scan(&s.Id, &s.UserId, &s.Created, &s.Expires)
+
+	if err != nil {
+		return nil, translateError(err, "session")
+	}
+	return &s, nil
+}
+
+func (b *Backend) DeleteUserSessions(ctx context.Context, userId uuid.UUID) error {
+	_, err := b.db.ExecContext(ctx, `
+    DELETE FROM sessions
+    WHERE UserId = ?`, userId.Bytes())
+	return translateError(err, "session")
+}
+
+func (b *Backend) CreatePasswordReset(ctx context.Context, r *entities.PasswordReset) error {
+	_, err := b.createResetStmt.ExecContext(ctx, r.Id, r.UserId.Bytes(), r.Created.UTC(), r.Expires.UTC())
+	return translateRefError(err, "password reset")
+}
+
+func (b *Backend) TakePasswordReset(ctx context.Context, id string) (*entities.PasswordReset, error) {
+	var r entities.PasswordReset
+	err := b.takeResetStmt.QueryRowContext(ctx, id).Scan(&r.Id, &r.UserId, &r.Created, &r.Expires)
+
+	if err != nil {
+		return nil, translateError(err, "password reset")
+	}
+	return &r, nil
+}
+
+func (b *Backend) ReplacePasswordReset(ctx context.Context, oldId, newId string) (*entities.PasswordReset, error) {
+	var r entities.PasswordReset
+	err := b.db.QueryRowContext(ctx, `
+    UPDATE passwordResets
+    SET Id = ?
+    WHERE Id = ?
+    RETURNING Id, UserId, Created, Expires`, newId, oldId).Scan(&r.Id, &r.UserId, &r.Created, &r.Expires)
+
+	if err != nil {
+		return nil, translateError(err, "password reset")
+	}
+	return &r, nil
+}
+
+func (b *Backend) RecordSecurityEvent(ctx context.Context, e *entities.SecurityEvent) error {
+	_, err := b.db.ExecContext(ctx, `
+    INSERT INTO securityEvents (
+        Kind,
+        Username,
+        RemoteAddr,
+        Created)
+    VALUES (?, ?, ?, ?)`, e.Kind, e.Username, e.RemoteAddr, e.Created.UTC())
+	return translateError(err, "security event")
+}
+
+func (b *Backend) CreateApiKey(ctx context.Context, k *entities.ApiKey) error {
+	var expires interface{}
+	if k.Expires != nil {
+		expires = k.Expires.UTC()
+	}
+	_, err := b.db.ExecContext(ctx, `
+    INSERT INTO apiKeys (
+        Id,
+        UserId,
+        Name,
+        Scope,
+        Threads,
+        Created,
+        Expires)
+    VALUES (?, ?, ?, ?, ?, ?, ?)`, k.Id, k.UserId.Bytes(), k.Name, k.Scope, backend.JoinUuids(k.Threads), k.Created.UTC(), expires)
+	return translateRefError(err, "API key")
+}
+
+// scanApiKey reads an API key from a row of the columns selected by
+// getApiKeyStmt
+func scanApiKey(scan func(dest ...interface{}) error) (*entities.ApiKey, error) {
+	var k entities.ApiKey
+	var threads string
+	err := scan(&k.Id, &k.UserId, &k.Name, &k.Scope, &threads, &k.Created, &k.Expires)
+	if err != nil {
+		return nil, translateError(err, "API key")
+	}
+	if k.Threads, err = backend.SplitUuids(threads); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (b *Backend) GetApiKey(ctx context.Context, id string) (*entities.ApiKey, error) {
+	return scanApiKey(b.getApiKeyStmt.QueryRowContext(ctx, id).Scan)
+}
+
+func (b *Backend) GetUserApiKeys(ctx context.Context, userId uuid.UUID, appendToCollection func(entities.ApiKey)) error {
+	rows, err := b.db.QueryContext(ctx, `
+    SELECT
+        Id,
+        UserId,
+        Name,
+        Scope,
+        Threads,
+        Created,
+        Expires
+    FROM apiKeys
+    WHERE UserId = ?
+    ORDER BY Name
+    `, userId.Bytes())
+	if err != nil {
+		return translateError(err, "API key")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		k, err := scanApiKey(rows.Scan)
+		if err != nil {
+			return err
+		}
+		appendToCollection(*k)
+	}
+	return translateError(rows.Err(), "API key")
+}
+
+func (b *Backend) DeleteApiKey(ctx context.Context, userId uuid.UUID, name string) error {
+	res, err := b.db.ExecContext(ctx, `
+    DELETE FROM apiKeys
+    WHERE UserId = ? AND Name = ?`, userId.Bytes(), name)
+	if err != nil {
+		return translateError(err, "API key")
+	}
+	return checkAffected(res, "API key")
+}
+
+func (b *Backend) CreateWebhook(ctx context.Context, w *entities.Webhook) error {
+	_, err := b.db.ExecContext(ctx, `
+    INSERT INTO webhooks (
+        Id,
+        Url,
+        Secret,
+        Events,
+        Created)
+    VALUES (?, ?, ?, ?, ?)`, w.Id.Bytes(), w.Url, w.Secret, backend.JoinEvents(w.Events), w.Created.UTC())
+	return translateError(err, "webhook")
+}
+
+const webhookColumns = `
+        Id,
+        Url,
+        Secret,
+        Events,
+        Created`
+
+// scanWebhook reads a webhook from a row of webhookColumns
+func scanWebhook(scan func(dest ...interface{}) error) (*entities.Webhook, error) {
+	var w entities.Webhook
+	var events string
+	err := scan(&w.Id, &w.Url, &w.Secret, &events, &w.Created)
+	if err != nil {
+		return nil, translateError(err, "webhook")
+	}
+	w.Events = backend.SplitEvents(events)
+	return &w, nil
+}
+
+func (b *Backend) GetWebhook(ctx context.Context, id uuid.UUID) (*entities.Webhook, error) {
+	return scanWebhook(b.db.QueryRowContext(ctx, `
+    SELECT`+webhookColumns+`
+    FROM webhooks
+    WHERE Id = ?`, id.Bytes()).Scan)
+}
+
+func (b *Backend) GetWebhooks(ctx context.Context, appendToCollection func(entities.Webhook)) error {
+	rows, err := b.db.QueryContext(ctx, `
+    SELECT`+webhookColumns+`
+    FROM webhooks
+    ORDER BY Created, Id`)
+	if err != nil {
+		return translateError(err, "webhook")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		w, err := scanWebhook(rows.Scan)
+		if err != nil {
+			return err
+		}
+		appendToCollection(*w)
+	}
+	return translateError(rows.Err(), "webhook")
+}
+
+func (b *Backend) EditWebhookByUuid(ctx context.Context, id uuid.UUID, w *entities.WebhookEdit) error {
+	query := "UPDATE webhooks SET "
+	updateFieldSql := []string{}
+	params := []interface{}{}
+	if w.Url != nil {
+		updateFieldSql = append(updateFieldSql, "Url = ?")
+		params = append(params, *w.Url)
+	}
+
+	if w.Secret != nil {
+		updateFieldSql = append(updateFieldSql, "Secret = ?")
+		params = append(params, *w.Secret)
+	}
+
+	if w.Events != nil {
+		updateFieldSql = append(updateFieldSql, "Events = ?")
+		params = append(params, backend.JoinEvents(*w.Events))
+	}
+
+	if len(updateFieldSql) == 0 {
+		return nil
+	}
+	query += strings.Join(updateFieldSql, ", ")
+	query += " WHERE Id = ?"
+	params = append(params, id.Bytes())
+
+	res, err := b.db.ExecContext(ctx, query, params...)
+	if err != nil {
+		return translateError(err, "webhook")
+	}
+	return checkAffected(res, "webhook")
+}
+
+func (b *Backend) DeleteWebhookByUuid(ctx context.Context, id uuid.UUID) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err, "webhook")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+    DELETE FROM webhookDeliveries
+    WHERE WebhookId = ?`, id.Bytes())
+	if err != nil {
+		return translateError(err, "webhook")
+	}
+
+	res, err := tx.ExecContext(ctx, `
+    DELETE FROM webhooks
+    WHERE Id = ?`, id.Bytes())
+	if err != nil {
+		return translateError(err, "webhook")
+	}
+	if err = checkAffected(res, "webhook"); err != nil {
+		return err
+	}
+
+	return translateError(tx.Commit(), "webhook")
+}
+
+func (b *Backend) CreateWebhookDelivery(ctx context.Context, d *entities.WebhookDelivery) error {
+	_, err := b.db.ExecContext(ctx, `
+    INSERT INTO webhookDeliveries (
+        Id,
+        WebhookId,
+        EventId,
+        Event,
+        Payload,
+        Status,
+        Attempts,
+        ResponseStatus,
+        Error,
+        Created,
+        Updated)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.Id.Bytes(), d.WebhookId.Bytes(), d.EventId.Bytes(), d.Event, d.Payload, d.Status, d.Attempts, d.ResponseStatus, d.Error, d.Created.UTC(), d.Updated.UTC())
+	return translateRefError(err, "webhook delivery")
+}
+
+func (b *Backend) UpdateWebhookDelivery(ctx context.Context, d *entities.WebhookDelivery) error {
+	res, err := b.db.ExecContext(ctx, `
+    UPDATE webhookDeliveries
+    SET Status = ?, Attempts = ?, ResponseStatus = ?, Error = ?, Updated = ?
+    WHERE Id = ?`, d.Status, d.Attempts, d.ResponseStatus, d.Error, d.Updated.UTC(), d.Id.Bytes())
+	if err != nil {
+		return translateError(err, "webhook delivery")
+	}
+	return checkAffected(res, "webhook delivery")
+}
+
+const deliveryColumns = `
+        Id,
+        WebhookId,
+        EventId,
+        Event,
+        Payload,
+        Status,
+        Attempts,
+        ResponseStatus,
+        Error,
+        Created,
+        Updated`
+
+// scanDelivery reads a webhook delivery from a row of deliveryColumns
+func scanDelivery(scan func(dest ...interface{}) error) (*entities.WebhookDelivery, error) {
+	var d entities.WebhookDelivery
+	err := scan(&d.Id, &d.WebhookId, &d.EventId, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.ResponseStatus, &d.Error, &d.Created, &d.Updated)
+	if err != nil {
+		return nil, translateError(err, "webhook delivery")
+	}
+	return &d, nil
+}
+
+func (b *Backend) GetWebhookDelivery(ctx context.Context, id uuid.UUID) (*entities.WebhookDelivery, error) {
+	return scanDelivery(b.db.QueryRowContext(ctx, `
+    SELECT`+deliveryColumns+`
+    FROM webhookDeliveries
+    WHERE Id = ?`, id.Bytes()).Scan)
+}
+
+func (b *Backend) GetWebhookDeliveries(ctx context.Context, webhookId uuid.UUID, count uint64, page int64, appendToCollection func(entities.WebhookDelivery)) error {
+	offset := page * int64(count)
+
+	rows, err := b.db.QueryContext(ctx, `
+    SELECT`+deliveryColumns+`
+    FROM webhookDeliveries
+    WHERE WebhookId = ?
+    ORDER BY Created DESC, Id DESC
+    LIMIT ? OFFSET ?`, webhookId.Bytes(), count, offset)
+	if err != nil {
+		return translateError(err, "webhook delivery")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d, err := scanDelivery(rows.Scan)
+		if err != nil {
+			return err
+		}
+		appendToCollection(*d)
+	}
+	return translateError(rows.Err(), "webhook delivery")
+}
+
+func (b *Backend) GetWebhookDeliveryTotal(ctx context.Context, webhookId uuid.UUID) (uint, error) {
+	ret := uint(0)
+	err := b.db.QueryRowContext(ctx, `
+    SELECT count(*)
+    FROM webhookDeliveries
+    WHERE WebhookId = ?`, webhookId.Bytes()).Scan(&ret)
+	return ret, translateError(err, "webhook delivery")
+}
+
+func (b *Backend) CreateJob(ctx context.Context, j *entities.Job) error {
+	_, err := b.db.ExecContext(ctx, `
+    INSERT INTO jobs (
+        Id,
+        Kind,
+        Payload,
+        Status,
+        Attempts,
+        MaxAttempts,
+        Error,
+        RunAt,
+        LockedUntil,
+        Created,
+        Updated)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		j.Id.Bytes(), j.Kind, j.Payload, j.Status, j.Attempts, j.MaxAttempts, j.Error, j.RunAt.UTC(), j.LockedUntil.UTC(), j.Created.UTC(), j.Updated.UTC())
+	return translateError(err, "job")
+}
+
+const jobColumns = `
+        Id,
+        Kind,
+        Payload,
+        Status,
+        Attempts,
+        MaxAttempts,
+        Error,
+        RunAt,
+        LockedUntil,
+        Created,
+        Updated`
+
+// scanJob reads a job from a row of jobColumns
+func scanJob(scan func(dest ...interface{}) error) (*entities.Job, error) {
+	var j entities.Job
+	err := scan(&j.Id, &j.Kind, &j.Payload, &j.Status, &j.Attempts, &j.MaxAttempts, &j.Error, &j.RunAt, &j.LockedUntil, &j.Created, &j.Updated)
+	if err != nil {
+		return nil, translateError(err, "job")
+	}
+	return &j, nil
+}
+
+// ClaimJob is a single statement, which SQLite runs with the database
+// locked, so no two callers can claim the same job
+func (b *Backend) ClaimJob(ctx context.Context, now time.Time, lease time.Duration) (*entities.Job, error) {
+	j, err := scanJob(b.db.QueryRowContext(ctx, `
+    UPDATE jobs
+    SET Status = ?, Attempts = Attempts + 1, LockedUntil = ?, Updated = ?
+    WHERE Id = (
+        SELECT Id
+        FROM jobs
+        WHERE (Status = ? AND RunAt <= ?) OR (Status = ? AND LockedUntil <= ?)
+        ORDER BY RunAt
+        LIMIT 1)
+    RETURNING`+jobColumns,
+		entities.JobRunning, now.Add(lease).UTC(), now.UTC(),
+		entities.JobPending, now.UTC(), entities.JobRunning, now.UTC()).Scan)
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+		return nil, entities.NewError(entities.NotFound, "no job is due")
+	}
+	return j, err
+}
+
+func (b *Backend) UpdateJob(ctx context.Context, j *entities.Job) error {
+	res, err := b.db.ExecContext(ctx, `
+    UPDATE jobs
+    SET Payload = ?, Status = ?, Attempts = ?, Error = ?, RunAt = ?, LockedUntil = ?, Updated = ?
+    WHERE Id = ?`, j.Payload, j.Status, j.Attempts, j.Error, j.RunAt.UTC(), j.LockedUntil.UTC(), j.Updated.UTC(), j.Id.Bytes())
+	if err != nil {
+		return translateError(err, "job")
+	}
+	return checkAffected(res, "job")
+}
+
+func (b *Backend) DeleteJob(ctx context.Context, id uuid.UUID) error {
+	res, err := b.db.ExecContext(ctx, `
+    DELETE FROM jobs
+    WHERE Id = ?`, id.Bytes())
+	if err != nil {
+		return translateError(err, "job")
+	}
+	return checkAffected(res, "job")
+}
+
+func (b *Backend) GetJob(ctx context.Context, id uuid.UUID) (*entities.Job, error) {
+	return scanJob(b.db.QueryRowContext(ctx, `
+    SELECT`+jobColumns+`
+    FROM jobs
+    WHERE Id = ?`, id.Bytes()).Scan)
+}
+
+func (b *Backend) GetJobs(ctx context.Context, status entities.JobStatus, count uint64, page int64, appendToCollection func(entities.Job)) error {
+	offset := page * int64(count)
+
+	rows, err := b.db.QueryContext(ctx, `
+    SELECT`+jobColumns+`
+    FROM jobs
+    WHERE Status = ?
+    ORDER BY RunAt, Id
+    LIMIT ? OFFSET ?`, status, count, offset)
+	if err != nil {
+		return translateError(err, "job")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		j, err := scanJob(rows.Scan)
+		if err != nil {
+			return err
+		}
+		appendToCollection(*j)
+	}
+	return translateError(rows.Err(), "job")
+}
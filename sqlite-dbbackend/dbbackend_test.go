@@ -0,0 +1,91 @@
+//go:build sqlite_fts5
+
+package dbbackend
+
+import (
+	"context"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testBackend(t *testing.T) backend.Backend {
+	b, err := Open(backend.Config{DataSource: filepath.Join(t.TempDir(), "jerver.db"), Migrate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// TestForeignKeys checks the foreign keys hold on every connection of
+// the pool, so that threads in use are not deleted and messages are
+// not written to threads that do not exist
+func TestForeignKeys(t *testing.T) {
+	ctx := context.Background()
+	b := testBackend(t)
+	now := time.Now().UTC()
+
+	u := &entities.User{Username: "hasquith", Role: entities.RoleMember}
+	u.Uuid, _ = uuid.NewV4()
+	if err := b.CreateUser(ctx, u, ""); err != nil {
+		t.Fatal(err)
+	}
+	var full, empty entities.Thread
+	for _, th := range []*entities.Thread{&full, &empty} {
+		th.Id, _ = uuid.NewV4()
+		th.Title = "Who's the best PM?"
+		th.Created = now
+		if err := b.CreateThread(ctx, th); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &entities.Message{ThreadId: full.Id, AuthorId: u.Uuid, Content: "Asquith", Created: now}
+	m.Id, _ = uuid.NewV4()
+	if err := b.CreateMessage(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	missing, _ := uuid.NewV4()
+
+	tests := []struct {
+		name string
+		run  func() error
+		kind entities.ErrorKind
+	}{
+		{"message by unknown author", func() error {
+			m := &entities.Message{ThreadId: full.Id, AuthorId: missing, Content: "Balfour", Created: now}
+			m.Id, _ = uuid.NewV4()
+			return b.CreateMessage(ctx, m)
+		}, entities.Validation},
+		{"message moved to unknown thread", func() error {
+			return b.EditMessageByUuid(ctx, m.Id, &entities.MessageEdit{ThreadId: &missing})
+		}, entities.Validation},
+		{"session of unknown user", func() error {
+			id, _ := uuid.NewV4()
+			return b.CreateSession(ctx, &entities.Session{Id: id.String(), UserId: missing, Created: now, Expires: now})
+		}, entities.Validation},
+		{"thread with messages", func() error {
+			return b.DeleteThreadByUuid(ctx, full.Id)
+		}, entities.Conflict},
+	}
+	// more than one round, so that statements run on more than the
+	// first connection of the pool
+	for round := 0; round < 3; round++ {
+		for _, test := range tests {
+			err := test.run()
+			if kind, _ := entities.ErrorKindOf(err); kind != test.kind {
+				t.Errorf("%s: got %v, want a %s error", test.name, err, test.kind)
+			}
+		}
+	}
+
+	if _, err := b.GetMessageByUuid(ctx, m.Id); err != nil {
+		t.Errorf("message of thread in use: %v", err)
+	}
+	if err := b.DeleteThreadByUuid(ctx, empty.Id); err != nil {
+		t.Errorf("thread without messages: %v", err)
+	}
+}
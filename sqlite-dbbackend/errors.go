@@ -0,0 +1,67 @@
+package dbbackend
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/mattn/go-sqlite3"
+)
+
+// translateError maps database/sql and sqlite3 errors on to the kinds
+// of entities.Error, what names the entity the query was about.
+// Errors that are not recognised are returned unchanged
+func translateError(err error, what string) error {
+	if err == nil {
+		return nil
+	}
+
+	if err == sql.ErrNoRows {
+		return entities.WrapError(entities.NotFound, what+" not found", err)
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrCantOpen, sqlite3.ErrIoErr:
+			return entities.WrapError(entities.Unavailable, "database unavailable", err)
+		case sqlite3.ErrConstraint:
+			switch sqliteErr.ExtendedCode {
+			case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+				return entities.WrapError(entities.Conflict, what+" already exists", err)
+			case sqlite3.ErrConstraintForeignKey:
+				return entities.WrapError(entities.Conflict, what+" is still in use", err)
+			default:
+				return entities.WrapError(entities.Validation, "invalid "+what, err)
+			}
+		case sqlite3.ErrMismatch, sqlite3.ErrTooBig:
+			return entities.WrapError(entities.Validation, "invalid "+what, err)
+		}
+	}
+
+	return err
+}
+
+// translateRefError is translateError for a statement writing a row
+// that refers to others. sqlite reports a foreign key failing the same
+// way whichever end of it is at fault, for such a statement it is
+// because what refers to something that does not exist
+func translateRefError(err error, what string) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+		return entities.WrapError(entities.Validation, what+" refers to something that does not exist", err)
+	}
+	return translateError(err, what)
+}
+
+// checkAffected reports a NotFound error when an UPDATE or DELETE did
+// not match any row
+func checkAffected(res sql.Result, what string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return entities.NewError(entities.NotFound, what+" not found")
+	}
+	return nil
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
+	"context"
+	"github.com/john-sharp/jerver/backend"
+	sqlite "github.com/john-sharp/jerver/sqlite-dbbackend"
 	"github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
 	"log"
-	"os"
+	"time"
 )
 
 type userBaseDetails struct {
@@ -14,14 +15,15 @@ type userBaseDetails struct {
 	SecondName string
 	Username   string
 	Pwd        string
+	Role       string
 }
 
 var users = []userBaseDetails{
-	{"Robert", "Gascoyne-Cecil", "salisbury", "1895"},
-	{"Arthur", "Balfour", "abalfour", "1902"},
-	{"Henry", "Campbell-Bannerman", "hcb", "1905"},
-	{"Herbert", "Asquith", "hasquith", "1908"},
-	{"David", "Lloyd George", "dlg", "1916"},
+	{"Robert", "Gascoyne-Cecil", "salisbury", "1895", "admin"},
+	{"Arthur", "Balfour", "abalfour", "1902", "moderator"},
+	{"Henry", "Campbell-Bannerman", "hcb", "1905", "member"},
+	{"Herbert", "Asquith", "hasquith", "1908", "member"},
+	{"David", "Lloyd George", "dlg", "1916", "member"},
 }
 
 type threadBaseDetails struct {
@@ -47,26 +49,25 @@ var messages = []messageBaseDetails{
 }
 
 func main() {
-	os.Remove("../jerver.db")
-
-	db, err := sql.Open("sqlite3", "../jerver.db")
+	// an existing database is only brought up to date, so that
+	// local data survives schema changes
+	m, err := sqlite.Migrator(backend.Config{DataSource: "../jerver.db"})
 	if err != nil {
 		log.Fatal(err)
 	}
+	db := m.DB
 	defer db.Close()
 
-	// CREATE USERS TABLE
-	sqlStmt := `
-	CREATE TABLE users (
-        Uuid blob NOT NULL PRIMARY KEY, 
-        FirstName text,
-        SecondName text,
-        Username text,
-        HashedPwd blob);
-	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		log.Printf("%q: %s\n", err, sqlStmt)
+	if err = m.Up(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	var numUsers int
+	if err = db.QueryRow("SELECT count(*) FROM users").Scan(&numUsers); err != nil {
+		log.Fatal(err)
+	}
+	if numUsers > 0 {
+		log.Print("../jerver.db already holds data, not adding any")
 		return
 	}
 
@@ -81,8 +82,9 @@ func main() {
         FirstName,
         SecondName,
         Username,
-        HashedPwd)
-    VALUES (?, ?, ?, ?, ?)`)
+        HashedPwd,
+        Role)
+    VALUES (?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -98,25 +100,13 @@ func main() {
 		}
 
 		_, err = stmt.Exec(userUuids[i].Bytes(), user.FirstName,
-			user.SecondName, user.Username, hpwd)
+			user.SecondName, user.Username, hpwd, user.Role)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 	tx.Commit()
 
-	// CREATE THREADS TABLE
-	sqlStmt = `
-	CREATE TABLE threads (
-        Uuid blob NOT NULL PRIMARY KEY, 
-        Title text);
-	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		log.Printf("%q: %s\n", err, sqlStmt)
-		return
-	}
-
 	// POPULATE THREADS TABLE
 	tx, err = db.Begin()
 	if err != nil {
@@ -125,8 +115,9 @@ func main() {
 	stmt, err = tx.Prepare(`
     INSERT INTO threads(
         Uuid,
-        Title)
-    VALUES (?, ?)`)
+        Title,
+        Created)
+    VALUES (?, ?, ?)`)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -136,29 +127,13 @@ func main() {
 	for i, thread := range threads {
 		threadUuid, _ := uuid.NewV4()
 		threadUuids = append(threadUuids, threadUuid)
-		_, err = stmt.Exec(threadUuids[i].Bytes(), thread.Title)
+		_, err = stmt.Exec(threadUuids[i].Bytes(), thread.Title, time.Now().UTC())
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 	tx.Commit()
 
-	// CREATE MESSAGES TABLE
-	sqlStmt = `
-    CREATE TABLE messages (
-        Uuid blob NOT NULL PRIMARY KEY,
-        ThreadId blob NOT NULL,
-        AuthorId blob NOT NULL,
-        Content string,
-        FOREIGN KEY(ThreadId) REFERENCES threads(Uuid),
-        FOREIGN KEY(AuthorId) REFERENCES users(Uuid))
-    `
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		log.Printf("%q: %s\n", err, sqlStmt)
-		return
-	}
-
 	// POPULATE MESSAGES TABLE
 	tx, err = db.Begin()
 	if err != nil {
@@ -169,8 +144,9 @@ func main() {
         Uuid,
         ThreadId,
         AuthorId,
-        Content)
-    VALUES (?, ?, ?, ?)`)
+        Content,
+        Created)
+    VALUES (?, ?, ?, ?, ?)`)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -182,11 +158,22 @@ func main() {
 			messageUuid.Bytes(),
 			threadUuids[message.ThreadIndex].Bytes(),
 			userUuids[message.AuthorIndex].Bytes(),
-			message.Content)
+			message.Content,
+			time.Now().UTC())
 
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 	tx.Commit()
+
+	// FILL IN THREAD MESSAGE COUNTS
+	_, err = db.Exec(`
+    UPDATE threads SET
+        NumMsgs = (SELECT count(*) FROM messages WHERE messages.ThreadId = threads.Uuid),
+        LastMsgTime = (SELECT max(Created) FROM messages WHERE messages.ThreadId = threads.Uuid)
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
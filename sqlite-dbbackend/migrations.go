@@ -0,0 +1,88 @@
+package dbbackend
+
+import (
+	"context"
+	"database/sql"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/migrate"
+	"github.com/john-sharp/jerver/schema"
+)
+
+func noLock(ctx context.Context, conn *sql.Conn) error {
+	return nil
+}
+
+// sqlite serialises writers itself, an instance migrating at the same
+// time as another has its transaction fail instead of racing it, so no
+// further lock is taken
+var dialect = migrate.Dialect{
+	Lock:        noLock,
+	Unlock:      noLock,
+	Placeholder: "?",
+	Baseline:    baseline,
+}
+
+// baseline finds the version of a database made by an older makeDB,
+// which created the whole schema of the time without recording its
+// version
+func baseline(ctx context.Context, conn *sql.Conn) (int, error) {
+	hasColumn := func(table, column string) (bool, error) {
+		var n int
+		err := conn.QueryRowContext(ctx, `
+    SELECT
+        count(*)
+    FROM pragma_table_info(?)
+    WHERE name = ?`, table, column).Scan(&n)
+		return n > 0, err
+	}
+
+	checks := []struct {
+		table   string
+		column  string
+		version int
+	}{
+		{"threads", "NumMsgs", 2},
+		{"threads", "Created", 1},
+		{"users", "Uuid", 0},
+	}
+	for _, check := range checks {
+		found, err := hasColumn(check.table, check.column)
+		if err != nil {
+			return -1, err
+		}
+		if found {
+			return check.version, nil
+		}
+	}
+	return -1, nil
+}
+
+func newMigrator(db *sql.DB) (*migrate.Migrator, error) {
+	migrations, err := schema.Migrations(schema.Sqlite)
+	if err != nil {
+		return nil, err
+	}
+	return &migrate.Migrator{DB: db, Dialect: dialect, Migrations: migrations}, nil
+}
+
+// Migrator opens the database file named by config.DataSource for
+// running migrations against it. Unlike Open it does not need the
+// schema to be up to date. The caller closes the Migrator's DB
+func Migrator(config backend.Config) (*migrate.Migrator, error) {
+	db, err := sql.Open(driverName, config.DataSource)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkFts5(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	m, err := newMigrator(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,29 @@
+//go:build !sqlite_fts5
+
+package dbbackend
+
+import (
+	"errors"
+	"github.com/john-sharp/jerver/backend"
+	"path/filepath"
+	"testing"
+)
+
+// TestOpenWithoutFts5 checks that, built without FTS5, the backend
+// fails to open for good rather than with an error worth retrying
+func TestOpenWithoutFts5(t *testing.T) {
+	config := backend.Config{DataSource: filepath.Join(t.TempDir(), "jerver.db"), Migrate: true}
+
+	if b, err := Open(config); !errors.Is(err, backend.ErrUnsupported) {
+		if err == nil {
+			b.Close()
+		}
+		t.Errorf("Open: got %v, want %v", err, backend.ErrUnsupported)
+	}
+	if m, err := Migrator(config); !errors.Is(err, backend.ErrUnsupported) {
+		if err == nil {
+			m.DB.Close()
+		}
+		t.Errorf("Migrator: got %v, want %v", err, backend.ErrUnsupported)
+	}
+}
@@ -0,0 +1,132 @@
+package dbbackend
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"strings"
+)
+
+// checkFts5 reports backend.ErrUnsupported if the sqlite linked in was
+// built without FTS5, which the search tables are made with
+func checkFts5(db *sql.DB) error {
+	var used bool
+	err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&used)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return fmt.Errorf("%w: sqlite was built without FTS5, build jerver with -tags sqlite_fts5", backend.ErrUnsupported)
+	}
+	return nil
+}
+
+// snippetTokensSQL is about how many words snippet() gives around
+// the matches
+const snippetTokensSQL = "24"
+
+// searchResults returns SQL selecting the results of q, as Kind, Id,
+// ThreadId, AuthorId, Created, Snippet and Rank, with its arguments.
+// It is empty if q searches nothing
+func searchResults(q *backend.SearchQuery) (string, []interface{}) {
+	// the terms are only letters and digits, so can be quoted as they
+	// are, each being a phrase that must match
+	match := `"` + strings.Join(q.Terms, `" "`) + `"`
+	var args []interface{}
+	filter := func(where []string, created string) []string {
+		if q.Since != nil {
+			where = append(where, created+" >= ?")
+			args = append(args, q.Since.UTC())
+		}
+		if q.Until != nil {
+			where = append(where, created+" < ?")
+			args = append(args, q.Until.UTC())
+		}
+		return where
+	}
+
+	var selects []string
+	if q.Messages {
+		where := []string{"messagesSearch MATCH ?"}
+		args = append(args, match)
+		if q.AuthorId != nil {
+			where = append(where, "m.AuthorId = ?")
+			args = append(args, q.AuthorId.Bytes())
+		}
+		if q.ThreadId != nil {
+			where = append(where, "m.ThreadId = ?")
+			args = append(args, q.ThreadId.Bytes())
+		}
+		where = filter(where, "m.Created")
+		selects = append(selects, `
+        SELECT '`+string(entities.SearchMessage)+`' AS Kind, m.Uuid AS Id, m.ThreadId AS ThreadId, m.AuthorId AS AuthorId,
+            m.Created AS Created, snippet(messagesSearch, 0, char(2), char(3), '…', `+snippetTokensSQL+`) AS Snippet,
+            -bm25(messagesSearch) AS Rank
+        FROM messagesSearch
+            JOIN messagesSearchIds i ON i.Rowid = messagesSearch.rowid
+            JOIN messages m ON m.Uuid = i.Uuid
+        WHERE `+strings.Join(where, " AND "))
+	}
+	if q.Threads && q.AuthorId == nil {
+		where := []string{"threadsSearch MATCH ?"}
+		args = append(args, uuid.Nil.Bytes(), match)
+		if q.ThreadId != nil {
+			where = append(where, "t.Uuid = ?")
+			args = append(args, q.ThreadId.Bytes())
+		}
+		where = filter(where, "t.Created")
+		selects = append(selects, `
+        SELECT '`+string(entities.SearchThread)+`' AS Kind, t.Uuid AS Id, t.Uuid AS ThreadId, ? AS AuthorId,
+            t.Created AS Created, snippet(threadsSearch, 0, char(2), char(3), '…', `+snippetTokensSQL+`) AS Snippet,
+            -bm25(threadsSearch) AS Rank
+        FROM threadsSearch
+            JOIN threadsSearchIds i ON i.Rowid = threadsSearch.rowid
+            JOIN threads t ON t.Uuid = i.Uuid
+        WHERE `+strings.Join(where, " AND "))
+	}
+
+	return strings.Join(selects, "\n        UNION ALL"), args
+}
+
+func (b *Backend) Search(ctx context.Context, q *backend.SearchQuery, count uint64, page int64, appendToCollection func(entities.SearchResult)) error {
+	results, args := searchResults(q)
+	if results == "" {
+		return nil
+	}
+	offset := page * int64(count)
+	args = append(args, count, offset)
+
+	rows, err := b.db.QueryContext(ctx, `
+    SELECT Kind, Id, ThreadId, AuthorId, Created, Snippet, Rank
+    FROM (`+results+`)
+    ORDER BY Rank DESC, Created DESC, Id
+    LIMIT ? OFFSET ?`, args...)
+	if err != nil {
+		return translateError(err, "search result")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r entities.SearchResult
+		if err = rows.Scan(&r.Kind, &r.Id, &r.ThreadId, &r.AuthorId, &r.Created, &r.Snippet, &r.Rank); err != nil {
+			return translateError(err, "search result")
+		}
+		appendToCollection(r)
+	}
+	return translateError(rows.Err(), "search result")
+}
+
+func (b *Backend) SearchTotal(ctx context.Context, q *backend.SearchQuery) (uint, error) {
+	results, args := searchResults(q)
+	if results == "" {
+		return 0, nil
+	}
+
+	ret := uint(0)
+	err := b.db.QueryRowContext(ctx, `
+    SELECT count(*)
+    FROM (`+results+`)`, args...).Scan(&ret)
+	return ret, translateError(err, "search result")
+}
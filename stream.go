@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"gitlab.com/johncolinsharp/entitycoll"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// events kept for clients resuming a stream, and queued for each
+// client before it is dropped for not keeping up
+const (
+	streamBacklog = 1024
+	streamQueue   = 64
+)
+
+const (
+	streamKeepAlive    = 30 * time.Second
+	streamWriteTimeout = 10 * time.Second
+)
+
+// eventReset tells a resuming client that events it missed are no
+// longer kept, so it must fetch the thread's messages again
+const eventReset = "reset"
+
+// messageEvent is sent on the streams of a thread when one of its
+// messages changes. Message is absent from deletions
+type messageEvent struct {
+	Id        string
+	Type      backend.EventType
+	ThreadId  uuid.UUID
+	MessageId uuid.UUID
+	Message   *publicMessage `json:",omitempty"`
+	seq       uint64
+}
+
+// streamReset is sent in place of the events a client missed when
+// they cannot be replayed
+type streamReset struct {
+	Type     string
+	ThreadId uuid.UUID
+}
+
+type streamSubscriber struct {
+	threadId uuid.UUID
+	events   chan messageEvent
+}
+
+// messageBroker passes the message events of the backend on to the
+// streams of their thread, keeping the most recent so that clients can
+// resume after reconnecting. Event ids are an epoch, which changes each
+// time the server starts or events are lost, followed by '-' and a
+// sequence number
+type messageBroker struct {
+	mu      sync.Mutex
+	epoch   string
+	seq     uint64
+	backlog []messageEvent
+	subs    map[uuid.UUID]map[*streamSubscriber]struct{}
+	closed  bool
+}
+
+var messageEvents = newMessageBroker()
+
+func newMessageBroker() *messageBroker {
+	return &messageBroker{
+		epoch: newStreamEpoch(),
+		subs:  map[uuid.UUID]map[*streamSubscriber]struct{}{},
+	}
+}
+
+func newStreamEpoch() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// handle is subscribed to the backend, the messages created and edited
+// are read from it as events only carry their ids
+func (b *messageBroker) handle(e backend.Event) {
+	switch e.Type {
+	case backend.MessageCreated, backend.MessageEdited:
+		// to the streams of each thread a moved message leaves one
+		// and joins the other
+		typ := e.Type
+		if !uuid.Equal(e.PrevThreadId, uuid.Nil) {
+			b.publish(backend.MessageDeleted, &entities.Message{Id: e.MessageId, ThreadId: e.PrevThreadId})
+			typ = backend.MessageCreated
+		}
+
+		m, err := messages.getByUuid(context.Background(), e.MessageId)
+		if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+			// deleted since, which has an event of its own
+			return
+		}
+		if err != nil {
+			log.Print(err)
+			b.reset()
+			return
+		}
+		m.ThreadId = e.ThreadId
+		b.publish(typ, m)
+	case backend.MessageDeleted:
+		b.publish(e.Type, &entities.Message{Id: e.MessageId, ThreadId: e.ThreadId})
+	case backend.ThreadDeleted:
+		b.endThread(e.ThreadId)
+	case backend.EventsLost:
+		b.reset()
+	}
+}
+
+// publish sends an event of type typ about m to the streams of its
+// thread
+func (b *messageBroker) publish(typ backend.EventType, m *entities.Message) {
+	e := messageEvent{Type: typ, ThreadId: m.ThreadId, MessageId: m.Id}
+	if typ != backend.MessageDeleted {
+		p := publicMessage(*m)
+		e.Message = &p
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	b.seq++
+	e.seq = b.seq
+	e.Id = b.epoch + "-" + strconv.FormatUint(b.seq, 10)
+	if len(b.backlog) == streamBacklog {
+		b.backlog = b.backlog[1:]
+	}
+	b.backlog = append(b.backlog, e)
+
+	for s := range b.subs[e.ThreadId] {
+		select {
+		case s.events <- e:
+		default:
+			// the client reconnects when its stream ends, and can
+			// resume from the backlog
+			b.remove(s)
+		}
+	}
+}
+
+// subscribe starts a stream of the events of threadId. Events after
+// lastEventId are returned to be sent first, or reset is true when
+// they are no longer all kept
+func (b *messageBroker) subscribe(threadId uuid.UUID, lastEventId string) (s *streamSubscriber, missed []messageEvent, reset bool) {
+	s = &streamSubscriber{threadId: threadId, events: make(chan messageEvent, streamQueue)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(s.events)
+		return s, nil, false
+	}
+
+	if b.subs[threadId] == nil {
+		b.subs[threadId] = map[*streamSubscriber]struct{}{}
+	}
+	b.subs[threadId][s] = struct{}{}
+
+	if lastEventId == "" {
+		return s, nil, false
+	}
+	last, ok := b.parseEventId(lastEventId)
+	// there is a backlog whenever last < b.seq
+	if !ok || last > b.seq || (last < b.seq && last+1 < b.backlog[0].seq) {
+		return s, nil, true
+	}
+	for _, e := range b.backlog {
+		if e.seq > last && uuid.Equal(e.ThreadId, threadId) {
+			missed = append(missed, e)
+		}
+	}
+	return s, missed, false
+}
+
+// parseEventId returns the sequence number of an event id from this
+// epoch
+func (b *messageBroker) parseEventId(id string) (uint64, bool) {
+	dash := strings.LastIndexByte(id, '-')
+	if dash == -1 || id[:dash] != b.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(id[dash+1:], 10, 64)
+	return seq, err == nil
+}
+
+// unsubscribe ends the stream of s, if the broker has not already
+func (b *messageBroker) unsubscribe(s *streamSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s.threadId][s]; ok {
+		b.remove(s)
+	}
+}
+
+// remove ends the stream of s, callers must hold mu
+func (b *messageBroker) remove(s *streamSubscriber) {
+	delete(b.subs[s.threadId], s)
+	if len(b.subs[s.threadId]) == 0 {
+		delete(b.subs, s.threadId)
+	}
+	close(s.events)
+}
+
+// endThread ends the streams of a deleted thread
+func (b *messageBroker) endThread(threadId uuid.UUID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs[threadId] {
+		b.remove(s)
+	}
+}
+
+// reset starts a new epoch, forgetting the backlog and ending every
+// stream, so that clients reconnecting are told to fetch their thread
+// again
+func (b *messageBroker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.epoch = newStreamEpoch()
+	b.backlog = nil
+	b.removeAll()
+}
+
+// close ends every stream, as http.Server.Shutdown waits for them
+func (b *messageBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.removeAll()
+}
+
+// removeAll ends every stream, callers must hold mu
+func (b *messageBroker) removeAll() {
+	for _, subs := range b.subs {
+		for s := range subs {
+			b.remove(s)
+		}
+	}
+}
+
+// authenticateStream is authenticateRequest also accepting an access
+// token or API key in the access_token query parameter, as browsers
+// cannot set headers on EventSource and WebSocket connections
+func authenticateStream(r *http.Request) (entitycoll.Entity, error) {
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return users.verifyBearer(r.Context(), token)
+	}
+	return authenticateRequest(r)
+}
+
+// streamHandler serves GETs of /threads/{id}/stream, streaming the
+// events of the thread's messages as Server-Sent Events, or over a
+// WebSocket when the request is to upgrade to one. Clients resume
+// with the Last-Event-ID header, or lastEventId query parameter
+func streamHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if r.Method != "GET" || len(path) != 3 || path[0] != threads.GetRestName() || path[2] != "stream" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		threadId, err := uuid.FromString(path[1])
+		if err != nil {
+			writeError(w, entities.NewError(entities.Validation, "malformed thread id"))
+			return
+		}
+
+		w.Header().Add("Access-Control-Allow-Origin", conf.AllowOrigin)
+		requestor, err := authenticateStream(r)
+		if err != nil {
+			w.Header().Add("WWW-Authenticate", "Basic realm=\"a\"")
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+
+		if err = authorize(requestor, messages.GetRestName(), actionRead); err != nil {
+			writeError(w, err)
+			return
+		}
+		if _, err = threads.getByUuid(r.Context(), threadId); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if websocket.IsWebSocketUpgrade(r) {
+			serveWebSocket(w, r, threadId)
+			return
+		}
+		serveEventStream(w, r, threadId)
+	})
+}
+
+func writeEvent(w io.Writer, id, typ string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typ, data)
+	return err
+}
+
+func serveEventStream(w http.ResponseWriter, r *http.Request, threadId uuid.UUID) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errors.New("response writer cannot stream"))
+		return
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+	s, missed, reset := messageEvents.subscribe(threadId, lastEventId)
+	defer messageEvents.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	if reset {
+		writeEvent(w, "", eventReset, streamReset{Type: eventReset, ThreadId: threadId})
+	}
+	for _, e := range missed {
+		writeEvent(w, e.Id, string(e.Type), e)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				return
+			}
+			err = writeEvent(w, e.Id, string(e.Type), e)
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	// browsers send the origin of the page, which must be the one
+	// allowed to use the API, other clients send none
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || conf.AllowOrigin == "*" || origin == conf.AllowOrigin
+	},
+}
+
+// serveWebSocket sends events as JSON text messages, the type of each
+// being in its Type
+func serveWebSocket(w http.ResponseWriter, r *http.Request, threadId uuid.UUID) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has responded
+		return
+	}
+	defer conn.Close()
+
+	s, missed, reset := messageEvents.subscribe(threadId, r.URL.Query().Get("lastEventId"))
+	defer messageEvents.unsubscribe(s)
+
+	// clients only send control messages, which reading handles, and
+	// reading notices the connection closing
+	conn.SetReadLimit(512)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(v interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return conn.WriteJSON(v)
+	}
+	if reset {
+		if write(streamReset{Type: eventReset, ThreadId: threadId}) != nil {
+			return
+		}
+	}
+	for _, e := range missed {
+		if write(e) != nil {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(streamWriteTimeout))
+				return
+			}
+			if write(e) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)) != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -2,10 +2,11 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
+	"github.com/john-sharp/jerver/backend"
 	"github.com/john-sharp/jerver/entities"
 	"github.com/satori/go.uuid"
 	"gitlab.com/johncolinsharp/entitycoll"
+	"time"
 )
 
 func (t *thread) verifyAndParseNew(b []byte) error {
@@ -16,15 +17,16 @@ func (t *thread) verifyAndParseNew(b []byte) error {
 	err := json.Unmarshal(b, &data)
 
 	if err != nil {
-		return err
+		return entities.WrapError(entities.Validation, "malformed thread", err)
 	}
 
 	if data.Title == nil {
-		return errors.New("thread Title not set when required")
+		return entities.NewError(entities.Validation, "thread Title not set when required")
 	}
 
 	t.Id, _ = uuid.NewV4()
 	t.Title = *data.Title
+	t.Created = time.Now().UTC()
 	return nil
 }
 
@@ -52,39 +54,39 @@ func (tc *threadCollection) GetParentCollection() entitycoll.APINode {
 func (tc *threadCollection) CreateEntity(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID, body []byte) (string, error) {
 	var t threadNew
 	err := json.Unmarshal(body, &t)
+	if err != nil {
+		return "", entities.WrapError(entities.Validation, "malformed thread", err)
+	}
+
+	err = tc.create(requestContext(requestor), (*entities.Thread)(&t))
 	if err != nil {
 		return "", err
 	}
 
-	err = tc.create((*entities.Thread)(&t))
 	path := "/" + tc.GetRestName() + "/" + t.Id.String()
 	return path, nil
 }
 
 func (tc *threadCollection) GetEntity(requestor entitycoll.Entity, targetUuid uuid.UUID) (entitycoll.Entity, error) {
-	return tc.getByUuid(targetUuid)
+	return tc.getByUuid(requestContext(requestor), targetUuid)
 }
 
 func (tc *threadCollection) GetCollection(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID, filter entitycoll.CollFilter) (entitycoll.Collection, error) {
 	var ec entitycoll.Collection
 
-	count := uint64(10)
-	page := int64(0)
-	if filter.Page != nil {
-		page = *filter.Page
-	}
-	if filter.Count != nil {
-		count = *filter.Count
+	count, page, err := checkPage(filter)
+	if err != nil {
+		return entitycoll.Collection{}, err
 	}
 
-	var err error
-	ec.Entities, err = tc.getCollection(count, page)
+	ctx := requestContext(requestor)
+	ec.Entities, err = tc.getCollection(ctx, count, page)
 
 	if err != nil {
 		return entitycoll.Collection{}, err
 	}
 
-	ec.TotalEntities, err = tc.getTotal()
+	ec.TotalEntities, err = tc.getTotal(ctx)
 
 	if err != nil {
 		return entitycoll.Collection{}, err
@@ -93,21 +95,53 @@ func (tc *threadCollection) GetCollection(requestor entitycoll.Entity, parentEnt
 	return ec, nil
 }
 
+func (tc *threadCollection) GetCursorCollection(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID, cursor string, count uint64) (cursorCollection, error) {
+	var cc cursorCollection
+
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return cursorCollection{}, err
+	}
+
+	var next *backend.Cursor
+	ctx := requestContext(requestor)
+	cc.Entities, next, err = tc.getCollectionAfter(ctx, after, count)
+
+	if err != nil {
+		return cursorCollection{}, err
+	}
+	cc.NextCursor = encodeCursor(next)
+
+	cc.TotalEntities, err = tc.getTotal(ctx)
+
+	if err != nil {
+		return cursorCollection{}, err
+	}
+
+	return cc, nil
+}
+
 func (tc *threadCollection) EditEntity(requestor entitycoll.Entity, targetUuid uuid.UUID, body []byte) error {
 	var edit entities.ThreadEdit
 
 	err := json.Unmarshal(body, &edit)
 	if err != nil {
-		return err
+		return entities.WrapError(entities.Validation, "malformed thread edit", err)
 	}
 
 	if edit.Title == nil {
 		return nil
 	}
+	if err = authorizeThreadId(requestor, targetUuid); err != nil {
+		return err
+	}
 
-	return tc.editByUuid(targetUuid, &edit)
+	return tc.editByUuid(requestContext(requestor), targetUuid, &edit)
 }
 
 func (tc *threadCollection) DelEntity(requestor entitycoll.Entity, targetUuid uuid.UUID) error {
-	return tc.deleteByUuid(targetUuid)
+	if err := authorizeThreadId(requestor, targetUuid); err != nil {
+		return err
+	}
+	return tc.deleteByUuid(requestContext(requestor), targetUuid)
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// failed logins allowed to an account, and from an address, before
+// they are locked out. Addresses get more as they may be shared
+const (
+	accountFreeAttempts = 5
+	addrFreeAttempts    = 20
+)
+
+// the throttle forgets keys once there are this many, keeping only
+// those still locked out
+const maxThrottleKeys = 100000
+
+// failures counts the recent failed logins of an account or address
+type failures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginThrottle locks accounts and addresses out after repeated failed
+// logins, for LoginLockoutBase doubling with each further failure up
+// to LoginLockoutMax. Counts are kept in memory, so are per instance
+// of the server
+type loginThrottle struct {
+	mu    sync.Mutex
+	byKey map[string]*failures
+}
+
+var throttle = loginThrottle{byKey: map[string]*failures{}}
+
+func accountKey(uname string) string {
+	return "account:" + strings.ToLower(uname)
+}
+
+func addrKey(addr string) string {
+	return "addr:" + addr
+}
+
+// wait returns how much longer key is locked out for
+func (t *loginThrottle) wait(key string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if f, ok := t.byKey[key]; ok && now.Before(f.lockedUntil) {
+		return f.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// fail records a failed login for key, which is allowed free failures
+// before being locked out, and reports whether it now is
+func (t *loginThrottle) fail(key string, free int, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	maxLockout := time.Duration(conf.LoginLockoutMax)
+	f, ok := t.byKey[key]
+	if !ok || now.Sub(f.last) > maxLockout {
+		if len(t.byKey) >= maxThrottleKeys {
+			t.prune(now)
+		}
+		f = &failures{}
+		t.byKey[key] = f
+	}
+	f.count++
+	f.last = now
+
+	if f.count <= free {
+		return false
+	}
+
+	lockout := time.Duration(conf.LoginLockoutBase)
+	for i := free + 1; i < f.count && lockout < maxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > maxLockout {
+		lockout = maxLockout
+	}
+	f.lockedUntil = now.Add(lockout)
+	return true
+}
+
+// succeed forgets the failures of key
+func (t *loginThrottle) succeed(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.byKey, key)
+}
+
+// prune drops the keys that are not locked out, callers must hold mu
+func (t *loginThrottle) prune(now time.Time) {
+	for key, f := range t.byKey {
+		if !now.Before(f.lockedUntil) {
+			delete(t.byKey, key)
+		}
+	}
+}
+
+// remoteAddr is the address a request came from, without the port
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
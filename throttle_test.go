@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	conf = defaultConfig
+	conf.LoginLockoutBase = duration(time.Second)
+	conf.LoginLockoutMax = duration(8 * time.Second)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		free     int
+		failures int
+		// gap is the time between failures
+		gap time.Duration
+		// then what is asked of the throttle after the last failure
+		locked bool
+		wait   time.Duration
+	}{
+		{"under free attempts", 3, 2, 0, false, 0},
+		{"at free attempts", 3, 3, 0, false, 0},
+		{"first lockout", 3, 4, 0, true, time.Second},
+		{"doubles", 3, 5, 0, true, 2 * time.Second},
+		{"doubles again", 3, 6, 0, true, 4 * time.Second},
+		{"reaches max", 3, 7, 0, true, 8 * time.Second},
+		{"capped at max", 3, 20, 0, true, 8 * time.Second},
+		{"no free attempts", 0, 1, 0, true, time.Second},
+		{"slow failures add up", 3, 5, 5 * time.Second, true, 2 * time.Second},
+		{"failures forgotten after max lockout", 3, 5, 9 * time.Second, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lt := loginThrottle{byKey: map[string]*failures{}}
+			now := start
+			locked := false
+			for i := 0; i < test.failures; i++ {
+				if i > 0 {
+					now = now.Add(test.gap)
+				}
+				locked = lt.fail("key", test.free, now)
+			}
+			if locked != test.locked {
+				t.Fatalf("locked %v, want %v", locked, test.locked)
+			}
+			if wait := lt.wait("key", now); wait != test.wait {
+				t.Fatalf("wait %s, want %s", wait, test.wait)
+			}
+			if wait := lt.wait("other", now); wait != 0 {
+				t.Fatalf("other key waits %s", wait)
+			}
+		})
+	}
+}
+
+func TestLoginThrottleSucceed(t *testing.T) {
+	conf = defaultConfig
+	conf.LoginLockoutBase = duration(time.Second)
+	conf.LoginLockoutMax = duration(time.Minute)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	lt := loginThrottle{byKey: map[string]*failures{}}
+	for i := 0; i < 3; i++ {
+		lt.fail(accountKey("Bob"), 2, now)
+	}
+	if lt.wait(accountKey("bob"), now) == 0 {
+		t.Fatal("account keys should ignore case")
+	}
+	if lt.wait(accountKey("bob"), now.Add(time.Second)) != 0 {
+		t.Fatal("lockout should end")
+	}
+
+	lt.succeed(accountKey("bob"))
+	if lt.fail(accountKey("bob"), 2, now) {
+		t.Fatal("failures should be forgotten on success")
+	}
+}
+
+func TestLoginThrottlePrune(t *testing.T) {
+	conf = defaultConfig
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	lt := loginThrottle{byKey: map[string]*failures{
+		"locked":   {count: 9, last: now, lockedUntil: now.Add(time.Minute)},
+		"unlocked": {count: 1, last: now},
+		"expired":  {count: 9, last: now, lockedUntil: now},
+	}}
+	lt.prune(now)
+	if _, ok := lt.byKey["locked"]; !ok || len(lt.byKey) != 1 {
+		t.Fatalf("kept %v, want only the locked key", lt.byKey)
+	}
+}
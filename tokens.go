@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"gitlab.com/johncolinsharp/entitycoll"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenKey signs access tokens, set by main from the TokenSecret
+// setting or randomly when that is empty
+var tokenKey []byte
+
+// accessClaims is the signed content of an access token. Gen is the
+// TokenGeneration of the user it was issued to
+type accessClaims struct {
+	Sub uuid.UUID
+	Gen int64
+	Exp int64
+}
+
+var errBadToken = entities.NewError(entities.Unauthorized, "invalid or expired access token")
+
+func newTokenKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+func tokenMAC(payload string) []byte {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// signAccessToken returns an access token for u and its expiry. Tokens
+// are the claims as base64 JSON followed by '.' and the base64
+// HMAC-SHA256 of that
+func signAccessToken(u *user, now time.Time) (string, time.Time) {
+	expires := now.Add(time.Duration(conf.AccessTokenTTL))
+	b, _ := json.Marshal(accessClaims{Sub: u.Uuid, Gen: u.TokenGeneration, Exp: expires.Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(payload)), expires
+}
+
+// parseAccessToken checks the signature and expiry of token and returns
+// its claims
+func parseAccessToken(token string, now time.Time) (*accessClaims, error) {
+	dot := strings.IndexByte(token, '.')
+	if dot == -1 {
+		return nil, errBadToken
+	}
+	payload := token[:dot]
+
+	mac, err := base64.RawURLEncoding.DecodeString(token[dot+1:])
+	if err != nil || !hmac.Equal(mac, tokenMAC(payload)) {
+		return nil, errBadToken
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errBadToken
+	}
+	var claims accessClaims
+	if err = json.Unmarshal(b, &claims); err != nil || now.Unix() >= claims.Exp {
+		return nil, errBadToken
+	}
+	return &claims, nil
+}
+
+// newToken returns a random refresh or password reset token
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// tokenId is what a refresh or password reset token is stored under,
+// so that the tokens themselves are never stored
+func tokenId(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenResponse is the body sent on logging in and refreshing
+type tokenResponse struct {
+	TokenType           string
+	AccessToken         string
+	AccessTokenExpires  time.Time
+	RefreshToken        string
+	RefreshTokenExpires time.Time
+}
+
+// issueTokens starts a new session for u
+func (uc *userCollection) issueTokens(ctx context.Context, u *user) (*tokenResponse, error) {
+	now := time.Now().UTC()
+	refreshToken, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	s := entities.Session{
+		Id:      tokenId(refreshToken),
+		UserId:  u.Uuid,
+		Created: now,
+		Expires: now.Add(time.Duration(conf.RefreshTokenTTL)),
+	}
+	if err := uc.createSession(ctx, &s); err != nil {
+		return nil, err
+	}
+
+	accessToken, accessExpires := signAccessToken(u, now)
+	return &tokenResponse{
+		TokenType:           "Bearer",
+		AccessToken:         accessToken,
+		AccessTokenExpires:  accessExpires,
+		RefreshToken:        refreshToken,
+		RefreshTokenExpires: s.Expires,
+	}, nil
+}
+
+// refresh swaps a refresh token for a new access token and refresh
+// token, the old refresh token cannot be used again
+func (uc *userCollection) refresh(ctx context.Context, refreshToken string) (*tokenResponse, error) {
+	s, err := uc.takeSession(ctx, tokenId(refreshToken))
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+		return nil, entities.NewError(entities.Unauthorized, "invalid refresh token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(s.Expires) {
+		return nil, entities.NewError(entities.Unauthorized, "refresh token has expired")
+	}
+
+	u, err := uc.getUserByUuid(ctx, s.UserId)
+	if err != nil {
+		return nil, err
+	}
+	return uc.issueTokens(ctx, (*user)(u))
+}
+
+// verifyToken finds the user an access token was issued to, refusing
+// tokens issued before its password was last set
+func (uc *userCollection) verifyToken(ctx context.Context, token string) (entitycoll.Entity, error) {
+	claims, err := parseAccessToken(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := uc.getUserByUuid(ctx, claims.Sub)
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+		return nil, errBadToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.TokenGeneration != claims.Gen {
+		return nil, errBadToken
+	}
+	return (*user)(u), nil
+}
+
+// bearerUsername stands in for the username when authHandler passes an
+// access token or API key on to entitycoll as Basic credentials,
+// followed by the key the context of the request is held under. It is
+// not a valid username, so cannot belong to a user
+const bearerUsername = "*bearer*"
+
+// requestContexts holds the context of each request authHandler passes
+// on to entitycoll, while it is served, under a key of its own, so
+// that authorizeUser finds the context of that request and no other
+var requestContexts sync.Map // key -> context.Context
+
+// holdRequestContext holds ctx under a new key, returning the key and a
+// func releasing it for once the request has been served
+func holdRequestContext(ctx context.Context) (string, func(), error) {
+	key, err := newToken()
+	if err != nil {
+		return "", nil, err
+	}
+	requestContexts.Store(key, ctx)
+	return key, func() { requestContexts.Delete(key) }, nil
+}
+
+// heldRequestContext finds the context held under key
+func heldRequestContext(key string) (context.Context, bool) {
+	ctx, ok := requestContexts.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return ctx.(context.Context), true
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return auth[len("Bearer "):], true
+	}
+	return "", false
+}
+
+// authHandler passes Bearer tokens on to entitycoll, which only
+// understands Basic credentials, so that authorizeUser receives them
+// with the key the context of the request is held under. Basic
+// credentials are checked here, where the address they come from is
+// known for throttling failures, and replaced by an access token.
+// entitycoll must only be reached through authHandler, as authorizeUser
+// refuses credentials it has not passed on. /verification reads
+// credentials itself so is left alone
+func authHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/verification") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := bearerToken(r)
+		if uname, pwd, basic := r.BasicAuth(); basic && !strings.HasPrefix(uname, bearerUsername) && bool(conf.BasicAuth) {
+			u, err := users.verifyUser(r.Context(), uname, pwd, remoteAddr(r))
+			if err != nil {
+				w.Header().Add("WWW-Authenticate", "Basic realm=\"a\"")
+				writeError(w, err)
+				return
+			}
+			token, _ = signAccessToken(u.(*user), time.Now())
+			ok = true
+		}
+
+		if ok {
+			key, release, err := holdRequestContext(r.Context())
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			defer release()
+			r = r.Clone(r.Context())
+			r.SetBasicAuth(bearerUsername+key, token)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readCredentials takes the username and password to log in with from
+// Basic credentials, or failing that from a JSON body
+func readCredentials(r *http.Request) (string, string, error) {
+	if uname, pwd, ok := r.BasicAuth(); ok {
+		return uname, pwd, nil
+	}
+
+	var body struct {
+		Username string
+		Password string
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<16)).Decode(&body); err != nil {
+		return "", "", entities.NewError(entities.Unauthorized, "no credentials supplied")
+	}
+	return body.Username, body.Password, nil
+}
+
+// loginHandler serves POSTs to /verification, exchanging a username
+// and password for an access token and refresh token
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	uname, pwd, err := readCredentials(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	u, err := users.verifyUser(r.Context(), uname, pwd, remoteAddr(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	tokens, err := users.issueTokens(r.Context(), u.(*user))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// readRefreshToken takes the refresh token from the JSON body of r
+func readRefreshToken(r *http.Request) (string, error) {
+	var body struct {
+		RefreshToken string
+	}
+	err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<16)).Decode(&body)
+	if err != nil || body.RefreshToken == "" {
+		return "", entities.NewError(entities.Validation, "no refresh token supplied")
+	}
+	return body.RefreshToken, nil
+}
+
+// refreshHandler serves /verification/refresh
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", conf.AllowOrigin)
+	if r.Method == "OPTIONS" {
+		w.Header().Add("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Add("Access-Control-Allow-Methods", "POST")
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	refreshToken, err := readRefreshToken(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	tokens, err := users.refresh(r.Context(), refreshToken)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// logoutHandler serves /verification/logout, revoking the refresh
+// token in the body. Access tokens already issued run until they expire
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", conf.AllowOrigin)
+	if r.Method == "OPTIONS" {
+		w.Header().Add("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Add("Access-Control-Allow-Methods", "POST")
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	refreshToken, err := readRefreshToken(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	_, err = users.takeSession(r.Context(), tokenId(refreshToken))
+	if kind, _ := entities.ErrorKindOf(err); err != nil && kind != entities.NotFound {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
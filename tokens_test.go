@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseAccessToken(t *testing.T) {
+	conf = defaultConfig
+	conf.AccessTokenTTL = duration(15 * time.Minute)
+	tokenKey = []byte("test key")
+
+	id, _ := uuid.NewV4()
+	issued := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	token, expires := signAccessToken(&user{Uuid: id, TokenGeneration: 3}, issued)
+	payload, mac := token[:strings.IndexByte(token, '.')], token[strings.IndexByte(token, '.')+1:]
+
+	// flip changes the first character of s to another valid base64 one
+	flip := func(s string) string {
+		if s[0] == 'A' {
+			return "B" + s[1:]
+		}
+		return "A" + s[1:]
+	}
+	resigned := func(claims string) string {
+		p := base64.RawURLEncoding.EncodeToString([]byte(claims))
+		return p + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(p))
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		ok    bool
+	}{
+		{"valid", token, issued, true},
+		{"just before expiry", token, expires.Add(-time.Second), true},
+		{"at expiry", token, expires, false},
+		{"after expiry", token, expires.Add(time.Hour), false},
+		{"tampered payload", flip(payload) + "." + mac, issued, false},
+		{"tampered mac", payload + "." + flip(mac), issued, false},
+		{"no mac", payload, issued, false},
+		{"empty mac", payload + ".", issued, false},
+		{"mac not base64", payload + ".!!", issued, false},
+		{"empty", "", issued, false},
+		{"signed, not json", resigned("claims"), issued, false},
+		{"signed, no expiry", resigned(`{"Sub":"` + id.String() + `"}`), issued, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := parseAccessToken(test.token, test.now)
+			if !test.ok {
+				if err != errBadToken {
+					t.Fatalf("got %+v, %v, want errBadToken", claims, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !uuid.Equal(claims.Sub, id) || claims.Gen != 3 || claims.Exp != expires.Unix() {
+				t.Fatalf("got claims %+v", claims)
+			}
+		})
+	}
+
+	t.Run("other key", func(t *testing.T) {
+		tokenKey = []byte("other key")
+		defer func() { tokenKey = []byte("test key") }()
+		if _, err := parseAccessToken(token, issued); err != errBadToken {
+			t.Fatalf("got %v, want errBadToken", err)
+		}
+	})
+}
+
+// heldRequestContexts counts the request contexts held by authHandler
+func heldRequestContexts() int {
+	n := 0
+	requestContexts.Range(func(key, ctx interface{}) bool {
+		n += 1
+		return true
+	})
+	return n
+}
+
+type requestNumberKey struct{}
+
+// TestAuthHandlerRequestContext makes requests by the same user at
+// once, checking each reaches the collections with its own context, and
+// that none is held once they have been served
+func TestAuthHandlerRequestContext(t *testing.T) {
+	testMemoryBackend(t)
+	conf.BasicAuth = true
+	tokenKey = []byte("test key")
+	u, err := users.getUserByUsername(context.Background(), "hasquith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := signAccessToken((*user)(u), time.Now())
+
+	const n = 20
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	// stands in for entitycoll, authorizing the credentials passed on
+	// once every request is being served
+	collections := authHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+
+		uname, pwd, _ := r.BasicAuth()
+		requestor, err := authorizeUser(uname, pwd)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if got, ok := requestorUser(requestor); !ok || !uuid.Equal(got.Uuid, u.Uuid) {
+			http.Error(w, "wrong requestor", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, requestContext(requestor).Value(requestNumberKey{}))
+	}))
+
+	var served sync.WaitGroup
+	for i := 0; i < n; i++ {
+		served.Add(1)
+		go func(i int) {
+			defer served.Done()
+			ctx := context.WithValue(context.Background(), requestNumberKey{}, i)
+			r := httptest.NewRequest("GET", "/threads", nil).WithContext(ctx)
+			// some log in with Basic credentials, which authHandler
+			// swaps for an access token
+			if i%4 == 0 {
+				r.SetBasicAuth("hasquith", "1908")
+			} else {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			collections.ServeHTTP(w, r)
+			if w.Code != http.StatusOK || w.Body.String() != fmt.Sprint(i) {
+				t.Errorf("request %d: got %d %q, want its own context", i, w.Code, w.Body.String())
+			}
+		}(i)
+	}
+	served.Wait()
+
+	if held := heldRequestContexts(); held != 0 {
+		t.Fatalf("%d request contexts still held", held)
+	}
+}
+
+// TestAuthHandlerReleasesPanicking checks the context of a request is
+// released when serving it panics
+func TestAuthHandlerReleasesPanicking(t *testing.T) {
+	conf = defaultConfig
+	tokenKey = []byte("test key")
+	h := authHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if heldRequestContexts() != 1 {
+			t.Error("request context not held")
+		}
+		panic(http.ErrAbortHandler)
+	}))
+
+	r := httptest.NewRequest("GET", "/threads", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	func() {
+		defer func() { recover() }()
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+	if held := heldRequestContexts(); held != 0 {
+		t.Fatalf("%d request contexts still held", held)
+	}
+}
+
+// TestAuthorizeUserNotPassedOn checks credentials that did not come
+// through authHandler are refused, rather than the request being served
+// without its context
+func TestAuthorizeUserNotPassedOn(t *testing.T) {
+	conf = defaultConfig
+	tokenKey = []byte("test key")
+	id, _ := uuid.NewV4()
+	token, _ := signAccessToken(&user{Uuid: id}, time.Now())
+	released, release, err := holdRequestContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	tests := []struct {
+		name      string
+		basicAuth bool
+		uname     string
+		pwd       string
+		err       error
+	}{
+		{"Basic credentials", true, "hasquith", "1908", errNotPassedOn},
+		{"Basic credentials when disabled", false, "hasquith", "1908", errBasicAuthDisabled},
+		{"no key", true, bearerUsername, token, errNotPassedOn},
+		{"unknown key", true, bearerUsername + "unknown", token, errNotPassedOn},
+		{"released key", true, bearerUsername + released, token, errNotPassedOn},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf.BasicAuth = boolValue(test.basicAuth)
+			if requestor, err := authorizeUser(test.uname, test.pwd); err != test.err {
+				t.Fatalf("got %v, %v, want %v", requestor, err, test.err)
+			}
+		})
+	}
+}
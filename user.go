@@ -1,18 +1,31 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/john-sharp/jerver/entities"
+	"github.com/john-sharp/jerver/pwhash"
 	"github.com/satori/go.uuid"
 	"gitlab.com/johncolinsharp/entitycoll"
-	"golang.org/x/crypto/bcrypt"
 	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 type user entities.User
 
+// hashPassword returns the hash stored for the password pwd, made as
+// the PasswordHash setting says
+func hashPassword(pwd string) ([]byte, error) {
+	return pwhash.Hash(conf.passwordHashParams(), []byte(pwd))
+}
+
 func (u *user) popNew(fname, sname, uname, pwd string) error {
-	hpwd, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.DefaultCost)
+	hpwd, err := hashPassword(pwd)
 
 	if err != nil {
 		return err
@@ -27,19 +40,104 @@ func (u *user) popNew(fname, sname, uname, pwd string) error {
 	return nil
 }
 
-func (uc *userCollection) verifyUser(uname, pwd string) (entitycoll.Entity, error) {
-	u, err := uc.getUserByUsername(uname)
+var errBadCredentials = entities.NewError(entities.Unauthorized, "incorrect username or password")
 
-	if err != nil {
-		log.Printf(err.Error())
-		return nil, errors.New("could not find user")
+var dummyHash []byte
+var dummyHashOnce sync.Once
+
+// unknownUserHash is compared against the passwords given for unknown
+// usernames, so that they take as long to reject as wrong passwords
+func unknownUserHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashPassword("not a password")
+	})
+	return dummyHash
+}
+
+// verifyUser checks a username and password, given from remoteAddr
+// (empty if not known). Repeated failures lock the account and the
+// address out for a while, and unknown usernames are treated exactly
+// as wrong passwords so that neither reveals which accounts exist
+func (uc *userCollection) verifyUser(ctx context.Context, uname, pwd, remoteAddr string) (entitycoll.Entity, error) {
+	now := time.Now()
+	wait := throttle.wait(accountKey(uname), now)
+	if remoteAddr != "" {
+		if addrWait := throttle.wait(addrKey(remoteAddr), now); addrWait > wait {
+			wait = addrWait
+		}
+	}
+	if wait > 0 {
+		return nil, entities.NewError(entities.RateLimited,
+			fmt.Sprintf("too many failed logins, try again in %s", wait.Round(time.Second)))
 	}
 
-	if err = bcrypt.CompareHashAndPassword(u.HashedPwd, []byte(pwd)); err != nil {
+	u, err := uc.getUserByUsername(ctx, uname)
+	if kind, _ := entities.ErrorKindOf(err); err != nil && kind != entities.NotFound {
 		return nil, err
 	}
+	hash := unknownUserHash()
+	if err == nil && !u.Service {
+		hash = u.HashedPwd
+	}
+
+	// service accounts are rejected as unknown users are, they only
+	// authenticate with API keys
+	if err = pwhash.Check(hash, []byte(pwd)); err != nil || u == nil || u.Service {
+		if err != nil && err != pwhash.ErrMismatch {
+			log.Printf("checking password of %q: %s", uname, err)
+		}
+		uc.loginFailed(ctx, uname, remoteAddr, now)
+		return nil, errBadCredentials
+	}
+	throttle.succeed(accountKey(uname))
+	uc.upgradeHash(ctx, u, pwd)
+
+	if !u.Approved {
+		return nil, entities.NewError(entities.Forbidden, "account is awaiting approval")
+	}
+
+	return (*user)(u), nil
+}
+
+// upgradeHash rehashes the password of u if its hash was made other
+// than as now configured, pwd having just been checked against it.
+// Failing to is only logged, the old hash still works. A password too
+// long to hash as now configured keeps its old hash
+func (uc *userCollection) upgradeHash(ctx context.Context, u *entities.User, pwd string) {
+	params := conf.passwordHashParams()
+	if !pwhash.NeedsRehash(params, u.HashedPwd) || len(pwd) > params.MaxPasswordLen() {
+		return
+	}
 
-	return u, nil
+	hpwd, err := hashPassword(pwd)
+	if err == nil {
+		err = uc.upgradeUserPassword(ctx, u.Uuid, u.HashedPwd, hpwd)
+	}
+	// NotFound means the password was changed meanwhile, so has a new
+	// hash already
+	if kind, _ := entities.ErrorKindOf(err); err != nil && kind != entities.NotFound {
+		log.Printf("upgrading password hash of %q: %s", u.Username, err)
+	}
+}
+
+// loginFailed counts a failed login against the account and address,
+// and records it and any lockout it causes as security events
+func (uc *userCollection) loginFailed(ctx context.Context, uname, remoteAddr string, now time.Time) {
+	uc.securityEvent(ctx, "login_failed", uname, remoteAddr, now)
+	if throttle.fail(accountKey(uname), accountFreeAttempts, now) {
+		uc.securityEvent(ctx, "account_locked", uname, remoteAddr, now)
+	}
+	if remoteAddr != "" && throttle.fail(addrKey(remoteAddr), addrFreeAttempts, now) {
+		uc.securityEvent(ctx, "address_locked", uname, remoteAddr, now)
+	}
+}
+
+func (uc *userCollection) securityEvent(ctx context.Context, kind, uname, remoteAddr string, now time.Time) {
+	log.Printf("security event %s: user %q from %q", kind, uname, remoteAddr)
+	e := entities.SecurityEvent{Kind: kind, Username: uname, RemoteAddr: remoteAddr, Created: now.UTC()}
+	if err := uc.recordSecurityEvent(ctx, &e); err != nil {
+		log.Printf("recording security event: %s", err)
+	}
 }
 
 // userCollection will implement entityCollection
@@ -59,23 +157,130 @@ func (uc *userCollection) GetParentCollection() entitycoll.APINode {
 }
 
 func (uc *userCollection) CreateEntity(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID, body []byte) (string, error) {
-	// TODO add dedicated error code to entity coll for
-	// not being able to create entity
-	return "", errors.New("create entity not allowed")
+	return uc.register(requestContext(requestor), body)
 }
 
 func (uc *userCollection) GetEntity(requestor entitycoll.Entity, targetUuid uuid.UUID) (entitycoll.Entity, error) {
-	return uc.getUserByUuid(targetUuid)
+	return uc.getUserByUuid(requestContext(requestor), targetUuid)
 }
 
 func (uc *userCollection) GetCollection(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID, filter entitycoll.CollFilter) (entitycoll.Collection, error) {
-	return entitycoll.Collection{}, nil
+	count, page, err := checkPage(filter)
+	if err != nil {
+		return entitycoll.Collection{}, err
+	}
+	return uc.list(requestContext(requestor), "", count, page)
 }
 
-func (uc *userCollection) EditEntity(requestor entitycoll.Entity, targetUuid uuid.UUID, body []byte) error {
+// list reads a page of the users whose usernames start with prefix
+func (uc *userCollection) list(ctx context.Context, prefix string, count uint64, page int64) (entitycoll.Collection, error) {
+	var ec entitycoll.Collection
+
+	var err error
+	ec.Entities, err = uc.getCollection(ctx, prefix, count, page)
+
+	if err != nil {
+		return entitycoll.Collection{}, err
+	}
+
+	ec.TotalEntities, err = uc.getTotal(ctx, prefix)
+
+	if err != nil {
+		return entitycoll.Collection{}, err
+	}
+
+	return ec, nil
+}
+
+const maxBioLen = 1000
+
+// userEdit is the body of a PUT to a user. Users edit their own
+// profiles, admins edit anyone's profile and role
+type userEdit struct {
+	entities.UserEdit
+}
+
+func (e *userEdit) validate() error {
+	for _, name := range []*string{e.FirstName, e.SecondName, e.DisplayName} {
+		if name != nil && utf8.RuneCountInString(*name) > maxNameLen {
+			return entities.NewError(entities.Validation, "names must be at most 100 characters")
+		}
+	}
+	if e.Bio != nil && utf8.RuneCountInString(*e.Bio) > maxBioLen {
+		return entities.NewError(entities.Validation, "bio must be at most 1000 characters")
+	}
+	if e.Role != nil && !validRole(*e.Role) {
+		return entities.NewError(entities.Validation, "unknown role "+string(*e.Role))
+	}
 	return nil
 }
 
+func validRole(role entities.Role) bool {
+	for _, r := range entities.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (uc *userCollection) EditEntity(requestor entitycoll.Entity, targetUuid uuid.UUID, body []byte) error {
+	var edit userEdit
+
+	err := json.Unmarshal(body, &edit)
+	if err != nil {
+		return entities.WrapError(entities.Validation, "malformed user edit", err)
+	}
+	if err = edit.validate(); err != nil {
+		return err
+	}
+
+	u, _ := requestorUser(requestor)
+	isSelf := uuid.Equal(u.Uuid, targetUuid)
+	isAdmin := u.Role == entities.RoleAdmin
+	if !isSelf && !isAdmin {
+		return entities.NewError(entities.Forbidden, "only its user or an admin can edit this profile")
+	}
+	if edit.Role != nil {
+		if !isAdmin {
+			return entities.NewError(entities.Forbidden, "only an admin can change roles")
+		}
+		// so that the last admin cannot lock everyone out of changing
+		// roles
+		if isSelf {
+			return entities.NewError(entities.Forbidden, "admins cannot change their own role")
+		}
+	}
+
+	return uc.editByUuid(requestContext(requestor), targetUuid, &edit.UserEdit)
+}
+
+// userSearchHandler serves GETs on /users with a `prefix` query
+// parameter, listing the users whose usernames start with it, for
+// autocompleting mentions. As for cursors, entitycoll's CollFilter has
+// no room for it, so every other request is passed on to next
+func userSearchHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		_, hasPrefix := query["prefix"]
+		if r.Method != "GET" || !hasPrefix || strings.Trim(r.URL.Path, "/") != users.GetRestName() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		serveRead(w, r, func(requestor entitycoll.Entity, count uint64, page int64) (interface{}, error) {
+			if err := authorize(requestor, users.GetRestName(), actionRead); err != nil {
+				return nil, err
+			}
+			collection, err := users.list(r.Context(), query.Get("prefix"), count, page)
+			if err == nil {
+				collection.Entities, err = projectAll(requestor, collection.Entities)
+			}
+			return collection, err
+		})
+	})
+}
+
 func (uc *userCollection) DelEntity(requestor entitycoll.Entity, targetUuid uuid.UUID) error {
-	return errors.New("del entity not allowed")
+	return entities.NewError(entities.Forbidden, "del entity not allowed")
 }
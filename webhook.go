@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/john-sharp/jerver/backend"
+	"github.com/john-sharp/jerver/entities"
+	"github.com/satori/go.uuid"
+	"gitlab.com/johncolinsharp/entitycoll"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookEvents are the events webhooks can be subscribed to
+var webhookEvents = []backend.EventType{
+	backend.MessageCreated,
+	backend.MessageEdited,
+	backend.MessageDeleted,
+	backend.ThreadCreated,
+	backend.ThreadDeleted,
+}
+
+// an event is posted to a webhook up to webhookMaxAttempts times,
+// waiting webhookRetryBase after the first failure and doubling the
+// wait after each further one
+const (
+	webhookMaxAttempts = 6
+	webhookRetryBase   = 30 * time.Second
+	webhookTimeout     = 10 * time.Second
+)
+
+// webhookAbandoned is how long a pending delivery goes without an
+// attempt before it is taken to have lost its job, such as when
+// queueing the job failed, and may be replayed. It is longer than the
+// longest wait between attempts
+const webhookAbandoned = webhookRetryBase << webhookMaxAttempts
+
+const minWebhookSecretLen = 16
+
+var webhooks webhookCollection
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// implementation of entityCollectionInterface...
+
+func (wc *webhookCollection) GetRestName() string {
+	return "webhooks"
+}
+
+func (wc *webhookCollection) GetParentCollection() entitycoll.APINode {
+	return nil
+}
+
+func validWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if string(e) == event {
+			return true
+		}
+	}
+	return false
+}
+
+func validateWebhookUrl(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return entities.NewError(entities.Validation, "webhook Url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+func validateWebhookEvents(events []string) error {
+	if len(events) == 0 {
+		return entities.NewError(entities.Validation, "webhook Events must name at least one event")
+	}
+	for _, e := range events {
+		if !validWebhookEvent(e) {
+			return entities.NewError(entities.Validation, "unknown webhook event "+strconv.Quote(e))
+		}
+	}
+	return nil
+}
+
+func validateWebhookSecret(secret string) error {
+	if len(secret) < minWebhookSecretLen {
+		return entities.NewError(entities.Validation, fmt.Sprintf("webhook Secret must be at least %d characters", minWebhookSecretLen))
+	}
+	return nil
+}
+
+// CreateEntity adds a webhook, generating its Secret unless one is
+// given. Admins read the secret back from the webhook to check
+// signatures with
+func (wc *webhookCollection) CreateEntity(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID, body []byte) (string, error) {
+	var data struct {
+		Url    string
+		Secret string
+		Events []string
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return "", entities.WrapError(entities.Validation, "malformed webhook", err)
+	}
+
+	if err := validateWebhookUrl(data.Url); err != nil {
+		return "", err
+	}
+	if err := validateWebhookEvents(data.Events); err != nil {
+		return "", err
+	}
+	var err error
+	if data.Secret == "" {
+		data.Secret, err = newToken()
+	} else {
+		err = validateWebhookSecret(data.Secret)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	w := entities.Webhook{
+		Url:     data.Url,
+		Secret:  data.Secret,
+		Events:  data.Events,
+		Created: time.Now().UTC(),
+	}
+	w.Id, _ = uuid.NewV4()
+	if err = wc.create(requestContext(requestor), &w); err != nil {
+		return "", err
+	}
+
+	return "/" + wc.GetRestName() + "/" + w.Id.String(), nil
+}
+
+func (wc *webhookCollection) GetEntity(requestor entitycoll.Entity, targetUuid uuid.UUID) (entitycoll.Entity, error) {
+	return wc.getByUuid(requestContext(requestor), targetUuid)
+}
+
+// GetCollection returns every webhook, there being few enough not to
+// need paging
+func (wc *webhookCollection) GetCollection(requestor entitycoll.Entity, parentEntityUuids map[string]uuid.UUID, filter entitycoll.CollFilter) (entitycoll.Collection, error) {
+	all, err := wc.getAll(requestContext(requestor))
+	if err != nil {
+		return entitycoll.Collection{}, err
+	}
+
+	var ec entitycoll.Collection
+	for _, w := range all {
+		ec.Entities = append(ec.Entities, w)
+	}
+	ec.TotalEntities = uint(len(all))
+	return ec, nil
+}
+
+func (wc *webhookCollection) EditEntity(requestor entitycoll.Entity, targetUuid uuid.UUID, body []byte) error {
+	var edit entities.WebhookEdit
+	if err := json.Unmarshal(body, &edit); err != nil {
+		return entities.WrapError(entities.Validation, "malformed webhook edit", err)
+	}
+
+	if edit.Url != nil {
+		if err := validateWebhookUrl(*edit.Url); err != nil {
+			return err
+		}
+	}
+	if edit.Secret != nil {
+		if err := validateWebhookSecret(*edit.Secret); err != nil {
+			return err
+		}
+	}
+	if edit.Events != nil {
+		if err := validateWebhookEvents(*edit.Events); err != nil {
+			return err
+		}
+	}
+
+	return wc.editByUuid(requestContext(requestor), targetUuid, &edit)
+}
+
+func (wc *webhookCollection) DelEntity(requestor entitycoll.Entity, targetUuid uuid.UUID) error {
+	return wc.deleteByUuid(requestContext(requestor), targetUuid)
+}
+
+// webhookPayload is the body posted to webhooks, Id being that of the
+// event. Data is the public representation of the message or thread,
+// or only its ids once it has been deleted
+type webhookPayload struct {
+	Id      uuid.UUID
+	Type    backend.EventType
+	Created time.Time
+	Data    interface{}
+}
+
+type deletedEntity struct {
+	Id       uuid.UUID
+	ThreadId *uuid.UUID `json:",omitempty"`
+}
+
+func webhookData(ctx context.Context, e backend.Event) (interface{}, error) {
+	deleted := deletedEntity{Id: e.MessageId, ThreadId: &e.ThreadId}
+	switch e.Type {
+	case backend.MessageCreated, backend.MessageEdited:
+		m, err := messages.getByUuid(ctx, e.MessageId)
+		if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+			return deleted, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return publicMessage(*m), nil
+	case backend.ThreadCreated:
+		t, err := threads.getByUuid(ctx, e.ThreadId)
+		if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+			return deletedEntity{Id: e.ThreadId}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return publicThread(*t), nil
+	case backend.ThreadDeleted:
+		return deletedEntity{Id: e.ThreadId}, nil
+	}
+	return deleted, nil
+}
+
+func subscribedTo(w entities.Webhook, event backend.EventType) bool {
+	for _, e := range w.Events {
+		if e == string(event) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle is subscribed to the backend. Every instance of the server
+// handles every event, the delivery to each webhook being made by the
+// instance that logs it first
+func (wc *webhookCollection) handle(e backend.Event) {
+	if !validWebhookEvent(string(e.Type)) {
+		return
+	}
+
+	ctx := context.Background()
+	all, err := wc.getAll(ctx)
+	if err != nil {
+		log.Printf("webhooks: %s", err)
+		return
+	}
+	var subscribed []entities.Webhook
+	for _, w := range all {
+		if subscribedTo(w, e.Type) {
+			subscribed = append(subscribed, w)
+		}
+	}
+	if len(subscribed) == 0 {
+		return
+	}
+
+	data, err := webhookData(ctx, e)
+	if err != nil {
+		log.Printf("webhooks: %s", err)
+		return
+	}
+	now := time.Now().UTC()
+	payload, err := json.Marshal(webhookPayload{Id: e.Id, Type: e.Type, Created: now, Data: data})
+	if err != nil {
+		log.Printf("webhooks: %s", err)
+		return
+	}
+
+	for _, w := range subscribed {
+		d := entities.WebhookDelivery{
+			WebhookId: w.Id,
+			EventId:   e.Id,
+			Event:     string(e.Type),
+			Payload:   string(payload),
+			Status:    entities.DeliveryPending,
+			Created:   now,
+			Updated:   now,
+		}
+		d.Id, _ = uuid.NewV4()
+		err := wc.createDelivery(ctx, &d)
+		if kind, _ := entities.ErrorKindOf(err); kind == entities.Conflict {
+			continue
+		}
+		if err == nil {
+			err = enqueueJob(ctx, jobWebhookDelivery, d.Id, time.Time{})
+		}
+		if err != nil {
+			log.Printf("webhooks: %s", err)
+		}
+	}
+}
+
+// webhookSignature is sent in the X-Jerver-Signature header, as
+// "sha256=" followed by the hex HMAC-SHA256, keyed with the webhook's
+// secret, of the X-Jerver-Timestamp header, '.' and the body
+func webhookSignature(secret, timestamp, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook makes one attempt at delivering d to w, returning the
+// status of the response if there was one
+func postWebhook(ctx context.Context, w *entities.Webhook, d *entities.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.Url, strings.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "jerver-webhooks")
+	req.Header.Set("X-Jerver-Event", d.Event)
+	req.Header.Set("X-Jerver-Delivery", d.Id.String())
+	req.Header.Set("X-Jerver-Timestamp", timestamp)
+	req.Header.Set("X-Jerver-Signature", webhookSignature(w.Secret, timestamp, d.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliverJob runs the jobWebhookDelivery jobs, making an attempt at
+// the delivery whose id is the job's payload and logging it. The
+// webhook is read for each attempt so that edits to it are used, and
+// deliveries to deleted webhooks stop
+func (wc *webhookCollection) deliverJob(ctx context.Context, j *entities.Job) error {
+	var id uuid.UUID
+	if err := json.Unmarshal([]byte(j.Payload), &id); err != nil {
+		return err
+	}
+	d, err := wc.getDelivery(ctx, id)
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	w, err := wc.getByUuid(ctx, d.WebhookId)
+	if kind, _ := entities.ErrorKindOf(err); kind == entities.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	d.ResponseStatus, err = postWebhook(ctx, w, d)
+	d.Attempts += 1
+	d.Error = ""
+	if err != nil {
+		d.Error = err.Error()
+	}
+	if err == nil {
+		d.Status = entities.DeliverySucceeded
+	} else if j.Attempts >= j.MaxAttempts {
+		d.Status = entities.DeliveryFailed
+	}
+	d.Updated = time.Now().UTC()
+
+	// logged even if ctx is done, as the attempt was made
+	if err := wc.updateDelivery(context.Background(), d); err != nil {
+		log.Printf("webhooks: %s", err)
+	}
+	return err
+}
+
+// replay delivers d again, with a fresh set of attempts
+func (wc *webhookCollection) replay(ctx context.Context, d *entities.WebhookDelivery) error {
+	if d.Status == entities.DeliveryPending && time.Since(d.Updated) < webhookAbandoned {
+		return entities.NewError(entities.Conflict, "webhook delivery is still being attempted")
+	}
+
+	d.Status = entities.DeliveryPending
+	d.Attempts = 0
+	d.ResponseStatus = 0
+	d.Error = ""
+	d.Updated = time.Now().UTC()
+	if err := wc.updateDelivery(ctx, d); err != nil {
+		return err
+	}
+	return enqueueJob(ctx, jobWebhookDelivery, d.Id, time.Time{})
+}
+
+// webhookDeliveryHandler serves the log of deliveries to a webhook,
+// GET /webhooks/{id}/deliveries (with page and count) and
+// /webhooks/{id}/deliveries/{id}, and replays a delivery on a POST to
+// /webhooks/{id}/deliveries/{id}/replay
+func webhookDeliveryHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(path) < 3 || path[0] != webhooks.GetRestName() || path[2] != "deliveries" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		act := actionRead
+		switch {
+		case r.Method == "GET" && (len(path) == 3 || len(path) == 4):
+		case r.Method == "POST" && len(path) == 5 && path[4] == "replay":
+			act = actionEdit
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		webhookId, err := uuid.FromString(path[1])
+		if err != nil {
+			writeError(w, entities.NewError(entities.Validation, "malformed webhook id"))
+			return
+		}
+		var deliveryId uuid.UUID
+		if len(path) > 3 {
+			if deliveryId, err = uuid.FromString(path[3]); err != nil {
+				writeError(w, entities.NewError(entities.Validation, "malformed webhook delivery id"))
+				return
+			}
+		}
+
+		w.Header().Add("Access-Control-Allow-Origin", conf.AllowOrigin)
+		requestor, err := authenticateRequest(r)
+		if err != nil {
+			w.Header().Add("WWW-Authenticate", "Basic realm=\"a\"")
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		if err = authorize(requestor, webhooks.GetRestName(), act); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if len(path) == 3 {
+			serveWebhookDeliveries(w, r, webhookId)
+			return
+		}
+
+		d, err := webhooks.getDelivery(r.Context(), deliveryId)
+		if err == nil && !uuid.Equal(d.WebhookId, webhookId) {
+			err = entities.NewError(entities.NotFound, "webhook delivery not found")
+		}
+		if err == nil && act == actionEdit {
+			err = webhooks.replay(r.Context(), d)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if act == actionEdit {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		json.NewEncoder(w).Encode(publicWebhookDelivery(*d))
+	})
+}
+
+func serveWebhookDeliveries(w http.ResponseWriter, r *http.Request, webhookId uuid.UUID) {
+	var count uint64
+	var page int64
+	filter, err := queryFilter(r.URL.Query())
+	if err == nil {
+		count, page, err = checkPage(filter)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err = webhooks.getByUuid(r.Context(), webhookId); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var collection entitycoll.Collection
+	collection.Entities, err = webhooks.getDeliveries(r.Context(), webhookId, count, page)
+	if err == nil {
+		collection.TotalEntities, err = webhooks.getDeliveryTotal(r.Context(), webhookId)
+	}
+	if err == nil {
+		collection.Entities, err = projectAll(nil, collection.Entities)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collection)
+}